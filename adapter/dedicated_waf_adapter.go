@@ -0,0 +1,198 @@
+package adapter
+
+import (
+	"fmt"
+	golangsdk "github.com/opentelekomcloud/gophertelekomcloud"
+	dedicatedWaf "github.com/opentelekomcloud/gophertelekomcloud/openstack/waf-premium/v1/certificates"
+	dedicatedWafHost "github.com/opentelekomcloud/gophertelekomcloud/openstack/waf-premium/v1/hosts"
+	waf "github.com/opentelekomcloud/gophertelekomcloud/openstack/waf/v1/certificates"
+	wafDomain "github.com/opentelekomcloud/gophertelekomcloud/openstack/waf/v1/domains"
+	"log"
+	"strconv"
+	"waf-cert-uploader/metrics"
+)
+
+// dedicatedWafPageSize is the largest page size the dedicated waf accepts.
+const dedicatedWafPageSize = 100
+
+// DedicatedWafCertificateManager calls a dedicated waf instance once per operation. The protected hosts of the
+// dedicated waf are mapped to waf domains, so the certificate service handles both wafs the same way.
+type DedicatedWafCertificateManager struct {
+	client *golangsdk.ServiceClient
+}
+
+func NewDedicatedWafCertificateManager(client *golangsdk.ServiceClient) *DedicatedWafCertificateManager {
+	return &DedicatedWafCertificateManager{client: client}
+}
+
+func (m *DedicatedWafCertificateManager) CreateCertificate(opts waf.CreateOpts) (*waf.Certificate, error) {
+	certificate, err := dedicatedWaf.Create(m.client, dedicatedWaf.CreateOpts{
+		Name:    opts.Name,
+		Content: opts.Content,
+		Key:     opts.Key,
+	})
+	metrics.RecordWafApiCall("dedicated_create_certificate", err)
+	if err != nil {
+		return nil, err
+	}
+	return &waf.Certificate{
+		Id:         certificate.ID,
+		Name:       certificate.Name,
+		ExpireTime: int(certificate.ExpireAt),
+		Timestamp:  int(certificate.CreatedAt),
+	}, nil
+}
+
+func (m *DedicatedWafCertificateManager) DeleteCertificate(id string) error {
+	err := dedicatedWaf.Delete(m.client, id)
+	metrics.RecordWafApiCall("dedicated_delete_certificate", err)
+	return err
+}
+
+// ListCertificates lists all certificates of the dedicated waf. The sdk returns a single page, so the pages are
+// requested until one is not full.
+func (m *DedicatedWafCertificateManager) ListCertificates() ([]waf.Certificate, error) {
+	var certificates []waf.Certificate
+	for page := 1; ; page++ {
+		certificatesPage, err := dedicatedWaf.List(m.client, dedicatedWaf.ListOpts{
+			PageSize: strconv.Itoa(dedicatedWafPageSize),
+			Page:     strconv.Itoa(page),
+		})
+		metrics.RecordWafApiCall("dedicated_list_certificates", err)
+		if err != nil {
+			log.Println(err)
+			return []waf.Certificate{}, err
+		}
+		for _, certificate := range certificatesPage {
+			certificates = append(certificates, waf.Certificate{
+				Id:        certificate.ID,
+				Name:      certificate.Name,
+				Timestamp: int(certificate.CreatedAt),
+			})
+		}
+		if len(certificatesPage) < dedicatedWafPageSize {
+			return certificates, nil
+		}
+	}
+}
+
+func (m *DedicatedWafCertificateManager) GetDomain(domainId string) (*wafDomain.Domain, error) {
+	host, err := dedicatedWafHost.Get(m.client, domainId)
+	metrics.RecordWafApiCall("dedicated_get_host", err)
+	if err != nil {
+		return nil, err
+	}
+	domain := toWafDomain(*host)
+	return &domain, nil
+}
+
+// UpdateDomain binds the certificate of the options to the host. The dedicated waf needs the name of the
+// certificate as well, so it is looked up first. The origin servers of a host can't be changed, because the sdk
+// can't update them; options that would change them are rejected, the host needs an https server already.
+func (m *DedicatedWafCertificateManager) UpdateDomain(
+	domainId string,
+	opts wafDomain.UpdateOpts) (*wafDomain.Domain, error) {
+	if opts.Server != nil {
+		host, err := m.GetDomain(domainId)
+		if err != nil {
+			return nil, err
+		}
+		if !sameServers(host.Server, opts.Server) {
+			return nil, fmt.Errorf("%w: the servers of dedicated waf host %s can't be changed, "+
+				"add an https server to the host", ErrInvalidConfiguration, domainId)
+		}
+	}
+
+	certificate, err := dedicatedWaf.Get(m.client, opts.CertificateId)
+	metrics.RecordWafApiCall("dedicated_get_certificate", err)
+	if err != nil {
+		return nil, err
+	}
+
+	// the update options of the sdk aren't omitted when empty and would reset the host, so only the
+	// certificate is sent
+	body := map[string]string{
+		"certificateid":   certificate.ID,
+		"certificatename": certificate.Name,
+	}
+	var host dedicatedWafHost.Host
+	_, err = m.client.Put(m.client.ServiceURL("premium-waf", "host", domainId), body, &host, &golangsdk.RequestOpts{
+		OkCodes: []int{200},
+	})
+	metrics.RecordWafApiCall("dedicated_update_host", err)
+	if err != nil {
+		return nil, err
+	}
+	domain := toWafDomain(host)
+	return &domain, nil
+}
+
+// ListDomains lists all hosts of the dedicated waf page by page. The listed hosts are summaries without their
+// certificate, so every host is read on its own as well; the garbage collection relies on the certificates.
+func (m *DedicatedWafCertificateManager) ListDomains() ([]wafDomain.Domain, error) {
+	var domains []wafDomain.Domain
+	for page := 1; ; page++ {
+		hosts, err := dedicatedWafHost.List(m.client, dedicatedWafHost.ListOpts{
+			PageSize: strconv.Itoa(dedicatedWafPageSize),
+			Page:     strconv.Itoa(page),
+		})
+		metrics.RecordWafApiCall("dedicated_list_hosts", err)
+		if err != nil {
+			log.Println(err)
+			return []wafDomain.Domain{}, err
+		}
+		for _, host := range hosts {
+			domain, err := m.GetDomain(host.ID)
+			if err != nil {
+				log.Println(err)
+				return []wafDomain.Domain{}, err
+			}
+			domains = append(domains, *domain)
+		}
+		if len(hosts) < dedicatedWafPageSize {
+			return domains, nil
+		}
+	}
+}
+
+// sameServers ignores the order of the servers.
+func sameServers(servers []wafDomain.Server, serverOpts []wafDomain.ServerOpts) bool {
+	if len(servers) != len(serverOpts) {
+		return false
+	}
+	remaining := map[wafDomain.ServerOpts]int{}
+	for _, server := range servers {
+		remaining[wafDomain.ServerOpts{
+			ClientProtocol: server.ClientProtocol,
+			ServerProtocol: server.ServerProtocol,
+			Address:        server.Address,
+			Port:           server.Port,
+		}]++
+	}
+	for _, server := range serverOpts {
+		if remaining[server] == 0 {
+			return false
+		}
+		remaining[server]--
+	}
+	return true
+}
+
+func toWafDomain(host dedicatedWafHost.Host) wafDomain.Domain {
+	var servers []wafDomain.Server
+	for _, server := range host.Server {
+		servers = append(servers, wafDomain.Server{
+			ClientProtocol: server.FrontProtocol,
+			ServerProtocol: server.BackProtocol,
+			Address:        server.Address,
+			Port:           server.Port,
+		})
+	}
+	return wafDomain.Domain{
+		Id:            host.ID,
+		HostName:      host.Hostname,
+		Protocol:      host.Protocol,
+		CertificateId: host.CertificateId,
+		Server:        servers,
+	}
+}
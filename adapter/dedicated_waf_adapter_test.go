@@ -0,0 +1,119 @@
+package adapter
+
+import (
+	"errors"
+	"fmt"
+	golangsdk "github.com/opentelekomcloud/gophertelekomcloud"
+	waf "github.com/opentelekomcloud/gophertelekomcloud/openstack/waf/v1/certificates"
+	wafDomain "github.com/opentelekomcloud/gophertelekomcloud/openstack/waf/v1/domains"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"waf-cert-uploader/adapter/otctest"
+)
+
+func newTestDedicatedWafCertificateManager(t *testing.T) (*DedicatedWafCertificateManager, *otctest.OtcServer) {
+	server := otctest.NewServer()
+	t.Cleanup(server.Close)
+	wafClient, err := server.NewDedicatedWafClient()
+	assert.Nil(t, err)
+	return NewDedicatedWafCertificateManager(wafClient), server
+}
+
+func TestDedicatedWafCertificateManager_listsAllPages(t *testing.T) {
+	manager, server := newTestDedicatedWafCertificateManager(t)
+	for i := 0; i < 123; i++ {
+		server.AddDedicatedCertificate(otctest.Certificate{Id: fmt.Sprintf("certificate-%03d", i), Name: fmt.Sprintf("hash-%03d", i)})
+	}
+	for i := 0; i < 3; i++ {
+		server.AddHost(otctest.Host{Id: fmt.Sprintf("host-%02d", i), HostName: "my.domain.com"})
+	}
+	server.AddHost(otctest.Host{Id: "host-03", HostName: "my.domain.com", CertificateId: "certificate-122"})
+
+	certificates, err := manager.ListCertificates()
+	assert.Nil(t, err)
+	assert.Len(t, certificates, 123)
+	assert.Equal(t, "hash-122", certificates[122].Name)
+
+	domains, err := manager.ListDomains()
+	assert.Nil(t, err)
+	assert.Len(t, domains, 4)
+	assert.Equal(t, "host-03", domains[3].Id)
+	assert.Equal(t, "certificate-122", domains[3].CertificateId)
+
+	assert.Equal(t, []string{"create_token", "list_dedicated_certificates", "list_dedicated_certificates",
+		"list_hosts", "get_host", "get_host", "get_host", "get_host"}, server.Calls())
+}
+
+func TestDedicatedWafCertificateManager_attachAndDelete(t *testing.T) {
+	manager, server := newTestDedicatedWafCertificateManager(t)
+	server.AddHost(otctest.Host{Id: "host-1", HostName: "my.domain.com", Server: []otctest.HostServer{
+		{FrontProtocol: "HTTPS", BackProtocol: "HTTP", Address: "10.0.0.1", Port: 80, Type: "ipv4", VpcId: "vpc"}}})
+
+	certificate, err := manager.CreateCertificate(waf.CreateOpts{Name: "hash", Content: "cert", Key: "key"})
+	assert.Nil(t, err)
+	assert.Equal(t, "certificate-1", certificate.Id)
+	assert.NotZero(t, certificate.ExpireTime)
+
+	domain, err := manager.GetDomain("host-1")
+	assert.Nil(t, err)
+	assert.Equal(t, []wafDomain.Server{{ClientProtocol: "HTTPS", ServerProtocol: "HTTP", Address: "10.0.0.1", Port: 80}},
+		domain.Server)
+
+	updatedDomain, err := manager.UpdateDomain("host-1", wafDomain.UpdateOpts{CertificateId: certificate.Id})
+	assert.Nil(t, err)
+	assert.Equal(t, "certificate-1", updatedDomain.CertificateId)
+	host, _ := server.Host("host-1")
+	assert.Equal(t, "hash", host.CertificateName)
+	assert.Len(t, host.Server, 1)
+
+	err = manager.DeleteCertificate(certificate.Id)
+	var badRequest golangsdk.ErrDefault400
+	assert.True(t, errors.As(err, &badRequest))
+
+	_, err = manager.CreateCertificate(waf.CreateOpts{Name: "hash", Content: "cert", Key: "key"})
+	assert.True(t, errors.As(err, &badRequest))
+}
+
+func TestDedicatedWafCertificateManager_deleteCertificate(t *testing.T) {
+	manager, server := newTestDedicatedWafCertificateManager(t)
+	server.AddDedicatedCertificate(otctest.Certificate{Id: "certificate-1", Name: "hash"})
+
+	assert.Nil(t, manager.DeleteCertificate("certificate-1"))
+	assert.Empty(t, server.DedicatedCertificates())
+	assert.True(t, isNotFound(manager.DeleteCertificate("certificate-1")))
+}
+
+func TestDedicatedWafCertificateManager_updateWithUnknownCertificate(t *testing.T) {
+	manager, server := newTestDedicatedWafCertificateManager(t)
+	server.AddHost(otctest.Host{Id: "host-1", HostName: "my.domain.com"})
+
+	_, err := manager.UpdateDomain("host-1", wafDomain.UpdateOpts{CertificateId: "unknown"})
+
+	assert.True(t, isNotFound(err))
+	assert.Equal(t, []string{"create_token", "get_dedicated_certificate"}, server.Calls())
+}
+
+func TestDedicatedWafCertificateManager_updateRejectsChangedServers(t *testing.T) {
+	manager, server := newTestDedicatedWafCertificateManager(t)
+	server.AddDedicatedCertificate(otctest.Certificate{Id: "certificate-1", Name: "hash"})
+	server.AddHost(otctest.Host{Id: "host-1", HostName: "my.domain.com", Server: []otctest.HostServer{
+		{FrontProtocol: "HTTP", BackProtocol: "HTTP", Address: "10.0.0.1", Port: 80, Type: "ipv4", VpcId: "vpc"}}})
+	unchangedServers := []wafDomain.ServerOpts{
+		{ClientProtocol: "HTTP", ServerProtocol: "HTTP", Address: "10.0.0.1", Port: 80}}
+	addedHttpsServer := append(unchangedServers,
+		wafDomain.ServerOpts{ClientProtocol: "HTTPS", ServerProtocol: "HTTPS", Address: "10.0.0.1", Port: 443})
+
+	_, err := manager.UpdateDomain("host-1", wafDomain.UpdateOpts{CertificateId: "certificate-1", Server: addedHttpsServer})
+
+	assert.ErrorIs(t, err, ErrInvalidConfiguration)
+	host, _ := server.Host("host-1")
+	assert.Empty(t, host.CertificateId)
+	assert.Len(t, host.Server, 1)
+
+	domain, err := manager.UpdateDomain("host-1", wafDomain.UpdateOpts{CertificateId: "certificate-1", Server: unchangedServers})
+
+	assert.Nil(t, err)
+	assert.Equal(t, "certificate-1", domain.CertificateId)
+	assert.Equal(t, []string{"create_token", "get_host", "get_host", "get_dedicated_certificate", "update_host"},
+		server.Calls())
+}
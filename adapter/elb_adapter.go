@@ -0,0 +1,140 @@
+package adapter
+
+import (
+	golangsdk "github.com/opentelekomcloud/gophertelekomcloud"
+	elb "github.com/opentelekomcloud/gophertelekomcloud/openstack/elb/v3/certificates"
+	elbListener "github.com/opentelekomcloud/gophertelekomcloud/openstack/elb/v3/listeners"
+	"log"
+	"waf-cert-uploader/metrics"
+)
+
+// ElbCertificateManager manages the certificates and listeners of the elastic load balancers.
+type ElbCertificateManager interface {
+	CreateCertificate(opts elb.CreateOpts) (*elb.Certificate, error)
+	DeleteCertificate(id string) error
+	ListCertificates() ([]elb.Certificate, error)
+	GetListener(listenerId string) (*elbListener.Listener, error)
+	UpdateListener(listenerId string, opts elbListener.UpdateOpts) (*elbListener.Listener, error)
+}
+
+// OtcElbCertificateManager calls the elb v3 api of the open telekom cloud once per operation.
+type OtcElbCertificateManager struct {
+	client *golangsdk.ServiceClient
+}
+
+func NewOtcElbCertificateManager(client *golangsdk.ServiceClient) *OtcElbCertificateManager {
+	return &OtcElbCertificateManager{client: client}
+}
+
+func (m *OtcElbCertificateManager) CreateCertificate(opts elb.CreateOpts) (*elb.Certificate, error) {
+	certificate, err := elb.Create(m.client, opts).Extract()
+	metrics.RecordElbApiCall("create_certificate", err)
+	return certificate, err
+}
+
+func (m *OtcElbCertificateManager) DeleteCertificate(id string) error {
+	err := elb.Delete(m.client, id).ExtractErr()
+	metrics.RecordElbApiCall("delete_certificate", err)
+	return err
+}
+
+func (m *OtcElbCertificateManager) ListCertificates() ([]elb.Certificate, error) {
+	pages, err := elb.List(m.client, elb.ListOpts{}).AllPages()
+	metrics.RecordElbApiCall("list_certificates", err)
+	if err != nil {
+		log.Println(err)
+		return []elb.Certificate{}, err
+	}
+	return elb.ExtractCertificates(pages)
+}
+
+func (m *OtcElbCertificateManager) GetListener(listenerId string) (*elbListener.Listener, error) {
+	listener, err := elbListener.Get(m.client, listenerId).Extract()
+	metrics.RecordElbApiCall("get_listener", err)
+	return listener, err
+}
+
+func (m *OtcElbCertificateManager) UpdateListener(
+	listenerId string,
+	opts elbListener.UpdateOpts) (*elbListener.Listener, error) {
+	listener, err := elbListener.Update(m.client, listenerId, opts).Extract()
+	metrics.RecordElbApiCall("update_listener", err)
+	return listener, err
+}
+
+// RetryingElbCertificateManager retries the transient errors of another ElbCertificateManager.
+type RetryingElbCertificateManager struct {
+	retrier
+	next ElbCertificateManager
+}
+
+func NewRetryingElbCertificateManager(next ElbCertificateManager, policy RetryPolicy) *RetryingElbCertificateManager {
+	return &RetryingElbCertificateManager{retrier: newRetrier(policy, "elb", metrics.RecordElbApiRetry), next: next}
+}
+
+// CreateCertificate is retried only after checking that the certificate wasn't created by the failed attempt.
+func (m *RetryingElbCertificateManager) CreateCertificate(opts elb.CreateOpts) (*elb.Certificate, error) {
+	var certificate *elb.Certificate
+	err := m.withRetries("create_certificate", func(attempt int) error {
+		if attempt > 1 {
+			certificates, err := m.next.ListCertificates()
+			if err != nil {
+				return err
+			}
+			for _, existingCertificate := range certificates {
+				if existingCertificate.Name == opts.Name {
+					log.Printf("elb certificate %s was created by a failed attempt", opts.Name)
+					certificate = &existingCertificate
+					return nil
+				}
+			}
+		}
+		var err error
+		certificate, err = m.next.CreateCertificate(opts)
+		return err
+	})
+	return certificate, err
+}
+
+// DeleteCertificate treats a certificate that is not found after a failed attempt as deleted.
+func (m *RetryingElbCertificateManager) DeleteCertificate(id string) error {
+	return m.withRetries("delete_certificate", func(attempt int) error {
+		err := m.next.DeleteCertificate(id)
+		if attempt > 1 && isNotFound(err) {
+			return nil
+		}
+		return err
+	})
+}
+
+func (m *RetryingElbCertificateManager) ListCertificates() ([]elb.Certificate, error) {
+	var certificates []elb.Certificate
+	err := m.withRetries("list_certificates", func(int) error {
+		var err error
+		certificates, err = m.next.ListCertificates()
+		return err
+	})
+	return certificates, err
+}
+
+func (m *RetryingElbCertificateManager) GetListener(listenerId string) (*elbListener.Listener, error) {
+	var listener *elbListener.Listener
+	err := m.withRetries("get_listener", func(int) error {
+		var err error
+		listener, err = m.next.GetListener(listenerId)
+		return err
+	})
+	return listener, err
+}
+
+func (m *RetryingElbCertificateManager) UpdateListener(
+	listenerId string,
+	opts elbListener.UpdateOpts) (*elbListener.Listener, error) {
+	var listener *elbListener.Listener
+	err := m.withRetries("update_listener", func(int) error {
+		var err error
+		listener, err = m.next.UpdateListener(listenerId, opts)
+		return err
+	})
+	return listener, err
+}
@@ -0,0 +1,92 @@
+package adapter
+
+import (
+	"errors"
+	golangsdk "github.com/opentelekomcloud/gophertelekomcloud"
+	elb "github.com/opentelekomcloud/gophertelekomcloud/openstack/elb/v3/certificates"
+	elbListener "github.com/opentelekomcloud/gophertelekomcloud/openstack/elb/v3/listeners"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+	"waf-cert-uploader/adapter/otctest"
+)
+
+func newTestOtcElbCertificateManager(t *testing.T) (*OtcElbCertificateManager, *otctest.OtcServer) {
+	server := otctest.NewServer()
+	t.Cleanup(server.Close)
+	elbClient, err := server.NewElbClient()
+	assert.Nil(t, err)
+	return NewOtcElbCertificateManager(elbClient), server
+}
+
+func TestOtcElbCertificateManager_bindAndDelete(t *testing.T) {
+	manager, server := newTestOtcElbCertificateManager(t)
+	server.AddElbCertificate(otctest.ElbCertificate{Id: "previous", Name: "previous-hash", Domain: "my.domain.com"})
+	server.AddListener(otctest.Listener{Id: "listener-1", Protocol: "HTTPS", DefaultTlsContainerRef: "previous",
+		SniContainerRefs: []string{"previous"}})
+
+	certificate, err := manager.CreateCertificate(elb.CreateOpts{Name: "hash", Type: "server",
+		Domain: "my.domain.com,www.my.domain.com", Certificate: "cert", PrivateKey: "key"})
+	assert.Nil(t, err)
+	assert.Equal(t, "elb-certificate-1", certificate.ID)
+	assert.Equal(t, "my.domain.com,www.my.domain.com", certificate.Domain)
+
+	certificates, err := manager.ListCertificates()
+	assert.Nil(t, err)
+	assert.Len(t, certificates, 2)
+
+	listener, err := manager.GetListener("listener-1")
+	assert.Nil(t, err)
+	assert.Equal(t, "HTTPS", listener.Protocol)
+
+	sniContainerRefs := []string{certificate.ID}
+	updatedListener, err := manager.UpdateListener("listener-1", elbListener.UpdateOpts{SniContainerRefs: &sniContainerRefs})
+	assert.Nil(t, err)
+	assert.Equal(t, "previous", updatedListener.DefaultTlsContainerRef)
+	assert.Equal(t, []string{"elb-certificate-1"}, updatedListener.SniContainerRefs)
+
+	err = manager.DeleteCertificate("previous")
+	var conflict golangsdk.ErrDefault409
+	assert.True(t, errors.As(err, &conflict))
+
+	defaultTlsContainerRef := certificate.ID
+	_, err = manager.UpdateListener("listener-1", elbListener.UpdateOpts{DefaultTlsContainerRef: &defaultTlsContainerRef})
+	assert.Nil(t, err)
+	assert.Nil(t, manager.DeleteCertificate("previous"))
+	assert.Len(t, server.ElbCertificates(), 1)
+	assert.True(t, isNotFound(manager.DeleteCertificate("unknown")))
+}
+
+func TestOtcElbCertificateManager_sniCertificateNeedsDomain(t *testing.T) {
+	manager, server := newTestOtcElbCertificateManager(t)
+	server.AddListener(otctest.Listener{Id: "listener-1", Protocol: "HTTPS"})
+	certificate, err := manager.CreateCertificate(elb.CreateOpts{Name: "hash", Type: "server",
+		Certificate: "cert", PrivateKey: "key"})
+	assert.Nil(t, err)
+
+	sniContainerRefs := []string{certificate.ID}
+	_, err = manager.UpdateListener("listener-1", elbListener.UpdateOpts{SniContainerRefs: &sniContainerRefs})
+
+	var badRequest golangsdk.ErrDefault400
+	assert.True(t, errors.As(err, &badRequest))
+	defaultTlsContainerRef := certificate.ID
+	_, err = manager.UpdateListener("listener-1", elbListener.UpdateOpts{DefaultTlsContainerRef: &defaultTlsContainerRef})
+	assert.Nil(t, err)
+}
+
+func TestRetryingElbCertificateManager_doesNotCreateTwice(t *testing.T) {
+	otcManager, server := newTestOtcElbCertificateManager(t)
+	server.FailNext("create_elb_certificate", http.StatusServiceUnavailable)
+	manager := NewRetryingElbCertificateManager(otcManager, DefaultRetryPolicy)
+	manager.sleep = func(time.Duration) {}
+
+	certificate, err := manager.CreateCertificate(elb.CreateOpts{Name: "hash", Type: "server",
+		Certificate: "cert", PrivateKey: "key"})
+
+	assert.Nil(t, err)
+	assert.Equal(t, "hash", certificate.Name)
+	assert.Len(t, server.ElbCertificates(), 1)
+	assert.Equal(t, []string{"create_token", "create_elb_certificate", "list_elb_certificates",
+		"create_elb_certificate"}, server.Calls())
+}
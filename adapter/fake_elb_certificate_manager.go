@@ -0,0 +1,165 @@
+package adapter
+
+import (
+	"fmt"
+	golangsdk "github.com/opentelekomcloud/gophertelekomcloud"
+	elb "github.com/opentelekomcloud/gophertelekomcloud/openstack/elb/v3/certificates"
+	elbListener "github.com/opentelekomcloud/gophertelekomcloud/openstack/elb/v3/listeners"
+	"sort"
+	"sync"
+)
+
+// FakeElbCertificateManager keeps elb certificates and listeners in memory. Every call is recorded like
+// in the FakeWafCertificateManager, e.g. "UpdateListener listener-1". Like the elb, it refuses sni certificates
+// without a domain.
+type FakeElbCertificateManager struct {
+	mutex        sync.Mutex
+	certificates map[string]elb.Certificate
+	listeners    map[string]elbListener.Listener
+	failures     map[string][]error
+	calls        []string
+	createdCount int
+}
+
+func NewFakeElbCertificateManager() *FakeElbCertificateManager {
+	return &FakeElbCertificateManager{
+		certificates: map[string]elb.Certificate{},
+		listeners:    map[string]elbListener.Listener{},
+		failures:     map[string][]error{},
+	}
+}
+
+func (m *FakeElbCertificateManager) AddCertificate(certificate elb.Certificate) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.certificates[certificate.ID] = certificate
+}
+
+func (m *FakeElbCertificateManager) AddListener(listener elbListener.Listener) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.listeners[listener.ID] = listener
+}
+
+func (m *FakeElbCertificateManager) Certificate(id string) (elb.Certificate, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	certificate, found := m.certificates[id]
+	return certificate, found
+}
+
+func (m *FakeElbCertificateManager) Listener(id string) elbListener.Listener {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.listeners[id]
+}
+
+// FailNext lets the next calls of a recorded call, e.g. "UpdateListener listener-1", fail in order.
+func (m *FakeElbCertificateManager) FailNext(call string, errs ...error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.failures[call] = append(m.failures[call], errs...)
+}
+
+func (m *FakeElbCertificateManager) Calls() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]string{}, m.calls...)
+}
+
+func (m *FakeElbCertificateManager) record(call string) error {
+	m.calls = append(m.calls, call)
+	errs := m.failures[call]
+	if len(errs) == 0 {
+		return nil
+	}
+	m.failures[call] = errs[1:]
+	return errs[0]
+}
+
+func (m *FakeElbCertificateManager) CreateCertificate(opts elb.CreateOpts) (*elb.Certificate, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if err := m.record("CreateCertificate"); err != nil {
+		return nil, err
+	}
+	m.createdCount++
+	certificate := elb.Certificate{
+		ID:          fmt.Sprintf("elb-cert-%d", m.createdCount),
+		Name:        opts.Name,
+		Type:        opts.Type,
+		Domain:      opts.Domain,
+		Certificate: opts.Certificate,
+	}
+	m.certificates[certificate.ID] = certificate
+	return &certificate, nil
+}
+
+func (m *FakeElbCertificateManager) DeleteCertificate(id string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if err := m.record("DeleteCertificate " + id); err != nil {
+		return err
+	}
+	if _, found := m.certificates[id]; !found {
+		return golangsdk.ErrDefault404{}
+	}
+	delete(m.certificates, id)
+	return nil
+}
+
+func (m *FakeElbCertificateManager) ListCertificates() ([]elb.Certificate, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if err := m.record("ListCertificates"); err != nil {
+		return nil, err
+	}
+	certificates := []elb.Certificate{}
+	for _, certificate := range m.certificates {
+		certificates = append(certificates, certificate)
+	}
+	sort.Slice(certificates, func(i, j int) bool { return certificates[i].ID < certificates[j].ID })
+	return certificates, nil
+}
+
+func (m *FakeElbCertificateManager) GetListener(listenerId string) (*elbListener.Listener, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if err := m.record("GetListener " + listenerId); err != nil {
+		return nil, err
+	}
+	listener, found := m.listeners[listenerId]
+	if !found {
+		return nil, golangsdk.ErrDefault404{}
+	}
+	return &listener, nil
+}
+
+func (m *FakeElbCertificateManager) UpdateListener(
+	listenerId string,
+	opts elbListener.UpdateOpts) (*elbListener.Listener, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if err := m.record("UpdateListener " + listenerId); err != nil {
+		return nil, err
+	}
+	listener, found := m.listeners[listenerId]
+	if !found {
+		return nil, golangsdk.ErrDefault404{}
+	}
+	if opts.SniContainerRefs != nil {
+		for _, ref := range *opts.SniContainerRefs {
+			if certificate, found := m.certificates[ref]; found && len(certificate.Domain) == 0 {
+				return nil, golangsdk.ErrDefault400{}
+			}
+		}
+	}
+	if opts.DefaultTlsContainerRef != nil {
+		listener.DefaultTlsContainerRef = *opts.DefaultTlsContainerRef
+	}
+	if opts.SniContainerRefs != nil {
+		listener.SniContainerRefs = append([]string{}, *opts.SniContainerRefs...)
+	}
+	m.listeners[listenerId] = listener
+	return &listener, nil
+}
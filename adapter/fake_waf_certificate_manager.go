@@ -0,0 +1,176 @@
+package adapter
+
+import (
+	"fmt"
+	golangsdk "github.com/opentelekomcloud/gophertelekomcloud"
+	waf "github.com/opentelekomcloud/gophertelekomcloud/openstack/waf/v1/certificates"
+	wafDomain "github.com/opentelekomcloud/gophertelekomcloud/openstack/waf/v1/domains"
+	"sort"
+	"sync"
+	"time"
+)
+
+// FakeWafCertificateManager keeps certificates and domains in memory. Every call is recorded as
+// the operation name followed by the id it affects, e.g. "UpdateDomain domain-1".
+type FakeWafCertificateManager struct {
+	mutex        sync.Mutex
+	certificates map[string]waf.Certificate
+	domains      map[string]wafDomain.Domain
+	failures     map[string][]error
+	calls        []string
+	createdCount int
+}
+
+func NewFakeWafCertificateManager() *FakeWafCertificateManager {
+	return &FakeWafCertificateManager{
+		certificates: map[string]waf.Certificate{},
+		domains:      map[string]wafDomain.Domain{},
+		failures:     map[string][]error{},
+	}
+}
+
+func (m *FakeWafCertificateManager) AddCertificate(certificate waf.Certificate) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.certificates[certificate.Id] = certificate
+}
+
+func (m *FakeWafCertificateManager) AddDomain(domain wafDomain.Domain) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.domains[domain.Id] = domain
+}
+
+func (m *FakeWafCertificateManager) Certificate(id string) (waf.Certificate, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	certificate, found := m.certificates[id]
+	return certificate, found
+}
+
+func (m *FakeWafCertificateManager) Domain(id string) wafDomain.Domain {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.domains[id]
+}
+
+// FailNext lets the next calls of a recorded call, e.g. "UpdateDomain domain-1" or "ListCertificates", fail in order.
+func (m *FakeWafCertificateManager) FailNext(call string, errs ...error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.failures[call] = append(m.failures[call], errs...)
+}
+
+func (m *FakeWafCertificateManager) Calls() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]string{}, m.calls...)
+}
+
+func (m *FakeWafCertificateManager) record(call string) error {
+	m.calls = append(m.calls, call)
+	errs := m.failures[call]
+	if len(errs) == 0 {
+		return nil
+	}
+	m.failures[call] = errs[1:]
+	return errs[0]
+}
+
+func (m *FakeWafCertificateManager) CreateCertificate(opts waf.CreateOpts) (*waf.Certificate, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if err := m.record("CreateCertificate"); err != nil {
+		return nil, err
+	}
+	m.createdCount++
+	certificate := waf.Certificate{
+		Id:        fmt.Sprintf("cert-%d", m.createdCount),
+		Name:      opts.Name,
+		Timestamp: int(time.Now().UnixMilli()),
+	}
+	m.certificates[certificate.Id] = certificate
+	return &certificate, nil
+}
+
+func (m *FakeWafCertificateManager) DeleteCertificate(id string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if err := m.record("DeleteCertificate " + id); err != nil {
+		return err
+	}
+	if _, found := m.certificates[id]; !found {
+		return golangsdk.ErrDefault404{}
+	}
+	delete(m.certificates, id)
+	return nil
+}
+
+func (m *FakeWafCertificateManager) ListCertificates() ([]waf.Certificate, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if err := m.record("ListCertificates"); err != nil {
+		return nil, err
+	}
+	certificates := []waf.Certificate{}
+	for _, certificate := range m.certificates {
+		certificates = append(certificates, certificate)
+	}
+	sort.Slice(certificates, func(i, j int) bool { return certificates[i].Id < certificates[j].Id })
+	return certificates, nil
+}
+
+func (m *FakeWafCertificateManager) GetDomain(domainId string) (*wafDomain.Domain, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if err := m.record("GetDomain " + domainId); err != nil {
+		return nil, err
+	}
+	domain, found := m.domains[domainId]
+	if !found {
+		return nil, golangsdk.ErrDefault404{}
+	}
+	return &domain, nil
+}
+
+func (m *FakeWafCertificateManager) UpdateDomain(domainId string, opts wafDomain.UpdateOpts) (*wafDomain.Domain, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if err := m.record("UpdateDomain " + domainId); err != nil {
+		return nil, err
+	}
+	domain, found := m.domains[domainId]
+	if !found {
+		return nil, golangsdk.ErrDefault404{}
+	}
+	if len(opts.CertificateId) > 0 {
+		domain.CertificateId = opts.CertificateId
+	}
+	if opts.Server != nil {
+		domain.Server = nil
+		for _, server := range opts.Server {
+			domain.Server = append(domain.Server, wafDomain.Server{
+				ClientProtocol: server.ClientProtocol,
+				ServerProtocol: server.ServerProtocol,
+				Address:        server.Address,
+				Port:           server.Port,
+			})
+		}
+	}
+	m.domains[domainId] = domain
+	return &domain, nil
+}
+
+func (m *FakeWafCertificateManager) ListDomains() ([]wafDomain.Domain, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if err := m.record("ListDomains"); err != nil {
+		return nil, err
+	}
+	domains := []wafDomain.Domain{}
+	for _, domain := range m.domains {
+		domains = append(domains, domain)
+	}
+	sort.Slice(domains, func(i, j int) bool { return domains[i].Id < domains[j].Id })
+	return domains, nil
+}
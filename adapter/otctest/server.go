@@ -0,0 +1,941 @@
+// Package otctest provides an in-memory stand-in for the iam token endpoint, the cloud and dedicated waf apis
+// and the elb v3 api of the open telekom cloud, so the sdk can be tested end-to-end with httptest.
+package otctest
+
+import (
+	"encoding/json"
+	"fmt"
+	golangsdk "github.com/opentelekomcloud/gophertelekomcloud"
+	"github.com/opentelekomcloud/gophertelekomcloud/openstack"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ProjectId   = "project-id"
+	ProjectName = "eu-de_project"
+	Region      = "eu-de"
+	token       = "test-token"
+
+	// dedicatedWafPath is the catalog endpoint of the dedicated waf.
+	dedicatedWafPath = "dedicated/v1/" + ProjectId + "/"
+	// elbPath is the catalog endpoint of the elb, the sdk adds elb/ to it.
+	elbPath = "elb/v3/" + ProjectId + "/"
+
+	// defaultPageLimit is the page size of the waf api if no limit is requested,
+	// the sdk assumes it when it requests the next page.
+	defaultPageLimit = 10
+)
+
+// Certificate is a certificate stored in the waf.
+type Certificate struct {
+	Id         string `json:"id"`
+	Name       string `json:"name"`
+	Content    string `json:"-"`
+	Key        string `json:"-"`
+	ExpireTime int64  `json:"expireTime"`
+	Timestamp  int64  `json:"timestamp"`
+}
+
+// Server is an origin server of a waf domain.
+type Server struct {
+	ClientProtocol string `json:"client_protocol"`
+	ServerProtocol string `json:"server_protocol"`
+	Address        string `json:"address"`
+	Port           int    `json:"port"`
+}
+
+// Domain is a waf domain with the fields the uploader uses.
+type Domain struct {
+	Id            string   `json:"id"`
+	HostName      string   `json:"hostname"`
+	CertificateId string   `json:"certificate_id,omitempty"`
+	Protocol      string   `json:"protocol,omitempty"`
+	Server        []Server `json:"server"`
+}
+
+// Host is a protected domain of a dedicated waf instance.
+type Host struct {
+	Id              string       `json:"id"`
+	HostName        string       `json:"hostname"`
+	CertificateId   string       `json:"certificateid,omitempty"`
+	CertificateName string       `json:"certificatename,omitempty"`
+	Server          []HostServer `json:"server"`
+}
+
+// HostServer is an origin server of a dedicated waf host.
+type HostServer struct {
+	FrontProtocol string `json:"front_protocol"`
+	BackProtocol  string `json:"back_protocol"`
+	Address       string `json:"address"`
+	Port          int    `json:"port"`
+	Type          string `json:"type"`
+	VpcId         string `json:"vpc_id"`
+}
+
+// ElbCertificate is a certificate stored in the elb.
+type ElbCertificate struct {
+	Id          string `json:"id"`
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Domain      string `json:"domain"`
+	Certificate string `json:"certificate"`
+	PrivateKey  string `json:"-"`
+}
+
+// Listener is an elb listener with the fields the uploader uses.
+type Listener struct {
+	Id                     string   `json:"id"`
+	Protocol               string   `json:"protocol"`
+	DefaultTlsContainerRef string   `json:"default_tls_container_ref"`
+	SniContainerRefs       []string `json:"sni_container_refs"`
+}
+
+// OtcServer serves the iam, waf and elb requests of the sdk. The wafs and the elb keep their state in memory.
+type OtcServer struct {
+	*httptest.Server
+
+	mutex                 sync.Mutex
+	certificates          map[string]Certificate
+	domains               map[string]Domain
+	dedicatedCertificates map[string]Certificate
+	hosts                 map[string]Host
+	elbCertificates       map[string]ElbCertificate
+	listeners             map[string]Listener
+	failures              map[string][]int
+	calls                 []string
+	createdCount          int
+	tokenExpiresAt        time.Time
+}
+
+// NewServer starts a server, which has to be closed by the caller.
+func NewServer() *OtcServer {
+	s := newOtcServer()
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// NewTLSServer starts a server with a self-signed certificate, see httptest.NewTLSServer.
+func NewTLSServer() *OtcServer {
+	s := newOtcServer()
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+func newOtcServer() *OtcServer {
+	return &OtcServer{
+		certificates: map[string]Certificate{},
+		domains:      map[string]Domain{},
+		failures:     map[string][]int{},
+
+		dedicatedCertificates: map[string]Certificate{},
+		hosts:                 map[string]Host{},
+		elbCertificates:       map[string]ElbCertificate{},
+		listeners:             map[string]Listener{},
+	}
+}
+
+// IdentityEndpoint is the iam endpoint to authenticate at.
+func (s *OtcServer) IdentityEndpoint() string {
+	return s.URL + "/v3"
+}
+
+// NewProviderClient authenticates with a password at the server.
+func (s *OtcServer) NewProviderClient() (*golangsdk.ProviderClient, error) {
+	return openstack.AuthenticatedClient(golangsdk.AuthOptions{
+		IdentityEndpoint: s.IdentityEndpoint(),
+		Username:         "user",
+		Password:         "password",
+		DomainName:       "account",
+		TenantName:       ProjectName,
+		AllowReauth:      true,
+	})
+}
+
+// NewWafClient returns a cloud waf client like the one of the uploader.
+func (s *OtcServer) NewWafClient() (*golangsdk.ServiceClient, error) {
+	provider, err := s.NewProviderClient()
+	if err != nil {
+		return nil, err
+	}
+	return openstack.NewWAFV1(provider, golangsdk.EndpointOpts{Region: Region})
+}
+
+// NewDedicatedWafClient returns a dedicated waf client like the one of the uploader.
+func (s *OtcServer) NewDedicatedWafClient() (*golangsdk.ServiceClient, error) {
+	provider, err := s.NewProviderClient()
+	if err != nil {
+		return nil, err
+	}
+	return openstack.NewWAFDV1(provider, golangsdk.EndpointOpts{Region: Region})
+}
+
+func (s *OtcServer) AddCertificate(certificate Certificate) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.certificates[certificate.Id] = certificate
+}
+
+func (s *OtcServer) AddDomain(domain Domain) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.domains[domain.Id] = domain
+}
+
+// NewElbClient returns an elb client like the one of the uploader.
+func (s *OtcServer) NewElbClient() (*golangsdk.ServiceClient, error) {
+	provider, err := s.NewProviderClient()
+	if err != nil {
+		return nil, err
+	}
+	return openstack.NewELBV3(provider, golangsdk.EndpointOpts{Region: Region})
+}
+
+func (s *OtcServer) AddElbCertificate(certificate ElbCertificate) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.elbCertificates[certificate.Id] = certificate
+}
+
+func (s *OtcServer) AddListener(listener Listener) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.listeners[listener.Id] = listener
+}
+
+func (s *OtcServer) ElbCertificates() []ElbCertificate {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return sortedById(s.elbCertificates, func(certificate ElbCertificate) string { return certificate.Id })
+}
+
+func (s *OtcServer) Listener(id string) (Listener, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	listener, found := s.listeners[id]
+	return listener, found
+}
+
+func (s *OtcServer) AddDedicatedCertificate(certificate Certificate) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.dedicatedCertificates[certificate.Id] = certificate
+}
+
+func (s *OtcServer) AddHost(host Host) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.hosts[host.Id] = host
+}
+
+func (s *OtcServer) Certificates() []Certificate {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return sortedById(s.certificates, func(certificate Certificate) string { return certificate.Id })
+}
+
+func (s *OtcServer) DedicatedCertificates() []Certificate {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return sortedById(s.dedicatedCertificates, func(certificate Certificate) string { return certificate.Id })
+}
+
+func (s *OtcServer) Host(id string) (Host, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	host, found := s.hosts[id]
+	return host, found
+}
+
+func (s *OtcServer) Domain(id string) (Domain, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	domain, found := s.domains[id]
+	return domain, found
+}
+
+// FailNext lets the next requests of an operation, e.g. "update_domain", fail with the status codes in order.
+// The operations are create_token, get_token, list_projects, list_catalog, create_certificate, list_certificates,
+// get_certificate, delete_certificate, list_domains, get_domain and update_domain of the cloud waf and
+// create_dedicated_certificate, list_dedicated_certificates, get_dedicated_certificate, delete_dedicated_certificate,
+// list_hosts, get_host and update_host of the dedicated waf and create_elb_certificate, list_elb_certificates,
+// delete_elb_certificate, get_listener and update_listener of the elb.
+func (s *OtcServer) FailNext(operation string, statusCodes ...int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failures[operation] = append(s.failures[operation], statusCodes...)
+}
+
+// Calls returns the operations of all requests, including the failed ones.
+func (s *OtcServer) Calls() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string{}, s.calls...)
+}
+
+func (s *OtcServer) serveHTTP(writer http.ResponseWriter, request *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	path := strings.Trim(request.URL.Path, "/")
+	switch {
+	case path == "v3/auth/tokens" && request.Method == http.MethodPost:
+		s.handle(writer, "create_token", s.createToken, request)
+	case path == "v3/auth/tokens" && request.Method == http.MethodGet:
+		s.handle(writer, "get_token", s.getToken, request)
+	case path == "v3/projects" && request.Method == http.MethodGet:
+		s.handle(writer, "list_projects", s.listProjects, request)
+	case path == "v3/auth/catalog" && request.Method == http.MethodGet:
+		s.handle(writer, "list_catalog", s.listCatalog, request)
+	case strings.HasPrefix(path, "v1/"+ProjectId+"/waf/"):
+		if !isAuthenticated(request) {
+			writeError(writer, http.StatusUnauthorized, "APIGW.0301", "incorrect token")
+			return
+		}
+		s.serveWaf(writer, request, strings.Split(strings.TrimPrefix(path, "v1/"+ProjectId+"/waf/"), "/"))
+	case strings.HasPrefix(path, dedicatedWafPath):
+		if !isAuthenticated(request) {
+			writeError(writer, http.StatusUnauthorized, "APIGW.0301", "incorrect token")
+			return
+		}
+		s.serveDedicatedWaf(writer, request, strings.Split(strings.TrimPrefix(path, dedicatedWafPath), "/"))
+	case strings.HasPrefix(path, elbPath+"elb/"):
+		if !isAuthenticated(request) {
+			writeError(writer, http.StatusUnauthorized, "APIGW.0301", "incorrect token")
+			return
+		}
+		s.serveElb(writer, request, strings.Split(strings.TrimPrefix(path, elbPath+"elb/"), "/"))
+	default:
+		writeError(writer, http.StatusNotFound, "APIGW.0101", "the api does not exist")
+	}
+}
+
+func (s *OtcServer) serveWaf(writer http.ResponseWriter, request *http.Request, resource []string) {
+	switch {
+	case len(resource) == 1 && resource[0] == "certificate" && request.Method == http.MethodGet:
+		s.handle(writer, "list_certificates", s.listCertificates, request)
+	case len(resource) == 1 && resource[0] == "certificate" && request.Method == http.MethodPost:
+		s.handle(writer, "create_certificate", s.createCertificate, request)
+	case len(resource) == 2 && resource[0] == "certificate" && request.Method == http.MethodGet:
+		s.handle(writer, "get_certificate", s.getCertificate(resource[1]), request)
+	case len(resource) == 2 && resource[0] == "certificate" && request.Method == http.MethodDelete:
+		s.handle(writer, "delete_certificate", s.deleteCertificate(resource[1]), request)
+	case len(resource) == 1 && resource[0] == "instance" && request.Method == http.MethodGet:
+		s.handle(writer, "list_domains", s.listDomains, request)
+	case len(resource) == 2 && resource[0] == "instance" && request.Method == http.MethodGet:
+		s.handle(writer, "get_domain", s.getDomain(resource[1]), request)
+	case len(resource) == 2 && resource[0] == "instance" && request.Method == http.MethodPut:
+		s.handle(writer, "update_domain", s.updateDomain(resource[1]), request)
+	default:
+		writeError(writer, http.StatusNotFound, "APIGW.0101", "the api does not exist")
+	}
+}
+
+func (s *OtcServer) serveDedicatedWaf(writer http.ResponseWriter, request *http.Request, resource []string) {
+	switch {
+	case len(resource) == 2 && resource[0] == "waf" && resource[1] == "certificate" && request.Method == http.MethodGet:
+		s.handle(writer, "list_dedicated_certificates", s.listDedicatedCertificates, request)
+	case len(resource) == 2 && resource[0] == "waf" && resource[1] == "certificate" && request.Method == http.MethodPost:
+		s.handle(writer, "create_dedicated_certificate", s.createDedicatedCertificate, request)
+	case len(resource) == 3 && resource[0] == "waf" && resource[1] == "certificate" && request.Method == http.MethodGet:
+		s.handle(writer, "get_dedicated_certificate", s.getDedicatedCertificate(resource[2]), request)
+	case len(resource) == 3 && resource[0] == "waf" && resource[1] == "certificate" && request.Method == http.MethodDelete:
+		s.handle(writer, "delete_dedicated_certificate", s.deleteDedicatedCertificate(resource[2]), request)
+	case len(resource) == 2 && resource[0] == "premium-waf" && resource[1] == "host" && request.Method == http.MethodGet:
+		s.handle(writer, "list_hosts", s.listHosts, request)
+	case len(resource) == 3 && resource[0] == "premium-waf" && resource[1] == "host" && request.Method == http.MethodGet:
+		s.handle(writer, "get_host", s.getHost(resource[2]), request)
+	case len(resource) == 3 && resource[0] == "premium-waf" && resource[1] == "host" && request.Method == http.MethodPut:
+		s.handle(writer, "update_host", s.updateHost(resource[2]), request)
+	default:
+		writeError(writer, http.StatusNotFound, "APIGW.0101", "the api does not exist")
+	}
+}
+
+func (s *OtcServer) serveElb(writer http.ResponseWriter, request *http.Request, resource []string) {
+	switch {
+	case len(resource) == 1 && resource[0] == "certificates" && request.Method == http.MethodGet:
+		s.handle(writer, "list_elb_certificates", s.listElbCertificates, request)
+	case len(resource) == 1 && resource[0] == "certificates" && request.Method == http.MethodPost:
+		s.handle(writer, "create_elb_certificate", s.createElbCertificate, request)
+	case len(resource) == 2 && resource[0] == "certificates" && request.Method == http.MethodDelete:
+		s.handle(writer, "delete_elb_certificate", s.deleteElbCertificate(resource[1]), request)
+	case len(resource) == 2 && resource[0] == "listeners" && request.Method == http.MethodGet:
+		s.handle(writer, "get_listener", s.getListener(resource[1]), request)
+	case len(resource) == 2 && resource[0] == "listeners" && request.Method == http.MethodPut:
+		s.handle(writer, "update_listener", s.updateListener(resource[1]), request)
+	default:
+		writeError(writer, http.StatusNotFound, "APIGW.0101", "the api does not exist")
+	}
+}
+
+type handlerFunc func(writer http.ResponseWriter, request *http.Request)
+
+func (s *OtcServer) handle(writer http.ResponseWriter, operation string, handler handlerFunc, request *http.Request) {
+	s.calls = append(s.calls, operation)
+	if statusCodes := s.failures[operation]; len(statusCodes) > 0 {
+		s.failures[operation] = statusCodes[1:]
+		writeError(writer, statusCodes[0], "WAF.00000001", "injected failure of "+operation)
+		return
+	}
+	handler(writer, request)
+}
+
+// isAuthenticated accepts the issued token and the signature of ak/sk requests, which isn't verified.
+func isAuthenticated(request *http.Request) bool {
+	return request.Header.Get("X-Auth-Token") == token ||
+		strings.HasPrefix(request.Header.Get("Authorization"), "SDK-HMAC-SHA256")
+}
+
+func (s *OtcServer) createToken(writer http.ResponseWriter, request *http.Request) {
+	var body struct {
+		Auth struct {
+			Identity struct {
+				Password struct {
+					User struct {
+						Name     string `json:"name"`
+						Password string `json:"password"`
+					} `json:"user"`
+				} `json:"password"`
+			} `json:"identity"`
+		} `json:"auth"`
+	}
+	if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+		writeError(writer, http.StatusBadRequest, "IAM.0011", "invalid request body")
+		return
+	}
+	user := body.Auth.Identity.Password.User
+	if len(user.Name) == 0 || len(user.Password) == 0 {
+		writeError(writer, http.StatusUnauthorized, "IAM.0001", "the username or password is wrong")
+		return
+	}
+
+	s.tokenExpiresAt = time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second)
+	writer.Header().Set("X-Subject-Token", token)
+	writeJson(writer, http.StatusCreated, map[string]interface{}{
+		"token": map[string]interface{}{
+			"expires_at": s.tokenExpiresAt.Format(time.RFC3339),
+			"project":    map[string]interface{}{"id": ProjectId, "name": ProjectName, "domain": map[string]string{"id": "domain-id"}},
+			"user":       map[string]interface{}{"id": "user-id", "name": user.Name, "domain": map[string]string{"id": "domain-id"}},
+			"catalog":    s.catalog(),
+		},
+	})
+}
+
+// getToken validates the issued token, only its expiry is returned.
+func (s *OtcServer) getToken(writer http.ResponseWriter, request *http.Request) {
+	if !isAuthenticated(request) {
+		writeError(writer, http.StatusUnauthorized, "APIGW.0301", "incorrect token")
+		return
+	}
+	if request.Header.Get("X-Subject-Token") != token {
+		writeError(writer, http.StatusNotFound, "IAM.0011", "the token does not exist")
+		return
+	}
+	writeJson(writer, http.StatusOK, map[string]interface{}{
+		"token": map[string]interface{}{"expires_at": s.tokenExpiresAt.Format(time.RFC3339)},
+	})
+}
+
+// TokenExpiresAt returns the expiry of the last issued token.
+func (s *OtcServer) TokenExpiresAt() time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.tokenExpiresAt
+}
+
+func (s *OtcServer) listProjects(writer http.ResponseWriter, request *http.Request) {
+	projects := []map[string]string{}
+	if name := request.URL.Query().Get("name"); len(name) == 0 || name == ProjectName {
+		projects = append(projects, map[string]string{"id": ProjectId, "name": ProjectName, "domain_id": "domain-id"})
+	}
+	writeJson(writer, http.StatusOK, map[string]interface{}{"projects": projects, "links": map[string]string{}})
+}
+
+func (s *OtcServer) listCatalog(writer http.ResponseWriter, _ *http.Request) {
+	writeJson(writer, http.StatusOK, map[string]interface{}{"catalog": s.catalog(), "links": map[string]string{}})
+}
+
+func (s *OtcServer) catalog() []map[string]interface{} {
+	return []map[string]interface{}{{
+		"id":   "waf-service-id",
+		"name": "waf",
+		"type": "waf",
+		"endpoints": []map[string]string{{
+			"id":        "waf-endpoint-id",
+			"interface": "public",
+			"region":    Region,
+			"url":       s.URL + "/",
+		}},
+	}, {
+		"id":   "premium-waf-service-id",
+		"name": "premium-waf",
+		"type": "premium-waf",
+		"endpoints": []map[string]string{{
+			"id":        "premium-waf-endpoint-id",
+			"interface": "public",
+			"region":    Region,
+			"url":       s.URL + "/" + dedicatedWafPath,
+		}},
+	}, {
+		"id":   "elbv3-service-id",
+		"name": "elbv3",
+		"type": "elbv3",
+		"endpoints": []map[string]string{{
+			"id":        "elbv3-endpoint-id",
+			"interface": "public",
+			"region":    Region,
+			"url":       s.URL + "/" + elbPath,
+		}},
+	}}
+}
+
+func (s *OtcServer) listCertificates(writer http.ResponseWriter, request *http.Request) {
+	certificates := sortedById(s.certificates, func(certificate Certificate) string { return certificate.Id })
+	items, ok := page(certificates, request, writer)
+	if ok {
+		writeJson(writer, http.StatusOK, map[string]interface{}{"total": len(certificates), "items": items})
+	}
+}
+
+func (s *OtcServer) createCertificate(writer http.ResponseWriter, request *http.Request) {
+	certificate, ok := s.storeCertificate(s.certificates, writer, request)
+	if ok {
+		writeJson(writer, http.StatusOK, certificate)
+	}
+}
+
+// storeCertificate stores the certificate of the request body, names have to be unique as in the waf.
+func (s *OtcServer) storeCertificate(
+	certificates map[string]Certificate,
+	writer http.ResponseWriter,
+	request *http.Request) (Certificate, bool) {
+	var body struct {
+		Name    string `json:"name"`
+		Content string `json:"content"`
+		Key     string `json:"key"`
+	}
+	if err := json.NewDecoder(request.Body).Decode(&body); err != nil ||
+		len(body.Name) == 0 || len(body.Content) == 0 || len(body.Key) == 0 {
+		writeError(writer, http.StatusBadRequest, "WAF.00011001", "name, content and key are required")
+		return Certificate{}, false
+	}
+	for _, certificate := range certificates {
+		if certificate.Name == body.Name {
+			writeError(writer, http.StatusBadRequest, "WAF.00011005", "the certificate name already exists")
+			return Certificate{}, false
+		}
+	}
+
+	s.createdCount++
+	now := time.Now()
+	certificate := Certificate{
+		Id:         fmt.Sprintf("certificate-%d", s.createdCount),
+		Name:       body.Name,
+		Content:    body.Content,
+		Key:        body.Key,
+		ExpireTime: now.Add(90 * 24 * time.Hour).UnixMilli(),
+		Timestamp:  now.UnixMilli(),
+	}
+	certificates[certificate.Id] = certificate
+	return certificate, true
+}
+
+func (s *OtcServer) getCertificate(id string) handlerFunc {
+	return func(writer http.ResponseWriter, _ *http.Request) {
+		certificate, found := s.certificates[id]
+		if !found {
+			writeError(writer, http.StatusNotFound, "WAF.00014002", "the certificate does not exist")
+			return
+		}
+		writeJson(writer, http.StatusOK, certificate)
+	}
+}
+
+// deleteCertificate refuses to delete certificates that are still used by a domain, as the waf does.
+func (s *OtcServer) deleteCertificate(id string) handlerFunc {
+	return func(writer http.ResponseWriter, _ *http.Request) {
+		if _, found := s.certificates[id]; !found {
+			writeError(writer, http.StatusNotFound, "WAF.00014002", "the certificate does not exist")
+			return
+		}
+		for _, domain := range s.domains {
+			if domain.CertificateId == id {
+				writeError(writer, http.StatusBadRequest, "WAF.00014003", "the certificate is in use")
+				return
+			}
+		}
+		delete(s.certificates, id)
+		writer.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *OtcServer) listDomains(writer http.ResponseWriter, request *http.Request) {
+	domains := sortedById(s.domains, func(domain Domain) string { return domain.Id })
+	items, ok := page(domains, request, writer)
+	if ok {
+		writeJson(writer, http.StatusOK, map[string]interface{}{"total": len(domains), "items": items})
+	}
+}
+
+func (s *OtcServer) getDomain(id string) handlerFunc {
+	return func(writer http.ResponseWriter, _ *http.Request) {
+		domain, found := s.domains[id]
+		if !found {
+			writeError(writer, http.StatusNotFound, "WAF.00014002", "the domain does not exist")
+			return
+		}
+		writeJson(writer, http.StatusOK, domain)
+	}
+}
+
+func (s *OtcServer) updateDomain(id string) handlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		domain, found := s.domains[id]
+		if !found {
+			writeError(writer, http.StatusNotFound, "WAF.00014002", "the domain does not exist")
+			return
+		}
+		var body struct {
+			CertificateId string   `json:"certificate_id"`
+			Server        []Server `json:"server"`
+		}
+		if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+			writeError(writer, http.StatusBadRequest, "WAF.00011001", "invalid request body")
+			return
+		}
+		if len(body.CertificateId) > 0 {
+			if _, found := s.certificates[body.CertificateId]; !found {
+				writeError(writer, http.StatusBadRequest, "WAF.00014002", "the certificate does not exist")
+				return
+			}
+			domain.CertificateId = body.CertificateId
+		}
+		if body.Server != nil {
+			domain.Server = body.Server
+		}
+		s.domains[id] = domain
+		writeJson(writer, http.StatusOK, domain)
+	}
+}
+
+// dedicatedCertificateJson is the representation of a certificate in the dedicated waf api.
+func dedicatedCertificateJson(certificate Certificate) map[string]interface{} {
+	return map[string]interface{}{
+		"id":          certificate.Id,
+		"name":        certificate.Name,
+		"expire_time": certificate.ExpireTime,
+		"timestamp":   certificate.Timestamp,
+	}
+}
+
+func (s *OtcServer) listDedicatedCertificates(writer http.ResponseWriter, request *http.Request) {
+	certificates := sortedById(s.dedicatedCertificates, func(certificate Certificate) string { return certificate.Id })
+	certificatesPage, ok := pageByNumber(certificates, request, writer)
+	if !ok {
+		return
+	}
+	items := []map[string]interface{}{}
+	for _, certificate := range certificatesPage {
+		items = append(items, dedicatedCertificateJson(certificate))
+	}
+	writeJson(writer, http.StatusOK, map[string]interface{}{"total": len(certificates), "items": items})
+}
+
+func (s *OtcServer) createDedicatedCertificate(writer http.ResponseWriter, request *http.Request) {
+	certificate, ok := s.storeCertificate(s.dedicatedCertificates, writer, request)
+	if ok {
+		writeJson(writer, http.StatusOK, dedicatedCertificateJson(certificate))
+	}
+}
+
+func (s *OtcServer) getDedicatedCertificate(id string) handlerFunc {
+	return func(writer http.ResponseWriter, _ *http.Request) {
+		certificate, found := s.dedicatedCertificates[id]
+		if !found {
+			writeError(writer, http.StatusNotFound, "WAF.00014002", "the certificate does not exist")
+			return
+		}
+		writeJson(writer, http.StatusOK, dedicatedCertificateJson(certificate))
+	}
+}
+
+// deleteDedicatedCertificate refuses to delete certificates that are still used by a host.
+// Unlike the cloud waf, the dedicated waf responds with the deleted certificate.
+func (s *OtcServer) deleteDedicatedCertificate(id string) handlerFunc {
+	return func(writer http.ResponseWriter, _ *http.Request) {
+		certificate, found := s.dedicatedCertificates[id]
+		if !found {
+			writeError(writer, http.StatusNotFound, "WAF.00014002", "the certificate does not exist")
+			return
+		}
+		for _, host := range s.hosts {
+			if host.CertificateId == id {
+				writeError(writer, http.StatusBadRequest, "WAF.00014003", "the certificate is in use")
+				return
+			}
+		}
+		delete(s.dedicatedCertificates, id)
+		writeJson(writer, http.StatusOK, dedicatedCertificateJson(certificate))
+	}
+}
+
+// listHosts returns summaries of the hosts, like the dedicated waf they don't contain the certificate.
+func (s *OtcServer) listHosts(writer http.ResponseWriter, request *http.Request) {
+	hosts := sortedById(s.hosts, func(host Host) string { return host.Id })
+	items, ok := pageByNumber(hosts, request, writer)
+	if ok {
+		summaries := []Host{}
+		for _, host := range items {
+			host.CertificateId = ""
+			host.CertificateName = ""
+			summaries = append(summaries, host)
+		}
+		writeJson(writer, http.StatusOK, map[string]interface{}{"total": len(hosts), "items": summaries})
+	}
+}
+
+func (s *OtcServer) getHost(id string) handlerFunc {
+	return func(writer http.ResponseWriter, _ *http.Request) {
+		host, found := s.hosts[id]
+		if !found {
+			writeError(writer, http.StatusNotFound, "WAF.00014002", "the host does not exist")
+			return
+		}
+		writeJson(writer, http.StatusOK, host)
+	}
+}
+
+// updateHost binds a certificate to a host, which needs the id and the name of the certificate.
+func (s *OtcServer) updateHost(id string) handlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		host, found := s.hosts[id]
+		if !found {
+			writeError(writer, http.StatusNotFound, "WAF.00014002", "the host does not exist")
+			return
+		}
+		var body struct {
+			CertificateId   string `json:"certificateid"`
+			CertificateName string `json:"certificatename"`
+		}
+		if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+			writeError(writer, http.StatusBadRequest, "WAF.00011001", "invalid request body")
+			return
+		}
+		if len(body.CertificateId) > 0 {
+			certificate, found := s.dedicatedCertificates[body.CertificateId]
+			if !found || certificate.Name != body.CertificateName {
+				writeError(writer, http.StatusBadRequest, "WAF.00014002", "the certificate does not exist")
+				return
+			}
+			host.CertificateId = certificate.Id
+			host.CertificateName = certificate.Name
+		}
+		s.hosts[id] = host
+		writeJson(writer, http.StatusOK, host)
+	}
+}
+
+func (s *OtcServer) listElbCertificates(writer http.ResponseWriter, _ *http.Request) {
+	certificates := sortedById(s.elbCertificates, func(certificate ElbCertificate) string { return certificate.Id })
+	writeJson(writer, http.StatusOK, map[string]interface{}{"certificates": certificates})
+}
+
+func (s *OtcServer) createElbCertificate(writer http.ResponseWriter, request *http.Request) {
+	var body struct {
+		Certificate struct {
+			Name        string `json:"name"`
+			Type        string `json:"type"`
+			Domain      string `json:"domain"`
+			Certificate string `json:"certificate"`
+			PrivateKey  string `json:"private_key"`
+		} `json:"certificate"`
+	}
+	if err := json.NewDecoder(request.Body).Decode(&body); err != nil ||
+		len(body.Certificate.Certificate) == 0 || len(body.Certificate.PrivateKey) == 0 {
+		writeError(writer, http.StatusBadRequest, "ELB.8902", "certificate and private_key are required")
+		return
+	}
+
+	s.createdCount++
+	certificate := ElbCertificate{
+		Id:          fmt.Sprintf("elb-certificate-%d", s.createdCount),
+		Name:        body.Certificate.Name,
+		Type:        body.Certificate.Type,
+		Domain:      body.Certificate.Domain,
+		Certificate: body.Certificate.Certificate,
+		PrivateKey:  body.Certificate.PrivateKey,
+	}
+	s.elbCertificates[certificate.Id] = certificate
+	writeJson(writer, http.StatusCreated, map[string]interface{}{"certificate": certificate})
+}
+
+// deleteElbCertificate refuses to delete certificates that are still used by a listener.
+func (s *OtcServer) deleteElbCertificate(id string) handlerFunc {
+	return func(writer http.ResponseWriter, _ *http.Request) {
+		if _, found := s.elbCertificates[id]; !found {
+			writeError(writer, http.StatusNotFound, "ELB.8904", "the certificate does not exist")
+			return
+		}
+		for _, listener := range s.listeners {
+			if listener.DefaultTlsContainerRef == id || containsString(listener.SniContainerRefs, id) {
+				writeError(writer, http.StatusConflict, "ELB.8907", "the certificate is in use")
+				return
+			}
+		}
+		delete(s.elbCertificates, id)
+		writer.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *OtcServer) getListener(id string) handlerFunc {
+	return func(writer http.ResponseWriter, _ *http.Request) {
+		listener, found := s.listeners[id]
+		if !found {
+			writeError(writer, http.StatusNotFound, "ELB.8904", "the listener does not exist")
+			return
+		}
+		writeJson(writer, http.StatusOK, map[string]interface{}{"listener": listener})
+	}
+}
+
+// updateListener changes the certificates of a listener, which have to exist in the elb. Like the elb,
+// sni certificates need a domain.
+func (s *OtcServer) updateListener(id string) handlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		listener, found := s.listeners[id]
+		if !found {
+			writeError(writer, http.StatusNotFound, "ELB.8904", "the listener does not exist")
+			return
+		}
+		var body struct {
+			Listener struct {
+				DefaultTlsContainerRef *string   `json:"default_tls_container_ref"`
+				SniContainerRefs       *[]string `json:"sni_container_refs"`
+			} `json:"listener"`
+		}
+		if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+			writeError(writer, http.StatusBadRequest, "ELB.8902", "invalid request body")
+			return
+		}
+		var refs []string
+		if body.Listener.DefaultTlsContainerRef != nil {
+			refs = append(refs, *body.Listener.DefaultTlsContainerRef)
+		}
+		if body.Listener.SniContainerRefs != nil {
+			refs = append(refs, *body.Listener.SniContainerRefs...)
+		}
+		for _, ref := range refs {
+			if _, found := s.elbCertificates[ref]; !found && len(ref) > 0 {
+				writeError(writer, http.StatusNotFound, "ELB.8904", "the certificate does not exist")
+				return
+			}
+		}
+		if body.Listener.SniContainerRefs != nil {
+			for _, ref := range *body.Listener.SniContainerRefs {
+				if len(s.elbCertificates[ref].Domain) == 0 {
+					writeError(writer, http.StatusBadRequest, "ELB.8902", "the sni certificate has no domain")
+					return
+				}
+			}
+		}
+
+		if body.Listener.DefaultTlsContainerRef != nil {
+			listener.DefaultTlsContainerRef = *body.Listener.DefaultTlsContainerRef
+		}
+		if body.Listener.SniContainerRefs != nil {
+			listener.SniContainerRefs = *body.Listener.SniContainerRefs
+		}
+		s.listeners[id] = listener
+		writeJson(writer, http.StatusOK, map[string]interface{}{"listener": listener})
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedById[T any](itemsById map[string]T, id func(T) string) []T {
+	items := []T{}
+	for _, item := range itemsById {
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool { return id(items[i]) < id(items[j]) })
+	return items
+}
+
+// pageByNumber returns the items of the requested page and page size, which the dedicated waf uses instead of offsets.
+func pageByNumber[T any](items []T, request *http.Request, writer http.ResponseWriter) ([]T, bool) {
+	pageNumber, pageSize := 1, defaultPageLimit
+	var err error
+	if value := request.URL.Query().Get("page"); len(value) > 0 {
+		if pageNumber, err = strconv.Atoi(value); err != nil || pageNumber < 1 {
+			writeError(writer, http.StatusBadRequest, "WAF.00011001", "invalid page")
+			return nil, false
+		}
+	}
+	if value := request.URL.Query().Get("pageSize"); len(value) > 0 {
+		if pageSize, err = strconv.Atoi(value); err != nil || pageSize < 1 || pageSize > 100 {
+			writeError(writer, http.StatusBadRequest, "WAF.00011001", "invalid page size")
+			return nil, false
+		}
+	}
+	offset := (pageNumber - 1) * pageSize
+	if offset >= len(items) {
+		return []T{}, true
+	}
+	end := offset + pageSize
+	if end > len(items) {
+		end = len(items)
+	}
+	return items[offset:end], true
+}
+
+// page returns the items of the requested offset and limit.
+func page[T any](items []T, request *http.Request, writer http.ResponseWriter) ([]T, bool) {
+	offset, limit := 0, defaultPageLimit
+	var err error
+	if value := request.URL.Query().Get("offset"); len(value) > 0 {
+		if offset, err = strconv.Atoi(value); err != nil || offset < 0 {
+			writeError(writer, http.StatusBadRequest, "WAF.00011001", "invalid offset")
+			return nil, false
+		}
+	}
+	if value := request.URL.Query().Get("limit"); len(value) > 0 {
+		if limit, err = strconv.Atoi(value); err != nil || limit < -1 || limit == 0 || limit > 50 {
+			writeError(writer, http.StatusBadRequest, "WAF.00011001", "invalid limit")
+			return nil, false
+		}
+	}
+	if limit == -1 {
+		limit = len(items)
+	}
+	if offset >= len(items) {
+		return []T{}, true
+	}
+	end := offset + limit
+	if end > len(items) {
+		end = len(items)
+	}
+	return items[offset:end], true
+}
+
+func writeJson(writer http.ResponseWriter, statusCode int, body interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(statusCode)
+	_ = json.NewEncoder(writer).Encode(body)
+}
+
+func writeError(writer http.ResponseWriter, statusCode int, errorCode string, message string) {
+	writeJson(writer, statusCode, map[string]string{"error_code": errorCode, "error_msg": message})
+}
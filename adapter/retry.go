@@ -0,0 +1,312 @@
+package adapter
+
+import (
+	"errors"
+	"fmt"
+	golangsdk "github.com/opentelekomcloud/gophertelekomcloud"
+	waf "github.com/opentelekomcloud/gophertelekomcloud/openstack/waf/v1/certificates"
+	wafDomain "github.com/opentelekomcloud/gophertelekomcloud/openstack/waf/v1/domains"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"waf-cert-uploader/metrics"
+)
+
+// RetryPolicy is the budget of a single adapter operation including all of its retries.
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	MaxElapsed  time.Duration
+}
+
+// DefaultRetryPolicy applies to every otc api call on its own, not to a whole upload. An upload makes a handful
+// of calls, so the budget is small enough that the retries of a few failing calls still fit into the default
+// webhook timeout of 10 seconds. The async mode isn't bound by the webhook timeout.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	BaseDelay:   250 * time.Millisecond,
+	MaxDelay:    time.Second,
+	MaxElapsed:  2 * time.Second,
+}
+
+func (p RetryPolicy) Validate() error {
+	if p.MaxAttempts < 1 {
+		return fmt.Errorf("the maximum number of attempts must be at least 1, got %d", p.MaxAttempts)
+	}
+	if p.BaseDelay <= 0 || p.MaxDelay < p.BaseDelay {
+		return fmt.Errorf("invalid retry delays, base %s, max %s", p.BaseDelay, p.MaxDelay)
+	}
+	if p.MaxElapsed < 0 {
+		return fmt.Errorf("invalid retry budget %s", p.MaxElapsed)
+	}
+	return nil
+}
+
+// retrier retries the transient errors of the otc api calls within the budget of its policy.
+type retrier struct {
+	policy RetryPolicy
+	// api is the name of the otc api in the logs, recordRetry counts the retries in its metric
+	api            string
+	recordRetry    func(operation string)
+	now            func() time.Time
+	sleep          func(time.Duration)
+	randomDuration func(max time.Duration) time.Duration
+}
+
+func newRetrier(policy RetryPolicy, api string, recordRetry func(operation string)) retrier {
+	return retrier{
+		policy:      policy,
+		api:         api,
+		recordRetry: recordRetry,
+		now:         time.Now,
+		sleep:       time.Sleep,
+		randomDuration: func(max time.Duration) time.Duration {
+			return time.Duration(rand.Int63n(int64(max) + 1))
+		},
+	}
+}
+
+// RetryingWafCertificateManager retries the transient errors of another WafCertificateManager.
+type RetryingWafCertificateManager struct {
+	retrier
+	next WafCertificateManager
+}
+
+func NewRetryingWafCertificateManager(next WafCertificateManager, policy RetryPolicy) *RetryingWafCertificateManager {
+	return &RetryingWafCertificateManager{retrier: newRetrier(policy, "waf", metrics.RecordWafApiRetry), next: next}
+}
+
+// CreateCertificate is retried only after checking that the certificate wasn't created by the failed attempt,
+// since the certificate name is the hash of its content.
+func (m *RetryingWafCertificateManager) CreateCertificate(opts waf.CreateOpts) (*waf.Certificate, error) {
+	var certificate *waf.Certificate
+	err := m.withRetries("create_certificate", func(attempt int) error {
+		if attempt > 1 {
+			existingCertificate, err := m.findCertificateByName(opts.Name)
+			if err != nil {
+				return err
+			}
+			if existingCertificate != nil {
+				log.Printf("certificate %s was created by a failed attempt", opts.Name)
+				certificate = existingCertificate
+				return nil
+			}
+		}
+		var err error
+		certificate, err = m.next.CreateCertificate(opts)
+		return err
+	})
+	return certificate, err
+}
+
+func (m *RetryingWafCertificateManager) findCertificateByName(name string) (*waf.Certificate, error) {
+	certificates, err := m.next.ListCertificates()
+	if err != nil {
+		return nil, err
+	}
+	for _, certificate := range certificates {
+		if certificate.Name == name {
+			return &certificate, nil
+		}
+	}
+	return nil, nil
+}
+
+// DeleteCertificate treats a certificate that is not found after a failed attempt as deleted.
+func (m *RetryingWafCertificateManager) DeleteCertificate(id string) error {
+	return m.withRetries("delete_certificate", func(attempt int) error {
+		err := m.next.DeleteCertificate(id)
+		if attempt > 1 && isNotFound(err) {
+			return nil
+		}
+		return err
+	})
+}
+
+func (m *RetryingWafCertificateManager) ListCertificates() ([]waf.Certificate, error) {
+	var certificates []waf.Certificate
+	err := m.withRetries("list_certificates", func(int) error {
+		var err error
+		certificates, err = m.next.ListCertificates()
+		return err
+	})
+	return certificates, err
+}
+
+func (m *RetryingWafCertificateManager) GetDomain(domainId string) (*wafDomain.Domain, error) {
+	var domain *wafDomain.Domain
+	err := m.withRetries("get_domain", func(int) error {
+		var err error
+		domain, err = m.next.GetDomain(domainId)
+		return err
+	})
+	return domain, err
+}
+
+func (m *RetryingWafCertificateManager) UpdateDomain(domainId string, opts wafDomain.UpdateOpts) (*wafDomain.Domain, error) {
+	var domain *wafDomain.Domain
+	err := m.withRetries("update_domain", func(int) error {
+		var err error
+		domain, err = m.next.UpdateDomain(domainId, opts)
+		return err
+	})
+	return domain, err
+}
+
+func (m *RetryingWafCertificateManager) ListDomains() ([]wafDomain.Domain, error) {
+	var domains []wafDomain.Domain
+	err := m.withRetries("list_domains", func(int) error {
+		var err error
+		domains, err = m.next.ListDomains()
+		return err
+	})
+	return domains, err
+}
+
+// withRetries calls the operation until it succeeds, fails with an error that isn't transient or the budget is spent.
+// The attempt number starting at 1 is passed to the operation.
+func (r *retrier) withRetries(operation string, call func(attempt int) error) error {
+	start := r.now()
+	for attempt := 1; ; attempt++ {
+		err := call(attempt)
+		if err == nil || !isRetryable(err) {
+			return err
+		}
+		delay, found := retryAfter(err, r.now())
+		if attempt >= r.policy.MaxAttempts {
+			return err
+		}
+		if !found {
+			delay = r.randomDuration(backoff(r.policy, attempt))
+		}
+		if r.now().Add(delay).Sub(start) > r.policy.MaxElapsed {
+			log.Printf("%s %s failed, the retry budget of %s is spent: %v", r.api, operation, r.policy.MaxElapsed, err)
+			return err
+		}
+
+		log.Printf("%s %s failed in attempt %d, retrying in %s: %v", r.api, operation, attempt, delay, err)
+		r.recordRetry(operation)
+		r.sleep(delay)
+	}
+}
+
+// backoff returns the upper bound of the jittered delay, so concurrent uploads don't retry in lockstep.
+func backoff(policy RetryPolicy, attempt int) time.Duration {
+	if attempt < 32 && policy.BaseDelay<<(attempt-1) < policy.MaxDelay {
+		return policy.BaseDelay << (attempt - 1)
+	}
+	return policy.MaxDelay
+}
+
+// isRetryable doesn't retry failed reauthentications, repeated logins with wrong credentials can lock the iam user.
+func isRetryable(err error) bool {
+	var throttled golangsdk.ErrDefault429
+	var timeout golangsdk.ErrDefault408
+	var internalServerError golangsdk.ErrDefault500
+	var serviceUnavailable golangsdk.ErrDefault503
+	var unexpectedResponseCode golangsdk.ErrUnexpectedResponseCode
+	var afterReauthentication *golangsdk.ErrErrorAfterReauthentication
+	var networkError net.Error
+
+	switch {
+	case errors.As(err, &throttled), errors.As(err, &timeout),
+		errors.As(err, &internalServerError), errors.As(err, &serviceUnavailable):
+		return true
+	case errors.As(err, &unexpectedResponseCode):
+		return unexpectedResponseCode.Actual == http.StatusBadGateway ||
+			unexpectedResponseCode.Actual == http.StatusGatewayTimeout
+	case errors.As(err, &afterReauthentication):
+		return isRetryable(afterReauthentication.ErrOriginal)
+	case errors.As(err, &networkError):
+		return true
+	default:
+		return false
+	}
+}
+
+func isNotFound(err error) bool {
+	var notFound golangsdk.ErrDefault404
+	return errors.As(err, &notFound)
+}
+
+// retryAfterDelays holds the time from the Retry-After header of the last throttled response per request,
+// since the errors of the sdk don't contain the response headers.
+var retryAfterDelays sync.Map
+
+func retryAfter(err error, currentTime time.Time) (time.Duration, bool) {
+	method, url, found := requestOfError(err)
+	if !found {
+		return 0, false
+	}
+	retryAt, found := retryAfterDelays.LoadAndDelete(method + " " + url)
+	if !found {
+		return 0, false
+	}
+	delay := retryAt.(time.Time).Sub(currentTime)
+	if delay < 0 {
+		delay = 0
+	}
+	return delay, true
+}
+
+func requestOfError(err error) (string, string, bool) {
+	var throttled golangsdk.ErrDefault429
+	var serviceUnavailable golangsdk.ErrDefault503
+	switch {
+	case errors.As(err, &throttled):
+		return throttled.Method, throttled.URL, true
+	case errors.As(err, &serviceUnavailable):
+		return serviceUnavailable.Method, serviceUnavailable.URL, true
+	default:
+		return "", "", false
+	}
+}
+
+type retryAfterTransport struct {
+	next http.RoundTripper
+}
+
+func (t retryAfterTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	response, err := t.next.RoundTrip(request)
+	if err != nil {
+		return response, err
+	}
+	if response.StatusCode == http.StatusTooManyRequests || response.StatusCode == http.StatusServiceUnavailable {
+		if retryAt, found := parseRetryAfter(response.Header.Get("Retry-After"), time.Now()); found {
+			retryAfterDelays.Store(request.Method+" "+request.URL.String(), retryAt)
+		}
+	}
+	return response, nil
+}
+
+// parseRetryAfter returns the time after which the request can be retried.
+func parseRetryAfter(value string, currentTime time.Time) (time.Time, bool) {
+	if len(value) == 0 {
+		return time.Time{}, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return currentTime.Add(time.Duration(seconds) * time.Second), true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return date, true
+	}
+	return time.Time{}, false
+}
+
+// ConfigureProviderClient replaces the fixed 60 second backoff of the sdk on throttled requests
+// with the retries of the adapter, which honour the Retry-After header.
+func ConfigureProviderClient(provider *golangsdk.ProviderClient) {
+	noBackoffRetries := 0
+	provider.MaxBackoffRetries = &noBackoffRetries
+
+	transport := provider.HTTPClient.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	provider.HTTPClient.Transport = retryAfterTransport{next: transport}
+}
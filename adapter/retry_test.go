@@ -0,0 +1,193 @@
+package adapter
+
+import (
+	"errors"
+	golangsdk "github.com/opentelekomcloud/gophertelekomcloud"
+	waf "github.com/opentelekomcloud/gophertelekomcloud/openstack/waf/v1/certificates"
+	wafDomain "github.com/opentelekomcloud/gophertelekomcloud/openstack/waf/v1/domains"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+type roundTripperFunc func(request *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(request *http.Request) (*http.Response, error) {
+	return f(request)
+}
+
+func newTestRetryingManager(fake *FakeWafCertificateManager) (*RetryingWafCertificateManager, *[]time.Duration) {
+	var delays []time.Duration
+	currentTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	manager := NewRetryingWafCertificateManager(fake, DefaultRetryPolicy)
+	manager.now = func() time.Time { return currentTime }
+	manager.sleep = func(delay time.Duration) {
+		delays = append(delays, delay)
+		currentTime = currentTime.Add(delay)
+	}
+	manager.randomDuration = func(max time.Duration) time.Duration { return max }
+	return manager, &delays
+}
+
+func unavailable() error {
+	return golangsdk.ErrDefault503{ErrUnexpectedResponseCode: golangsdk.ErrUnexpectedResponseCode{
+		Method: "GET", URL: "https://waf.eu-de.otc.t-systems.com/v1/project/waf/instance/domain-1", Actual: 503}}
+}
+
+func TestGetDomain_retriesTransientErrors(t *testing.T) {
+	fake := NewFakeWafCertificateManager()
+	fake.AddDomain(wafDomain.Domain{Id: "domain-1"})
+	fake.FailNext("GetDomain domain-1", unavailable(), unavailable())
+	manager, delays := newTestRetryingManager(fake)
+
+	domain, err := manager.GetDomain("domain-1")
+
+	assert.Nil(t, err)
+	assert.Equal(t, "domain-1", domain.Id)
+	assert.Len(t, fake.Calls(), 3)
+	assert.Equal(t, []time.Duration{250 * time.Millisecond, 500 * time.Millisecond}, *delays)
+}
+
+func TestGetDomain_givesUpAfterMaxAttempts(t *testing.T) {
+	fake := NewFakeWafCertificateManager()
+	fake.AddDomain(wafDomain.Domain{Id: "domain-1"})
+	fake.FailNext("GetDomain domain-1", unavailable(), unavailable(), unavailable(), unavailable())
+	manager, _ := newTestRetryingManager(fake)
+
+	_, err := manager.GetDomain("domain-1")
+
+	assert.NotNil(t, err)
+	assert.Len(t, fake.Calls(), DefaultRetryPolicy.MaxAttempts)
+}
+
+func TestGetDomain_doesNotRetryPermanentErrors(t *testing.T) {
+	fake := NewFakeWafCertificateManager()
+	manager, _ := newTestRetryingManager(fake)
+
+	_, err := manager.GetDomain("domain-1")
+
+	assert.NotNil(t, err)
+	assert.Len(t, fake.Calls(), 1)
+}
+
+func TestRetryAfterTransport(t *testing.T) {
+	transport := retryAfterTransport{next: roundTripperFunc(func(request *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {"3"}}}, nil
+	})}
+	requestUrl, _ := url.Parse("https://waf.eu-de.otc.t-systems.com/v1/project/waf/certificate")
+
+	_, err := transport.RoundTrip(&http.Request{Method: "GET", URL: requestUrl})
+
+	assert.Nil(t, err)
+	throttled := golangsdk.ErrDefault429{ErrUnexpectedResponseCode: golangsdk.ErrUnexpectedResponseCode{
+		Method: "GET", URL: requestUrl.String(), Actual: 429}}
+	delay, found := retryAfter(throttled, time.Now())
+	assert.True(t, found)
+	assert.InDelta(t, 3*time.Second, delay, float64(time.Second))
+}
+
+func TestWithRetries_honoursRetryAfter(t *testing.T) {
+	manager, delays := newTestRetryingManager(NewFakeWafCertificateManager())
+	requestUrl := "https://waf.eu-de.otc.t-systems.com/v1/project/waf/certificate"
+	retryAfterDelays.Store("GET "+requestUrl, manager.now().Add(1500*time.Millisecond))
+	throttled := golangsdk.ErrDefault429{ErrUnexpectedResponseCode: golangsdk.ErrUnexpectedResponseCode{
+		Method: "GET", URL: requestUrl, Actual: 429}}
+	calls := 0
+
+	err := manager.withRetries("list_certificates", func(int) error {
+		calls++
+		if calls == 1 {
+			return throttled
+		}
+		return nil
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, []time.Duration{1500 * time.Millisecond}, *delays)
+}
+
+func TestWithRetries_respectsBudget(t *testing.T) {
+	manager, delays := newTestRetryingManager(NewFakeWafCertificateManager())
+	manager.policy.MaxElapsed = time.Second
+	retryAfterDelays.Store("GET https://waf.eu-de.otc.t-systems.com/v1/project/waf/instance/domain-1",
+		manager.now().Add(10*time.Second))
+	calls := 0
+
+	err := manager.withRetries("get_domain", func(int) error {
+		calls++
+		return unavailable()
+	})
+
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, calls)
+	assert.Empty(t, *delays)
+}
+
+func TestCreateCertificate_doesNotCreateTwice(t *testing.T) {
+	fake := NewFakeWafCertificateManager()
+	fake.AddCertificate(waf.Certificate{Id: "12345", Name: "hash"})
+	fake.FailNext("CreateCertificate", golangsdk.ErrDefault500{})
+	manager, _ := newTestRetryingManager(fake)
+
+	certificate, err := manager.CreateCertificate(waf.CreateOpts{Name: "hash"})
+
+	assert.Nil(t, err)
+	assert.Equal(t, "12345", certificate.Id)
+	assert.Equal(t, []string{"CreateCertificate", "ListCertificates"}, fake.Calls())
+}
+
+func TestCreateCertificate_retriesIfNotCreated(t *testing.T) {
+	fake := NewFakeWafCertificateManager()
+	fake.AddCertificate(waf.Certificate{Id: "other", Name: "other-hash"})
+	fake.FailNext("CreateCertificate", golangsdk.ErrDefault429{})
+	manager, _ := newTestRetryingManager(fake)
+
+	certificate, err := manager.CreateCertificate(waf.CreateOpts{Name: "hash"})
+
+	assert.Nil(t, err)
+	assert.Equal(t, "hash", certificate.Name)
+	assert.Equal(t, []string{"CreateCertificate", "ListCertificates", "CreateCertificate"}, fake.Calls())
+}
+
+func TestDeleteCertificate_notFoundAfterRetryIsDeleted(t *testing.T) {
+	fake := NewFakeWafCertificateManager()
+	fake.FailNext("DeleteCertificate 12345", unavailable())
+	manager, _ := newTestRetryingManager(fake)
+
+	err := manager.DeleteCertificate("12345")
+
+	assert.Nil(t, err)
+	assert.Len(t, fake.Calls(), 2)
+}
+
+func TestIsRetryable(t *testing.T) {
+	assert.True(t, isRetryable(golangsdk.ErrUnexpectedResponseCode{Actual: http.StatusBadGateway}))
+	assert.True(t, isRetryable(&golangsdk.ErrErrorAfterReauthentication{ErrOriginal: golangsdk.ErrDefault503{}}))
+	assert.True(t, isRetryable(&url.Error{Op: "Get", Err: timeoutError{}}))
+	assert.False(t, isRetryable(&golangsdk.ErrUnableToReauthenticate{ErrOriginal: golangsdk.ErrDefault401{}}))
+	assert.False(t, isRetryable(golangsdk.ErrDefault400{}))
+	assert.False(t, isRetryable(errors.New("any error")))
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestParseRetryAfter(t *testing.T) {
+	currentTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	retryAt, found := parseRetryAfter("7", currentTime)
+	assert.True(t, found)
+	assert.Equal(t, currentTime.Add(7*time.Second), retryAt)
+
+	retryAt, found = parseRetryAfter("Mon, 01 Jan 2024 00:00:30 GMT", currentTime)
+	assert.True(t, found)
+	assert.Equal(t, 30*time.Second, retryAt.Sub(currentTime))
+
+	_, found = parseRetryAfter("soon", currentTime)
+	assert.False(t, found)
+}
@@ -0,0 +1,94 @@
+package adapter
+
+import (
+	elb "github.com/opentelekomcloud/gophertelekomcloud/openstack/elb/v3/certificates"
+	elbListener "github.com/opentelekomcloud/gophertelekomcloud/openstack/elb/v3/listeners"
+	waf "github.com/opentelekomcloud/gophertelekomcloud/openstack/waf/v1/certificates"
+	wafDomain "github.com/opentelekomcloud/gophertelekomcloud/openstack/waf/v1/domains"
+	"sync/atomic"
+)
+
+// SwappableWafCertificateManager forwards each call to the current WafCertificateManager, which is replaced when the
+// otc credentials are reloaded. A call that started before Swap finishes on the previous manager.
+type SwappableWafCertificateManager struct {
+	current atomic.Pointer[WafCertificateManager]
+}
+
+func NewSwappableWafCertificateManager(manager WafCertificateManager) *SwappableWafCertificateManager {
+	swappable := &SwappableWafCertificateManager{}
+	swappable.Swap(manager)
+	return swappable
+}
+
+func (m *SwappableWafCertificateManager) Swap(manager WafCertificateManager) {
+	m.current.Store(&manager)
+}
+
+func (m *SwappableWafCertificateManager) load() WafCertificateManager {
+	return *m.current.Load()
+}
+
+func (m *SwappableWafCertificateManager) CreateCertificate(opts waf.CreateOpts) (*waf.Certificate, error) {
+	return m.load().CreateCertificate(opts)
+}
+
+func (m *SwappableWafCertificateManager) DeleteCertificate(id string) error {
+	return m.load().DeleteCertificate(id)
+}
+
+func (m *SwappableWafCertificateManager) ListCertificates() ([]waf.Certificate, error) {
+	return m.load().ListCertificates()
+}
+
+func (m *SwappableWafCertificateManager) GetDomain(domainId string) (*wafDomain.Domain, error) {
+	return m.load().GetDomain(domainId)
+}
+
+func (m *SwappableWafCertificateManager) UpdateDomain(domainId string, opts wafDomain.UpdateOpts) (*wafDomain.Domain, error) {
+	return m.load().UpdateDomain(domainId, opts)
+}
+
+func (m *SwappableWafCertificateManager) ListDomains() ([]wafDomain.Domain, error) {
+	return m.load().ListDomains()
+}
+
+// SwappableElbCertificateManager is the SwappableWafCertificateManager of the elb.
+type SwappableElbCertificateManager struct {
+	current atomic.Pointer[ElbCertificateManager]
+}
+
+func NewSwappableElbCertificateManager(manager ElbCertificateManager) *SwappableElbCertificateManager {
+	swappable := &SwappableElbCertificateManager{}
+	swappable.Swap(manager)
+	return swappable
+}
+
+func (m *SwappableElbCertificateManager) Swap(manager ElbCertificateManager) {
+	m.current.Store(&manager)
+}
+
+func (m *SwappableElbCertificateManager) load() ElbCertificateManager {
+	return *m.current.Load()
+}
+
+func (m *SwappableElbCertificateManager) CreateCertificate(opts elb.CreateOpts) (*elb.Certificate, error) {
+	return m.load().CreateCertificate(opts)
+}
+
+func (m *SwappableElbCertificateManager) DeleteCertificate(id string) error {
+	return m.load().DeleteCertificate(id)
+}
+
+func (m *SwappableElbCertificateManager) ListCertificates() ([]elb.Certificate, error) {
+	return m.load().ListCertificates()
+}
+
+func (m *SwappableElbCertificateManager) GetListener(listenerId string) (*elbListener.Listener, error) {
+	return m.load().GetListener(listenerId)
+}
+
+func (m *SwappableElbCertificateManager) UpdateListener(
+	listenerId string,
+	opts elbListener.UpdateOpts) (*elbListener.Listener, error) {
+	return m.load().UpdateListener(listenerId, opts)
+}
@@ -0,0 +1,44 @@
+package adapter
+
+import (
+	elbListener "github.com/opentelekomcloud/gophertelekomcloud/openstack/elb/v3/listeners"
+	wafDomain "github.com/opentelekomcloud/gophertelekomcloud/openstack/waf/v1/domains"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSwappableWafCertificateManager_callsTheCurrentManager(t *testing.T) {
+	previous := NewFakeWafCertificateManager()
+	previous.AddDomain(wafDomain.Domain{Id: "domain-1", HostName: "previous.domain.com"})
+	next := NewFakeWafCertificateManager()
+	next.AddDomain(wafDomain.Domain{Id: "domain-1", HostName: "next.domain.com"})
+	manager := NewSwappableWafCertificateManager(previous)
+
+	domain, err := manager.GetDomain("domain-1")
+	assert.Nil(t, err)
+	assert.Equal(t, "previous.domain.com", domain.HostName)
+
+	manager.Swap(next)
+	domain, err = manager.GetDomain("domain-1")
+
+	assert.Nil(t, err)
+	assert.Equal(t, "next.domain.com", domain.HostName)
+	assert.Equal(t, []string{"GetDomain domain-1"}, previous.Calls())
+	assert.Equal(t, []string{"GetDomain domain-1"}, next.Calls())
+}
+
+func TestSwappableElbCertificateManager_callsTheCurrentManager(t *testing.T) {
+	previous := NewFakeElbCertificateManager()
+	next := NewFakeElbCertificateManager()
+	next.AddListener(elbListener.Listener{ID: "listener-1", Protocol: "HTTPS"})
+	manager := NewSwappableElbCertificateManager(previous)
+
+	_, err := manager.GetListener("listener-1")
+	assert.NotNil(t, err)
+
+	manager.Swap(next)
+	listener, err := manager.GetListener("listener-1")
+
+	assert.Nil(t, err)
+	assert.Equal(t, "HTTPS", listener.Protocol)
+}
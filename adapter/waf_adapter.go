@@ -1,22 +1,53 @@
 package adapter
 
 import (
+	"encoding/json"
+	"errors"
 	golangsdk "github.com/opentelekomcloud/gophertelekomcloud"
 	waf "github.com/opentelekomcloud/gophertelekomcloud/openstack/waf/v1/certificates"
 	wafDomain "github.com/opentelekomcloud/gophertelekomcloud/openstack/waf/v1/domains"
+	"github.com/opentelekomcloud/gophertelekomcloud/pagination"
 	"log"
+	"waf-cert-uploader/metrics"
 )
 
-var CreateAndExtract = func(c *golangsdk.ServiceClient, opts waf.CreateOpts) (*waf.Certificate, error) {
-	return waf.Create(c, opts).Extract()
+// ErrInvalidConfiguration is returned for options a waf can't apply, e.g. origin servers of a dedicated waf host.
+var ErrInvalidConfiguration = errors.New("invalid secret configuration")
+
+// WafCertificateManager manages the certificates and domains of a waf.
+type WafCertificateManager interface {
+	CreateCertificate(opts waf.CreateOpts) (*waf.Certificate, error)
+	DeleteCertificate(id string) error
+	ListCertificates() ([]waf.Certificate, error)
+	GetDomain(domainId string) (*wafDomain.Domain, error)
+	UpdateDomain(domainId string, opts wafDomain.UpdateOpts) (*wafDomain.Domain, error)
+	ListDomains() ([]wafDomain.Domain, error)
+}
+
+// OtcWafCertificateManager calls the waf of the open telekom cloud once per operation.
+type OtcWafCertificateManager struct {
+	client *golangsdk.ServiceClient
+}
+
+func NewOtcWafCertificateManager(client *golangsdk.ServiceClient) *OtcWafCertificateManager {
+	return &OtcWafCertificateManager{client: client}
+}
+
+func (m *OtcWafCertificateManager) CreateCertificate(opts waf.CreateOpts) (*waf.Certificate, error) {
+	certificate, err := waf.Create(m.client, opts).Extract()
+	metrics.RecordWafApiCall("create_certificate", err)
+	return certificate, err
 }
 
-var DeleteAndExtract = func(c *golangsdk.ServiceClient, id string) (*golangsdk.ErrRespond, error) {
-	return waf.Delete(c, id).Extract()
+func (m *OtcWafCertificateManager) DeleteCertificate(id string) error {
+	_, err := waf.Delete(m.client, id).Extract()
+	metrics.RecordWafApiCall("delete_certificate", err)
+	return err
 }
 
-var ListAndExtract = func(c *golangsdk.ServiceClient, opts waf.ListOptsBuilder) ([]waf.Certificate, error) {
-	pages, err := waf.List(c, opts).AllPages()
+func (m *OtcWafCertificateManager) ListCertificates() ([]waf.Certificate, error) {
+	pages, err := waf.List(m.client, waf.ListOpts{}).AllPages()
+	metrics.RecordWafApiCall("list_certificates", err)
 	if err != nil {
 		log.Println(err)
 		return []waf.Certificate{}, err
@@ -24,15 +55,36 @@ var ListAndExtract = func(c *golangsdk.ServiceClient, opts waf.ListOptsBuilder)
 	return waf.ExtractCertificates(pages)
 }
 
-var UpdateDomainAndExtract = func(
-	c *golangsdk.ServiceClient,
-	domainID string,
-	opts wafDomain.UpdateOptsBuilder) (*wafDomain.Domain, error) {
-	return wafDomain.Update(c, domainID, opts).Extract()
+func (m *OtcWafCertificateManager) GetDomain(domainId string) (*wafDomain.Domain, error) {
+	domain, err := wafDomain.Get(m.client, domainId).Extract()
+	metrics.RecordWafApiCall("get_domain", err)
+	return domain, err
 }
 
-var GetWafDomainAndExtract = func(
-	c *golangsdk.ServiceClient,
-	domainID string) (*wafDomain.Domain, error) {
-	return wafDomain.Get(c, domainID).Extract()
+func (m *OtcWafCertificateManager) UpdateDomain(domainId string, opts wafDomain.UpdateOpts) (*wafDomain.Domain, error) {
+	domain, err := wafDomain.Update(m.client, domainId, opts).Extract()
+	metrics.RecordWafApiCall("update_domain", err)
+	return domain, err
+}
+
+// ListDomains lists all waf domains. The sdk has no list call for waf v1 domains,
+// but the endpoint is paginated the same way as the certificate list, so its page type is reused.
+func (m *OtcWafCertificateManager) ListDomains() ([]wafDomain.Domain, error) {
+	pager := pagination.NewPager(m.client, m.client.ServiceURL("instance"), func(r pagination.PageResult) pagination.Page {
+		return waf.CertificatePage{OffsetPageBase: pagination.OffsetPageBase{PageResult: r}}
+	})
+	pager.Headers = map[string]string{"content-type": "application/json"}
+
+	pages, err := pager.AllPages()
+	metrics.RecordWafApiCall("list_domains", err)
+	if err != nil {
+		log.Println(err)
+		return []wafDomain.Domain{}, err
+	}
+
+	var domainList struct {
+		Items []wafDomain.Domain `json:"items"`
+	}
+	err = json.Unmarshal(pages.GetBody(), &domainList)
+	return domainList.Items, err
 }
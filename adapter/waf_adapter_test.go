@@ -0,0 +1,113 @@
+package adapter
+
+import (
+	"errors"
+	"fmt"
+	golangsdk "github.com/opentelekomcloud/gophertelekomcloud"
+	waf "github.com/opentelekomcloud/gophertelekomcloud/openstack/waf/v1/certificates"
+	wafDomain "github.com/opentelekomcloud/gophertelekomcloud/openstack/waf/v1/domains"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+	"waf-cert-uploader/adapter/otctest"
+)
+
+func newTestOtcWafCertificateManager(t *testing.T) (*OtcWafCertificateManager, *otctest.OtcServer) {
+	server := otctest.NewServer()
+	t.Cleanup(server.Close)
+	wafClient, err := server.NewWafClient()
+	assert.Nil(t, err)
+	ConfigureProviderClient(wafClient.ProviderClient)
+	return NewOtcWafCertificateManager(wafClient), server
+}
+
+func TestOtcWafCertificateManager_listsAllPages(t *testing.T) {
+	manager, server := newTestOtcWafCertificateManager(t)
+	for i := 0; i < 23; i++ {
+		server.AddCertificate(otctest.Certificate{Id: fmt.Sprintf("certificate-%02d", i), Name: fmt.Sprintf("hash-%02d", i)})
+	}
+	for i := 0; i < 12; i++ {
+		server.AddDomain(otctest.Domain{Id: fmt.Sprintf("domain-%02d", i), HostName: "my.domain.com"})
+	}
+
+	certificates, err := manager.ListCertificates()
+	assert.Nil(t, err)
+	assert.Len(t, certificates, 23)
+	assert.Equal(t, "hash-22", certificates[22].Name)
+
+	domains, err := manager.ListDomains()
+	assert.Nil(t, err)
+	assert.Len(t, domains, 12)
+	assert.Equal(t, "domain-11", domains[11].Id)
+
+	// the sdk requests the first page twice and stops at the first empty page
+	assert.Equal(t, []string{"create_token",
+		"list_certificates", "list_certificates", "list_certificates", "list_certificates", "list_certificates",
+		"list_domains", "list_domains", "list_domains", "list_domains"}, server.Calls())
+}
+
+func TestOtcWafCertificateManager_attachAndDelete(t *testing.T) {
+	manager, server := newTestOtcWafCertificateManager(t)
+	server.AddDomain(otctest.Domain{Id: "domain-1", HostName: "my.domain.com",
+		Server: []otctest.Server{{ClientProtocol: "HTTP", ServerProtocol: "HTTP", Address: "10.0.0.1", Port: 80}}})
+
+	certificate, err := manager.CreateCertificate(waf.CreateOpts{Name: "hash", Content: "cert", Key: "key"})
+	assert.Nil(t, err)
+	assert.Equal(t, "certificate-1", certificate.Id)
+
+	domain, err := manager.GetDomain("domain-1")
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.1", domain.Server[0].Address)
+
+	_, err = manager.UpdateDomain("domain-1", wafDomain.UpdateOpts{CertificateId: certificate.Id, Server: []wafDomain.ServerOpts{
+		{ClientProtocol: "HTTP", ServerProtocol: "HTTP", Address: "10.0.0.1", Port: 80},
+		{ClientProtocol: "HTTPS", ServerProtocol: "HTTP", Address: "10.0.0.1", Port: 80},
+	}})
+	assert.Nil(t, err)
+	updatedDomain, _ := server.Domain("domain-1")
+	assert.Equal(t, "certificate-1", updatedDomain.CertificateId)
+	assert.Len(t, updatedDomain.Server, 2)
+
+	err = manager.DeleteCertificate(certificate.Id)
+	var badRequest golangsdk.ErrDefault400
+	assert.True(t, errors.As(err, &badRequest))
+
+	_, err = manager.CreateCertificate(waf.CreateOpts{Name: "hash", Content: "cert", Key: "key"})
+	assert.True(t, errors.As(err, &badRequest))
+}
+
+func TestOtcWafCertificateManager_deleteUnknownCertificate(t *testing.T) {
+	manager, _ := newTestOtcWafCertificateManager(t)
+
+	err := manager.DeleteCertificate("unknown")
+
+	assert.True(t, isNotFound(err))
+}
+
+func TestOtcWafCertificateManager_reauthenticatesOnExpiredToken(t *testing.T) {
+	manager, server := newTestOtcWafCertificateManager(t)
+	server.AddDomain(otctest.Domain{Id: "domain-1", HostName: "my.domain.com"})
+	server.FailNext("get_domain", http.StatusUnauthorized)
+
+	domain, err := manager.GetDomain("domain-1")
+
+	assert.Nil(t, err)
+	assert.Equal(t, "my.domain.com", domain.HostName)
+	assert.Equal(t, []string{"create_token", "get_domain", "create_token", "get_domain"}, server.Calls())
+}
+
+func TestRetryingWafCertificateManager_againstServer(t *testing.T) {
+	otcManager, server := newTestOtcWafCertificateManager(t)
+	server.FailNext("create_certificate", http.StatusServiceUnavailable)
+	manager := NewRetryingWafCertificateManager(otcManager, DefaultRetryPolicy)
+	manager.sleep = func(time.Duration) {}
+
+	certificate, err := manager.CreateCertificate(waf.CreateOpts{Name: "hash", Content: "cert", Key: "key"})
+
+	assert.Nil(t, err)
+	assert.Equal(t, "hash", certificate.Name)
+	assert.Len(t, server.Certificates(), 1)
+	assert.Equal(t, []string{"create_token", "create_certificate", "list_certificates", "list_certificates",
+		"create_certificate"}, server.Calls())
+}
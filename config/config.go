@@ -0,0 +1,481 @@
+// Package config loads the configuration of the uploader from a yaml file, environment variables and flags.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"waf-cert-uploader/adapter"
+	"waf-cert-uploader/service"
+)
+
+const (
+	WebhookMode    = "webhook"
+	ReconcilerMode = "reconciler"
+
+	redacted = "<redacted>"
+)
+
+// Config is the configuration of the uploader. Each field can be set in the yaml file, by the environment variables
+// of its env tag, the first one that is set wins, and for some fields by a flag. Fields with a secret tag are
+// redacted when the configuration is printed, urls with the userinfo secret tag only lose their user and password.
+type Config struct {
+	Mode              string                  `yaml:"mode" env:"MODE"`
+	Port              string                  `yaml:"port" env:"PORT"`
+	WatchNamespace    string                  `yaml:"watchNamespace" env:"WATCH_NAMESPACE"`
+	Webhook           WebhookConfig           `yaml:"webhook"`
+	Otc               OtcConfig               `yaml:"otc"`
+	Waf               WafConfig               `yaml:"waf"`
+	Reconciler        ReconcilerConfig        `yaml:"reconciler"`
+	DriftDetection    DriftDetectionConfig    `yaml:"driftDetection"`
+	GarbageCollection GarbageCollectionConfig `yaml:"garbageCollection"`
+
+	// PrintConfig prints the effective configuration instead of starting the uploader.
+	PrintConfig bool `yaml:"-"`
+}
+
+type WebhookConfig struct {
+	// CertMountPath is the directory of tls.crt and tls.key if TlsCertFile and TlsKeyFile aren't set.
+	CertMountPath  string `yaml:"certMountPath" env:"CERT_MOUNT_PATH"`
+	TlsCertFile    string `yaml:"tlsCertFile" env:"TLS_CERT_FILE"`
+	TlsKeyFile     string `yaml:"tlsKeyFile" env:"TLS_KEY_FILE"`
+	FailOpenPolicy string `yaml:"failOpenPolicy" env:"FAIL_OPEN_POLICY"`
+	UploadMode     string `yaml:"uploadMode" env:"UPLOAD_MODE"`
+	UploadWorkers  int    `yaml:"uploadWorkers" env:"UPLOAD_WORKERS"`
+}
+
+// OtcConfig has the environment variables of the otc terraform provider and the gophertelekomcloud sdk with the
+// OTC_ prefix, the OS_ prefix of the sdk is accepted as well. The credentials are either read from the files of
+// CredentialsMountPath or set here.
+type OtcConfig struct {
+	CredentialsMountPath      string        `yaml:"credentialsMountPath" env:"CREDENTIALS_MOUNT_PATH"`
+	CredentialsReloadInterval time.Duration `yaml:"credentialsReloadInterval" env:"CREDENTIALS_RELOAD_INTERVAL"`
+
+	AuthUrl          string `yaml:"authUrl" env:"OTC_AUTH_URL,OTC_IAM_ENDPOINT,OS_AUTH_URL"`
+	Region           string `yaml:"region" env:"OTC_REGION_NAME,OTC_REGION,OS_REGION_NAME"`
+	ProjectName      string `yaml:"projectName" env:"OTC_PROJECT_NAME,OS_PROJECT_NAME"`
+	DomainName       string `yaml:"domainName" env:"OTC_DOMAIN_NAME,OS_DOMAIN_NAME"`
+	Username         string `yaml:"username" env:"OTC_USERNAME,OS_USERNAME"`
+	Password         string `yaml:"password" env:"OTC_PASSWORD,OS_PASSWORD" secret:"true"`
+	AccessKey        string `yaml:"accessKey" env:"OTC_ACCESS_KEY,OS_ACCESS_KEY"`
+	SecretKey        string `yaml:"secretKey" env:"OTC_SECRET_KEY,OS_SECRET_KEY" secret:"true"`
+	SecurityToken    string `yaml:"securityToken" env:"OTC_SECURITY_TOKEN,OS_SECURITY_TOKEN" secret:"true"`
+	AgencyName       string `yaml:"agencyName" env:"OTC_AGENCY_NAME,OS_AGENCY_NAME"`
+	AgencyDomainName string `yaml:"agencyDomainName" env:"OTC_AGENCY_DOMAIN_NAME,OS_AGENCY_DOMAIN_NAME"`
+
+	WafEndpoint          string `yaml:"wafEndpoint" env:"OTC_WAF_ENDPOINT"`
+	DedicatedWafEndpoint string `yaml:"dedicatedWafEndpoint" env:"OTC_DEDICATED_WAF_ENDPOINT"`
+	CaBundle             string `yaml:"caBundle" env:"OTC_CA_CERT,OTC_CA_BUNDLE,OS_CACERT"`
+	HttpProxy            string `yaml:"httpProxy" env:"OTC_HTTP_PROXY" secret:"userinfo"`
+}
+
+type WafConfig struct {
+	Type                   string        `yaml:"type" env:"WAF_TYPE"`
+	HostnameMismatchPolicy string        `yaml:"hostnameMismatchPolicy" env:"HOSTNAME_MISMATCH_POLICY"`
+	HttpsServerProtocol    string        `yaml:"httpsServerProtocol" env:"HTTPS_SERVER_PROTOCOL"`
+	HttpsServerPort        string        `yaml:"httpsServerPort" env:"HTTPS_SERVER_PORT"`
+	ExpiryWarningThreshold time.Duration `yaml:"expiryWarningThreshold" env:"CERT_EXPIRY_WARNING_THRESHOLD"`
+	ApiMaxAttempts         int           `yaml:"apiMaxAttempts" env:"WAF_API_MAX_ATTEMPTS"`
+	ApiRetryBaseDelay      time.Duration `yaml:"apiRetryBaseDelay" env:"WAF_API_RETRY_BASE_DELAY"`
+	ApiRetryMaxDelay       time.Duration `yaml:"apiRetryMaxDelay" env:"WAF_API_RETRY_MAX_DELAY"`
+	ApiRetryBudget         time.Duration `yaml:"apiRetryBudget" env:"WAF_API_RETRY_BUDGET"`
+}
+
+type ReconcilerConfig struct {
+	Workers int `yaml:"workers" env:"RECONCILER_WORKERS"`
+}
+
+type DriftDetectionConfig struct {
+	// Interval disables the drift detection if it is zero.
+	Interval time.Duration `yaml:"interval" env:"DRIFT_DETECTION_INTERVAL"`
+	Repair   bool          `yaml:"repair" env:"DRIFT_REPAIR"`
+}
+
+type GarbageCollectionConfig struct {
+	// Interval disables the garbage collection if it is zero.
+	Interval    time.Duration `yaml:"interval" env:"CERT_GC_INTERVAL"`
+	GracePeriod time.Duration `yaml:"gracePeriod" env:"CERT_GC_GRACE_PERIOD"`
+	Retention   int           `yaml:"retention" env:"CERT_GC_RETENTION"`
+	DryRun      bool          `yaml:"dryRun" env:"CERT_GC_DRY_RUN"`
+}
+
+// Default returns the configuration that is used for everything that isn't set.
+func Default() Config {
+	return Config{
+		Mode: WebhookMode,
+		Webhook: WebhookConfig{
+			UploadMode:    "sync",
+			UploadWorkers: 2,
+		},
+		Otc: OtcConfig{
+			CredentialsReloadInterval: service.DefaultCredentialsReloadInterval,
+		},
+		Waf: WafConfig{
+			Type:                   string(service.DefaultWafType),
+			HostnameMismatchPolicy: string(service.DefaultHostnameMismatchPolicy),
+			ExpiryWarningThreshold: service.DefaultExpiryWarningThreshold,
+			ApiMaxAttempts:         adapter.DefaultRetryPolicy.MaxAttempts,
+			ApiRetryBaseDelay:      adapter.DefaultRetryPolicy.BaseDelay,
+			ApiRetryMaxDelay:       adapter.DefaultRetryPolicy.MaxDelay,
+			ApiRetryBudget:         adapter.DefaultRetryPolicy.MaxElapsed,
+		},
+		Reconciler: ReconcilerConfig{Workers: 2},
+		GarbageCollection: GarbageCollectionConfig{
+			GracePeriod: service.DefaultGarbageCollectionGracePeriod,
+		},
+	}
+}
+
+// Load applies the yaml file, the environment variables and the flags to the defaults, each one overrides the ones
+// before. The yaml file is given by the config flag or the CONFIG_FILE environment variable.
+func Load(args []string) (Config, error) {
+	config := Default()
+
+	flags := flag.NewFlagSet("waf-cert-uploader", flag.ContinueOnError)
+	configFile := flags.String("config", os.Getenv("CONFIG_FILE"), "YAML file with the configuration.")
+	flags.String("mode", "", "Mode of the uploader, webhook or reconciler.")
+	flags.String("port", "", "Port of the webhook or of the health endpoint of the reconciler.")
+	flags.String("tlsCertFile", "", "File containing the x509 Certificate for HTTPS.")
+	flags.String("tlsKeyFile", "", "File containing the x509 private key to --tlsCertFile.")
+	flags.String("credentialsMountPath", "", "Directory of the mounted OTC credentials.")
+	printConfig := flags.Bool("printConfig", false, "Print the effective configuration and exit.")
+	err := flags.Parse(args)
+	if err != nil {
+		return Config{}, err
+	}
+
+	if len(*configFile) > 0 {
+		err = loadFile(&config, *configFile)
+		if err != nil {
+			return Config{}, err
+		}
+	}
+
+	err = loadEnv(reflect.ValueOf(&config).Elem())
+	if err != nil {
+		return Config{}, err
+	}
+
+	// only the flags that are set override the yaml file and the environment variables
+	flagFields := map[string]*string{
+		"mode":                 &config.Mode,
+		"port":                 &config.Port,
+		"tlsCertFile":          &config.Webhook.TlsCertFile,
+		"tlsKeyFile":           &config.Webhook.TlsKeyFile,
+		"credentialsMountPath": &config.Otc.CredentialsMountPath,
+	}
+	flags.Visit(func(setFlag *flag.Flag) {
+		if field, found := flagFields[setFlag.Name]; found {
+			*field = setFlag.Value.String()
+		}
+	})
+	config.PrintConfig = *printConfig
+
+	if len(config.Webhook.TlsCertFile) == 0 && len(config.Webhook.CertMountPath) > 0 {
+		config.Webhook.TlsCertFile = config.Webhook.CertMountPath + "tls.crt"
+	}
+	if len(config.Webhook.TlsKeyFile) == 0 && len(config.Webhook.CertMountPath) > 0 {
+		config.Webhook.TlsKeyFile = config.Webhook.CertMountPath + "tls.key"
+	}
+	return config, nil
+}
+
+// loadFile rejects unknown keys, so misspelled settings aren't ignored silently.
+func loadFile(config *Config, configFile string) error {
+	file, err := os.Open(configFile)
+	if err != nil {
+		return fmt.Errorf("couldn't read the config file: %w", err)
+	}
+	defer file.Close()
+
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	err = decoder.Decode(config)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("invalid config file %s: %w", configFile, err)
+	}
+	return nil
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// loadEnv sets the fields of the struct from the first of their environment variables that is set.
+func loadEnv(value reflect.Value) error {
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		structField := value.Type().Field(i)
+		if field.Kind() == reflect.Struct {
+			err := loadEnv(field)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		envTag := structField.Tag.Get("env")
+		if len(envTag) == 0 {
+			continue
+		}
+		for _, variable := range strings.Split(envTag, ",") {
+			envValue, found := os.LookupEnv(variable)
+			if !found {
+				continue
+			}
+			err := setField(field, envValue)
+			if err != nil {
+				return fmt.Errorf("invalid %s %q: %w", variable, envValue, err)
+			}
+			break
+		}
+	}
+	return nil
+}
+
+func setField(field reflect.Value, value string) error {
+	switch {
+	case field.Type() == durationType:
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(duration))
+	case field.Kind() == reflect.Int:
+		number, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(number))
+	case field.Kind() == reflect.Bool:
+		boolean, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(boolean)
+	default:
+		field.SetString(value)
+	}
+	return nil
+}
+
+func (c Config) Validate() error {
+	if c.Mode != WebhookMode && c.Mode != ReconcilerMode {
+		return fmt.Errorf("unknown mode %q, expected %s or %s", c.Mode, WebhookMode, ReconcilerMode)
+	}
+	port, err := strconv.Atoi(c.Port)
+	if err != nil || port < 1 || port > 65535 {
+		return fmt.Errorf("invalid port %q", c.Port)
+	}
+
+	validations := []func() error{c.Otc.validate, c.Waf.validate, c.Reconciler.validate,
+		c.DriftDetection.validate, c.GarbageCollection.validate}
+	if c.Mode == WebhookMode {
+		validations = append(validations, c.Webhook.validate)
+	}
+	for _, validate := range validations {
+		err = validate()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w WebhookConfig) validate() error {
+	if len(w.TlsCertFile) == 0 || len(w.TlsKeyFile) == 0 {
+		return errors.New("the tls certificate and key of the webhook are missing, set the cert mount path or the files")
+	}
+	_, err := service.ParseFailOpenPolicy(w.FailOpenPolicy)
+	if err != nil {
+		return err
+	}
+	if w.UploadMode != "sync" && w.UploadMode != "async" {
+		return fmt.Errorf("unknown upload mode %q, expected sync or async", w.UploadMode)
+	}
+	if w.UploadWorkers < 1 {
+		return fmt.Errorf("invalid number of upload workers %d", w.UploadWorkers)
+	}
+	return nil
+}
+
+func (o OtcConfig) validate() error {
+	credentials := o.Credentials()
+	if len(o.CredentialsMountPath) > 0 && len(credentials) > 0 {
+		return errors.New("the otc credentials are set in the configuration and mounted, expected only one of both")
+	}
+	if len(o.CredentialsMountPath) == 0 {
+		err := service.ValidateCredentials(credentials)
+		if err != nil {
+			return err
+		}
+	}
+	if o.CredentialsReloadInterval <= 0 {
+		return fmt.Errorf("invalid credentials reload interval %s", o.CredentialsReloadInterval)
+	}
+	return o.Endpoints().Validate()
+}
+
+// Credentials returns the credentials that are set in the configuration by the names of the credentials files.
+func (o OtcConfig) Credentials() map[string]string {
+	credentials := map[string]string{}
+	fields := map[string]string{
+		"username":         o.Username,
+		"password":         o.Password,
+		"accessKey":        o.AccessKey,
+		"secretKey":        o.SecretKey,
+		"securityToken":    o.SecurityToken,
+		"otcAccountName":   o.DomainName,
+		"projectName":      o.ProjectName,
+		"agencyName":       o.AgencyName,
+		"agencyDomainName": o.AgencyDomainName,
+	}
+	for name, value := range fields {
+		if len(value) > 0 {
+			credentials[name] = value
+		}
+	}
+	return credentials
+}
+
+func (o OtcConfig) OtcOptions() service.OtcOptions {
+	return service.OtcOptions{
+		CredentialsMountPath: o.CredentialsMountPath,
+		StaticCredentials:    o.Credentials(),
+		Endpoints:            o.Endpoints(),
+	}
+}
+
+func (o OtcConfig) Endpoints() service.OtcEndpoints {
+	return service.OtcEndpoints{
+		IamEndpoint:          o.AuthUrl,
+		Region:               o.Region,
+		WafEndpoint:          o.WafEndpoint,
+		DedicatedWafEndpoint: o.DedicatedWafEndpoint,
+		CaBundle:             o.CaBundle,
+		HttpProxy:            o.HttpProxy,
+	}
+}
+
+func (w WafConfig) validate() error {
+	_, err := w.Options()
+	if err != nil {
+		return err
+	}
+	return w.RetryPolicy().Validate()
+}
+
+// Options returns the defaults of the secrets that don't override them with an annotation.
+func (w WafConfig) Options() (service.Options, error) {
+	wafType, err := service.ParseWafType(w.Type)
+	if err != nil {
+		return service.Options{}, err
+	}
+	hostnameMismatchPolicy, err := service.ParseHostnameMismatchPolicy(w.HostnameMismatchPolicy)
+	if err != nil {
+		return service.Options{}, err
+	}
+	httpsBackend, err := service.ParseHttpsBackend(
+		service.DefaultOptions().HttpsBackend, w.HttpsServerProtocol, w.HttpsServerPort)
+	if err != nil {
+		return service.Options{}, err
+	}
+	return service.Options{
+		WafType:                wafType,
+		HostnameMismatchPolicy: hostnameMismatchPolicy,
+		HttpsBackend:           httpsBackend,
+		ExpiryWarningThreshold: w.ExpiryWarningThreshold,
+	}, nil
+}
+
+func (w WafConfig) RetryPolicy() adapter.RetryPolicy {
+	return adapter.RetryPolicy{
+		MaxAttempts: w.ApiMaxAttempts,
+		BaseDelay:   w.ApiRetryBaseDelay,
+		MaxDelay:    w.ApiRetryMaxDelay,
+		MaxElapsed:  w.ApiRetryBudget,
+	}
+}
+
+func (r ReconcilerConfig) validate() error {
+	if r.Workers < 1 {
+		return fmt.Errorf("invalid number of reconciler workers %d", r.Workers)
+	}
+	return nil
+}
+
+func (d DriftDetectionConfig) validate() error {
+	if d.Interval < 0 {
+		return fmt.Errorf("invalid drift detection interval %s", d.Interval)
+	}
+	return nil
+}
+
+func (g GarbageCollectionConfig) validate() error {
+	if g.Interval < 0 {
+		return fmt.Errorf("invalid certificate garbage collection interval %s", g.Interval)
+	}
+	if g.GracePeriod < 0 {
+		return fmt.Errorf("invalid certificate garbage collection grace period %s", g.GracePeriod)
+	}
+	if g.Retention < 0 {
+		return fmt.Errorf("invalid certificate garbage collection retention %d", g.Retention)
+	}
+	return nil
+}
+
+func (g GarbageCollectionConfig) CollectorConfig() service.GarbageCollectorConfig {
+	return service.GarbageCollectorConfig{
+		Interval:    g.Interval,
+		GracePeriod: g.GracePeriod,
+		Retention:   g.Retention,
+		DryRun:      g.DryRun,
+	}
+}
+
+// Redacted returns the configuration as yaml with the secrets replaced.
+func (c Config) Redacted() string {
+	redactedConfig := c
+	redact(reflect.ValueOf(&redactedConfig).Elem())
+	content, err := yaml.Marshal(redactedConfig)
+	if err != nil {
+		return err.Error()
+	}
+	return string(content)
+}
+
+func redact(value reflect.Value) {
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		if field.Kind() == reflect.Struct {
+			redact(field)
+			continue
+		}
+		switch value.Type().Field(i).Tag.Get("secret") {
+		case "true":
+			if field.Len() > 0 {
+				field.SetString(redacted)
+			}
+		case "userinfo":
+			field.SetString(withoutUserinfo(field.String()))
+		}
+	}
+}
+
+// withoutUserinfo strips the user and password of an url, e.g. of a proxy. An url that can't be parsed is redacted.
+func withoutUserinfo(rawUrl string) string {
+	if len(rawUrl) == 0 {
+		return rawUrl
+	}
+	parsedUrl, err := url.Parse(rawUrl)
+	if err != nil {
+		return redacted
+	}
+	parsedUrl.User = nil
+	return parsedUrl.String()
+}
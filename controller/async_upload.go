@@ -0,0 +1,60 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	v1 "k8s.io/api/admission/v1"
+	apiv1 "k8s.io/api/core/v1"
+	"log"
+	"reflect"
+	"waf-cert-uploader/service"
+)
+
+// canQueue tells whether the upload queue can fetch the secret. A secret created with generateName gets its name only
+// after the admission review, so it is uploaded during the review and isn't admitted if the upload fails.
+func canQueue(secret apiv1.Secret) bool {
+	if len(secret.Name) == 0 {
+		log.Println("the secret has no name yet, the certificate is uploaded during the admission review")
+		return false
+	}
+	return true
+}
+
+func (h *WebhookHandler) createQueuedResponseObject(
+	admissionReview v1.AdmissionReview,
+	secret apiv1.Secret) (*[]byte, bool, error) {
+	warnings, validationError := h.validateSecret(secret)
+	if validationError != nil {
+		log.Println("the admission review is rejected due to an error", validationError)
+		rejectResponse, err := createRejectAdmissionResponse(admissionReview, validationError)
+		return rejectResponse, false, err
+	}
+
+	patchBytes, err := createUploadStatusPatch(secret, service.UploadStatusPending)
+	if err != nil {
+		return nil, false, err
+	}
+	pendingResponse, err := createPatchedAdmissionResponse(admissionReview, *patchBytes, warnings)
+	return pendingResponse, true, err
+}
+
+// needsUpload ignores updates that only change the annotations written by the uploader itself,
+// otherwise writing back the certificate id or upload status would trigger the next upload.
+func needsUpload(admissionRequest v1.AdmissionRequest, secret apiv1.Secret) bool {
+	if len(admissionRequest.OldObject.Raw) == 0 {
+		return true
+	}
+	var oldSecret apiv1.Secret
+	err := json.Unmarshal(admissionRequest.OldObject.Raw, &oldSecret)
+	if err != nil {
+		log.Println("unmarshalling the old object of the admission review failed", err)
+		return true
+	}
+
+	if !bytes.Equal(oldSecret.Data[apiv1.TLSCertKey], secret.Data[apiv1.TLSCertKey]) ||
+		!bytes.Equal(oldSecret.Data[apiv1.TLSPrivateKeyKey], secret.Data[apiv1.TLSPrivateKeyKey]) {
+		return true
+	}
+	return !reflect.DeepEqual(
+		service.WithoutUploaderAnnotations(oldSecret.Annotations), service.WithoutUploaderAnnotations(secret.Annotations))
+}
@@ -0,0 +1,192 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	golangsdk "github.com/opentelekomcloud/gophertelekomcloud"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/admission/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"waf-cert-uploader/service"
+)
+
+func getSecret(annotations map[string]string) apiv1.Secret {
+	return apiv1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "my.domain.com", Annotations: annotations},
+		Data: map[string][]byte{
+			"tls.crt": []byte("any cert"),
+			"tls.key": []byte("any private key"),
+		},
+	}
+}
+
+func serveAdmissionReview(t *testing.T, webhookHandler *WebhookHandler, admissionReview []byte) v1.AdmissionReview {
+	request, err := http.NewRequest("PUT", "/upload-cert-to-waf", bytes.NewReader(admissionReview))
+	assert.Nil(t, err)
+	responseRecorder := httptest.NewRecorder()
+
+	http.HandlerFunc(webhookHandler.HandleUploadCertToWaf).ServeHTTP(responseRecorder, request)
+
+	var response v1.AdmissionReview
+	assert.Nil(t, json.Unmarshal(responseRecorder.Body.Bytes(), &response))
+	return response
+}
+
+func TestHandleUploadCertToWaf_async(t *testing.T) {
+	admissionReview, requestId := getAdmissionReview()
+	var queuedNamespace, queuedCertificateHash string
+	webhookHandler := &WebhookHandler{
+		createOrUpdateCertificate: func(secret apiv1.Secret) (*service.UploadResult, error) {
+			t.Fatal("the certificate must not be uploaded during the admission review")
+			return nil, nil
+		},
+		validateSecret: func(secret apiv1.Secret) ([]string, error) {
+			return []string{"expires soon"}, nil
+		},
+		options: WebhookOptions{
+			AsyncUpload: true,
+			QueueUpload: func(namespace string, name string, certificateHash string) {
+				queuedNamespace = namespace
+				queuedCertificateHash = certificateHash
+			},
+		},
+	}
+
+	response := serveAdmissionReview(t, webhookHandler, admissionReview)
+
+	assert.Equal(t, requestId, response.Response.UID)
+	assert.True(t, response.Response.Allowed)
+	assert.Equal(t, []string{"expires soon"}, response.Response.Warnings)
+	var patches []patchOperation
+	assert.Nil(t, json.Unmarshal(response.Response.Patch, &patches))
+	annotations := patches[0].Value.(map[string]interface{})
+	assert.Equal(t, service.UploadStatusPending, annotations[service.UploadStatusAnnotation])
+	assert.Equal(t, "waf", queuedNamespace)
+	assert.Equal(t, service.CertificateHash(apiv1.Secret{Data: map[string][]byte{"tls.crt": []byte("any cert")}}),
+		queuedCertificateHash)
+}
+
+func TestHandleUploadCertToWaf_asyncRejectsInvalidCertificate(t *testing.T) {
+	admissionReview, _ := getAdmissionReview()
+	queued := false
+	webhookHandler := &WebhookHandler{
+		validateSecret: func(secret apiv1.Secret) ([]string, error) {
+			return nil, &service.CertificateValidationError{Reason: service.ErrKeyMismatch}
+		},
+		options: WebhookOptions{
+			AsyncUpload: true,
+			QueueUpload: func(namespace string, name string, certificateHash string) {
+				queued = true
+			},
+		},
+	}
+
+	response := serveAdmissionReview(t, webhookHandler, admissionReview)
+
+	assert.False(t, response.Response.Allowed)
+	assert.Equal(t, int32(http.StatusUnprocessableEntity), response.Response.Result.Code)
+	assert.False(t, queued)
+}
+
+func TestHandleUploadCertToWaf_asyncUploadsSecretWithoutName(t *testing.T) {
+	secret := getSecret(map[string]string{"waf-cert-uploader.iits.tech/waf-domain-id": "45656165da65456"})
+	secret.Name = ""
+	secret.GenerateName = "my-"
+	admissionReview, _ := getAdmissionReviewForSecret(secret)
+	queued := false
+	webhookHandler := &WebhookHandler{
+		createOrUpdateCertificate: func(secret apiv1.Secret) (*service.UploadResult, error) {
+			return &service.UploadResult{CertIds: map[service.TargetName]string{service.TargetWaf: "12345"}}, nil
+		},
+		options: WebhookOptions{
+			AsyncUpload: true,
+			QueueUpload: func(namespace string, name string, certificateHash string) {
+				queued = true
+			},
+		},
+	}
+
+	response := serveAdmissionReview(t, webhookHandler, admissionReview)
+
+	assert.True(t, response.Response.Allowed)
+	var patches []patchOperation
+	assert.Nil(t, json.Unmarshal(response.Response.Patch, &patches))
+	annotations := patches[0].Value.(map[string]interface{})
+	assert.Equal(t, `{"waf":"12345"}`, annotations[service.CertIdsAnnotation])
+	assert.False(t, queued)
+}
+
+func TestHandleUploadCertToWaf_failOpenRejectsSecretWithoutName(t *testing.T) {
+	secret := getSecret(map[string]string{"waf-cert-uploader.iits.tech/waf-domain-id": "45656165da65456"})
+	secret.Name = ""
+	secret.GenerateName = "my-"
+	admissionReview, _ := getAdmissionReviewForSecret(secret)
+	retried := false
+	webhookHandler := &WebhookHandler{
+		createOrUpdateCertificate: func(secret apiv1.Secret) (*service.UploadResult, error) {
+			return nil, golangsdk.ErrDefault503{}
+		},
+		options: WebhookOptions{
+			FailOpenPolicy: service.FailOpenPolicy{service.ErrorClassWafUnavailable: true},
+			QueueUploadRetry: func(namespace string, name string, certificateHash string) {
+				retried = true
+			},
+		},
+	}
+
+	response := serveAdmissionReview(t, webhookHandler, admissionReview)
+
+	assert.False(t, response.Response.Allowed)
+	assert.Equal(t, int32(http.StatusServiceUnavailable), response.Response.Result.Code)
+	assert.False(t, retried)
+}
+
+func TestHandleUploadCertToWaf_onlyUploaderAnnotationsChanged(t *testing.T) {
+	oldSecret, _ := json.Marshal(getSecret(map[string]string{
+		"waf-cert-uploader.iits.tech/waf-domain-id": "45656165da65456",
+		service.UploadStatusAnnotation:              service.UploadStatusPending,
+	}))
+	secret, _ := json.Marshal(getSecret(map[string]string{
+		"waf-cert-uploader.iits.tech/waf-domain-id": "45656165da65456",
+		service.CertIdsAnnotation:                   `{"waf":"12345"}`,
+	}))
+	admissionReview, _ := json.Marshal(v1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{Kind: "UPDATE"},
+		Request: &v1.AdmissionRequest{
+			UID:       "4b3a0bd9-1898-4206-a999-a0947b82d921",
+			Namespace: "waf",
+			Object:    runtime.RawExtension{Raw: secret},
+			OldObject: runtime.RawExtension{Raw: oldSecret},
+		},
+	})
+	webhookHandler := &WebhookHandler{createOrUpdateCertificate: func(secret apiv1.Secret) (*service.UploadResult, error) {
+		t.Fatal("the certificate must not be uploaded again")
+		return nil, nil
+	}}
+
+	response := serveAdmissionReview(t, webhookHandler, admissionReview)
+
+	assert.True(t, response.Response.Allowed)
+	assert.Nil(t, response.Response.Patch)
+}
+
+func TestNeedsUpload(t *testing.T) {
+	annotations := map[string]string{"waf-cert-uploader.iits.tech/waf-domain-id": "45656165da65456"}
+	oldSecret, _ := json.Marshal(getSecret(annotations))
+	admissionRequest := v1.AdmissionRequest{OldObject: runtime.RawExtension{Raw: oldSecret}}
+
+	renewedSecret := getSecret(annotations)
+	renewedSecret.Data["tls.crt"] = []byte("renewed cert")
+	assert.True(t, needsUpload(admissionRequest, renewedSecret))
+
+	retargetedSecret := getSecret(map[string]string{"waf-cert-uploader.iits.tech/waf-domain-id": "other-domain"})
+	assert.True(t, needsUpload(admissionRequest, retargetedSecret))
+
+	assert.False(t, needsUpload(admissionRequest, getSecret(annotations)))
+	assert.True(t, needsUpload(v1.AdmissionRequest{}, getSecret(annotations)))
+}
@@ -12,6 +12,8 @@ import (
 	"k8s.io/apimachinery/pkg/runtime/serializer"
 	"log"
 	"net/http"
+	"time"
+	"waf-cert-uploader/metrics"
 	"waf-cert-uploader/service"
 )
 
@@ -21,12 +23,40 @@ type patchOperation struct {
 	Value interface{} `json:"value,omitempty"`
 }
 
-var createOrUpdateCertificate = func(secret apiv1.Secret) (*string, error) {
-	return service.CreateOrUpdateCertificate(secret)
+// WebhookOptions select the secrets whose upload is left to the upload queue instead of the admission review.
+type WebhookOptions struct {
+	// AsyncUpload only validates the secret during the admission review and leaves the upload to QueueUpload.
+	AsyncUpload bool
+	// QueueUpload is called for every admitted secret in the async mode with the hash of the admitted certificate.
+	QueueUpload func(namespace string, name string, certificateHash string)
+	// FailOpenPolicy selects the upload errors a secret is admitted despite, its upload is retried by QueueUploadRetry.
+	FailOpenPolicy service.FailOpenPolicy
+	// QueueUploadRetry is called for every secret that was admitted despite a failed upload.
+	QueueUploadRetry func(namespace string, name string, certificateHash string)
 }
 
-func HandleUploadCertToWaf(writer http.ResponseWriter, httpRequest *http.Request) {
+// WebhookHandler uploads the certificates of the reviewed secrets to the waf.
+type WebhookHandler struct {
+	createOrUpdateCertificate func(secret apiv1.Secret) (*service.UploadResult, error)
+	validateSecret            func(secret apiv1.Secret) ([]string, error)
+	options                   WebhookOptions
+}
+
+func NewWebhookHandler(certificateServices service.CertificateServices, options WebhookOptions) *WebhookHandler {
+	return &WebhookHandler{
+		createOrUpdateCertificate: certificateServices.CreateOrUpdateCertificate,
+		validateSecret:            certificateServices.ValidateSecret,
+		options:                   options,
+	}
+}
+
+func (h *WebhookHandler) HandleUploadCertToWaf(writer http.ResponseWriter, httpRequest *http.Request) {
 	log.Println("received admission review")
+	start := time.Now()
+	outcome := "bad_request"
+	defer func() {
+		metrics.ObserveAdmissionReview(outcome, time.Since(start))
+	}()
 
 	body, err := getRequestBody(httpRequest)
 	if err != nil {
@@ -46,14 +76,57 @@ func HandleUploadCertToWaf(writer http.ResponseWriter, httpRequest *http.Request
 		return
 	}
 
-	certId, wafServiceError := createOrUpdateCertificate(*secret)
+	if !needsUpload(*admissionReview.Request, *secret) {
+		log.Println("only the annotations of the uploader changed, the certificate is not uploaded")
+		responseBytes, err := marshal(createAdmissionReviewResponse(*admissionReview, true))
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		outcome = "unchanged"
+		writeResponseObjectToConnection(writer, *responseBytes)
+		return
+	}
+
+	if h.options.AsyncUpload && canQueue(*secret) {
+		responseBytes, queued, err := h.createQueuedResponseObject(*admissionReview, *secret)
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		outcome = "rejected"
+		if queued {
+			h.options.QueueUpload(admissionReview.Request.Namespace, secret.Name, service.CertificateHash(*secret))
+			outcome = "queued"
+		}
+		writeResponseObjectToConnection(writer, *responseBytes)
+		return
+	}
+
+	uploadResult, wafServiceError := h.createOrUpdateCertificate(*secret)
 
-	responseBytes, err := createResponseObject(wafServiceError, *admissionReview, *secret, certId)
+	if wafServiceError != nil && h.options.FailOpenPolicy.Allows(wafServiceError) && canQueue(*secret) {
+		responseBytes, err := createFailOpenResponseObject(wafServiceError, *admissionReview, *secret)
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		h.options.QueueUploadRetry(admissionReview.Request.Namespace, secret.Name, service.CertificateHash(*secret))
+		outcome = "failed_open"
+		writeResponseObjectToConnection(writer, *responseBytes)
+		return
+	}
+
+	responseBytes, err := createResponseObject(wafServiceError, *admissionReview, *secret, uploadResult)
 	if err != nil {
 		writer.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
+	outcome = "allowed"
+	if wafServiceError != nil {
+		outcome = "rejected"
+	}
 	writeResponseObjectToConnection(writer, *responseBytes)
 }
 
@@ -68,20 +141,20 @@ func createResponseObject(
 	wafServiceError error,
 	admissionReview v1.AdmissionReview,
 	secret apiv1.Secret,
-	certId *string) (*[]byte, error) {
+	uploadResult *service.UploadResult) (*[]byte, error) {
 	if wafServiceError != nil {
 		log.Println("the admission review is rejected due to an error", wafServiceError)
-		rejectResponse, err := createRejectAdmissionResponse(admissionReview)
+		rejectResponse, err := createRejectAdmissionResponse(admissionReview, wafServiceError)
 		if err != nil {
 			return nil, err
 		}
 		return rejectResponse, nil
 	} else {
-		patchBytes, err := createCertificateIdPatch(secret, *certId)
+		patchBytes, err := createCertificateIdPatch(secret, *uploadResult)
 		if err != nil {
 			return nil, err
 		}
-		patchedResponse, err := createPatchedAdmissionResponse(admissionReview, *patchBytes)
+		patchedResponse, err := createPatchedAdmissionResponse(admissionReview, *patchBytes, uploadResult.Warnings)
 		if err != nil {
 			return nil, err
 		}
@@ -89,6 +162,20 @@ func createResponseObject(
 	}
 }
 
+func createFailOpenResponseObject(
+	wafServiceError error,
+	admissionReview v1.AdmissionReview,
+	secret apiv1.Secret) (*[]byte, error) {
+	log.Println("the admission review is allowed despite an error, the upload is retried", wafServiceError)
+	patchBytes, err := createUploadStatusPatch(secret, service.UploadFailureStatus(wafServiceError))
+	if err != nil {
+		return nil, err
+	}
+	warning := fmt.Sprintf("the certificate couldn't be uploaded to the waf and is retried in the background: %v",
+		wafServiceError)
+	return createPatchedAdmissionResponse(admissionReview, *patchBytes, []string{warning})
+}
+
 func getRequestBody(httpRequest *http.Request) (*[]byte, error) {
 	body, err := io.ReadAll(httpRequest.Body)
 	if err != nil {
@@ -123,8 +210,12 @@ func deserializeToAdmissionReview(body []byte) (*v1.AdmissionReview, error) {
 	return &admissionReview, nil
 }
 
-func createPatchedAdmissionResponse(admissionReview v1.AdmissionReview, patchBytes []byte) (*[]byte, error) {
+func createPatchedAdmissionResponse(
+	admissionReview v1.AdmissionReview,
+	patchBytes []byte,
+	warnings []string) (*[]byte, error) {
 	admissionReviewResponse := createAdmissionReviewResponse(admissionReview, true)
+	admissionReviewResponse.Response.Warnings = warnings
 
 	applyPatchesToAdmissionResponse(admissionReviewResponse, patchBytes)
 
@@ -137,9 +228,11 @@ func createPatchedAdmissionResponse(admissionReview v1.AdmissionReview, patchByt
 	return bytes, nil
 }
 
-func createRejectAdmissionResponse(admissionReview v1.AdmissionReview) (*[]byte, error) {
+func createRejectAdmissionResponse(admissionReview v1.AdmissionReview, wafServiceError error) (*[]byte, error) {
 	admissionReviewResponse := createAdmissionReviewResponse(admissionReview, false)
 
+	admissionReviewResponse.Response.Result = createRejectStatus(wafServiceError)
+
 	bytes, err := marshal(admissionReviewResponse)
 	if err != nil {
 		return nil, err
@@ -148,6 +241,32 @@ func createRejectAdmissionResponse(admissionReview v1.AdmissionReview) (*[]byte,
 	return bytes, nil
 }
 
+type rejectStatus struct {
+	reason metav1.StatusReason
+	code   int32
+}
+
+var rejectStatusByErrorClass = map[service.ErrorClass]rejectStatus{
+	service.ErrorClassInvalidCertificate:   {metav1.StatusReasonInvalid, http.StatusUnprocessableEntity},
+	service.ErrorClassInvalidConfiguration: {metav1.StatusReasonBadRequest, http.StatusBadRequest},
+	service.ErrorClassDomainNotFound:       {metav1.StatusReasonNotFound, http.StatusNotFound},
+	service.ErrorClassAuthFailure:          {metav1.StatusReasonForbidden, http.StatusForbidden},
+	service.ErrorClassQuotaExceeded:        {metav1.StatusReasonForbidden, http.StatusForbidden},
+	service.ErrorClassThrottled:            {metav1.StatusReasonTooManyRequests, http.StatusTooManyRequests},
+	service.ErrorClassWafUnavailable:       {metav1.StatusReasonServiceUnavailable, http.StatusServiceUnavailable},
+	service.ErrorClassInternal:             {metav1.StatusReasonInternalError, http.StatusInternalServerError},
+}
+
+func createRejectStatus(wafServiceError error) *metav1.Status {
+	status := rejectStatusByErrorClass[service.ClassifyError(wafServiceError)]
+	return &metav1.Status{
+		Status:  metav1.StatusFailure,
+		Message: wafServiceError.Error(),
+		Reason:  status.reason,
+		Code:    status.code,
+	}
+}
+
 func createAdmissionReviewResponse(admissionReview v1.AdmissionReview, allowed bool) v1.AdmissionReview {
 	return v1.AdmissionReview{
 		TypeMeta: metav1.TypeMeta{
@@ -167,11 +286,20 @@ func applyPatchesToAdmissionResponse(admissionReviewResponse v1.AdmissionReview,
 	admissionReviewResponse.Response.PatchType = &patchType
 }
 
-func createCertificateIdPatch(secret apiv1.Secret, id string) (*[]byte, error) {
+func createCertificateIdPatch(secret apiv1.Secret, uploadResult service.UploadResult) (*[]byte, error) {
 	var patches []patchOperation
 
-	annotations := secret.ObjectMeta.Annotations
-	annotations["waf-cert-uploader.iits.tech/cert-waf-id"] = id
+	certIds, err := service.FormatCertIds(uploadResult.CertIds)
+	if err != nil {
+		log.Println("formatting the certificate ids failed", err)
+		return nil, err
+	}
+
+	annotations := copyAnnotations(secret)
+	annotations[service.CertIdsAnnotation] = certIds
+	delete(annotations, service.CertWafIdAnnotation)
+	delete(annotations, service.CertElbIdAnnotation)
+	delete(annotations, service.UploadStatusAnnotation)
 
 	patches = append(patches, patchOperation{
 		Op:    "add",
@@ -187,6 +315,27 @@ func createCertificateIdPatch(secret apiv1.Secret, id string) (*[]byte, error) {
 	return patchBytes, nil
 }
 
+func createUploadStatusPatch(secret apiv1.Secret, status string) (*[]byte, error) {
+	annotations := copyAnnotations(secret)
+	annotations[service.UploadStatusAnnotation] = status
+
+	return marshal([]patchOperation{{
+		Op:    "add",
+		Path:  "/metadata/annotations",
+		Value: annotations,
+	}})
+}
+
+// copyAnnotations returns the annotations of the secret to patch, a secret without annotations defaults to the waf
+// target and gets an empty map.
+func copyAnnotations(secret apiv1.Secret) map[string]string {
+	annotations := map[string]string{}
+	for key, value := range secret.ObjectMeta.Annotations {
+		annotations[key] = value
+	}
+	return annotations
+}
+
 func marshal(any interface{}) (*[]byte, error) {
 	bytes, err := json.Marshal(&any)
 	if err != nil {
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	golangsdk "github.com/opentelekomcloud/gophertelekomcloud"
 	"github.com/stretchr/testify/assert"
 	v1 "k8s.io/api/admission/v1"
 	apiv1 "k8s.io/api/core/v1"
@@ -15,68 +16,239 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"waf-cert-uploader/service"
 )
 
 func TestHandleUploadCertToWaf(t *testing.T) {
 	admissionReview, requestId := getAdmissionReview()
-	createOrUpdateCertificate = func(secret apiv1.Secret) (*string, error) {
-		certId := "12345"
-		return &certId, nil
-	}
+	webhookHandler := &WebhookHandler{createOrUpdateCertificate: func(secret apiv1.Secret) (*service.UploadResult, error) {
+		return &service.UploadResult{CertIds: map[service.TargetName]string{service.TargetWaf: "12345"}}, nil
+	}}
 
 	request, err := http.NewRequest("PUT", "/upload-cert-to-waf", bytes.NewReader(admissionReview))
 
 	assert.Nil(t, err)
 
 	responseRecorder := httptest.NewRecorder()
-	handler := http.HandlerFunc(HandleUploadCertToWaf)
+	handler := http.HandlerFunc(webhookHandler.HandleUploadCertToWaf)
 
 	handler.ServeHTTP(responseRecorder, request)
 
 	assert.Equal(t, http.StatusOK, responseRecorder.Code)
 
 	expectedBody := fmt.Sprintf(`{"kind":"UPDATE",`+
-		`"response":{"uid":"%s","allowed":true,"patch":"W3sib3AiOiJhZGQiLCJwYXRoIjoiL21ldGFkYXRhL2Fubm90YXRp`+
-		`b25zIiwidmFsdWUiOnsid2FmLWNlcnQtdXBsb2FkZXIuaWl0cy50ZWNoL2NlcnQtd2FmLWlkIjoiMTIzNDUiLCJ3YWYtY2VydC11`+
-		`cGxvYWRlci5paXRzLnRlY2gvd2FmLWRvbWFpbi1pZCI6IjQ1NjU2MTY1ZGE2NTQ1NiJ9fV0=",`+
+		`"response":{"uid":"%s","allowed":true,"patch":"W3sib3AiOiJhZGQiLCJwYXRoIjoiL21ldGFkYXRhL2Fubm90YXRpb25zIiwidmFsdWUiOnsid2FmLWNlcnQtdXBsb2FkZXIuaWl0`+
+		`cy50ZWNoL2NlcnQtaWRzIjoie1wid2FmXCI6XCIxMjM0NVwifSIsIndhZi1jZXJ0LXVwbG9hZGVyLmlpdHMudGVjaC93YWYtZG9t`+
+		`YWluLWlkIjoiNDU2NTYxNjVkYTY1NDU2In19XQ==",`+
 		`"patchType":"JSONPatch"}}`, requestId)
 	assert.Equal(t, expectedBody, responseRecorder.Body.String())
 }
 
+func TestHandleUploadCertToWaf_withWarnings(t *testing.T) {
+	admissionReview, requestId := getAdmissionReview()
+	webhookHandler := &WebhookHandler{createOrUpdateCertificate: func(secret apiv1.Secret) (*service.UploadResult, error) {
+		return &service.UploadResult{CertIds: map[service.TargetName]string{service.TargetWaf: "12345"}, Warnings: []string{"hostname mismatch"}}, nil
+	}}
+
+	request, err := http.NewRequest("PUT", "/upload-cert-to-waf", bytes.NewReader(admissionReview))
+
+	assert.Nil(t, err)
+
+	responseRecorder := httptest.NewRecorder()
+	handler := http.HandlerFunc(webhookHandler.HandleUploadCertToWaf)
+
+	handler.ServeHTTP(responseRecorder, request)
+
+	var response v1.AdmissionReview
+	assert.Nil(t, json.Unmarshal(responseRecorder.Body.Bytes(), &response))
+	assert.Equal(t, requestId, response.Response.UID)
+	assert.True(t, response.Response.Allowed)
+	assert.Equal(t, []string{"hostname mismatch"}, response.Response.Warnings)
+}
+
 func TestHandleUploadCertToWaf_rejectDueToAnError(t *testing.T) {
 	admissionReview, requestId := getAdmissionReview()
-	createOrUpdateCertificate = func(secret apiv1.Secret) (*string, error) {
+	webhookHandler := &WebhookHandler{createOrUpdateCertificate: func(secret apiv1.Secret) (*service.UploadResult, error) {
 		return nil, errors.New("any error")
-	}
+	}}
 
 	request, err := http.NewRequest("PUT", "/upload-cert-to-waf", bytes.NewReader(admissionReview))
 
 	assert.Nil(t, err)
 
 	responseRecorder := httptest.NewRecorder()
-	handler := http.HandlerFunc(HandleUploadCertToWaf)
+	handler := http.HandlerFunc(webhookHandler.HandleUploadCertToWaf)
 
 	handler.ServeHTTP(responseRecorder, request)
 
 	assert.Equal(t, http.StatusOK, responseRecorder.Code)
 
-	expectedBody := fmt.Sprintf(`{"kind":"UPDATE","response":{"uid":"%s","allowed":false}}`, requestId)
+	expectedBody := fmt.Sprintf(`{"kind":"UPDATE","response":{"uid":"%s","allowed":false,`+
+		`"status":{"metadata":{},"status":"Failure","message":"any error","reason":"InternalError","code":500}}}`, requestId)
 	assert.Equal(t, expectedBody, responseRecorder.Body.String())
 }
 
+func TestHandleUploadCertToWaf_rejectInvalidCertificate(t *testing.T) {
+	admissionReview, requestId := getAdmissionReview()
+	webhookHandler := &WebhookHandler{createOrUpdateCertificate: func(secret apiv1.Secret) (*service.UploadResult, error) {
+		return nil, &service.CertificateValidationError{Reason: service.ErrKeyMismatch}
+	}}
+
+	request, err := http.NewRequest("PUT", "/upload-cert-to-waf", bytes.NewReader(admissionReview))
+
+	assert.Nil(t, err)
+
+	responseRecorder := httptest.NewRecorder()
+	handler := http.HandlerFunc(webhookHandler.HandleUploadCertToWaf)
+
+	handler.ServeHTTP(responseRecorder, request)
+
+	assert.Equal(t, http.StatusOK, responseRecorder.Code)
+
+	expectedBody := fmt.Sprintf(`{"kind":"UPDATE","response":{"uid":"%s","allowed":false,`+
+		`"status":{"metadata":{},"status":"Failure",`+
+		`"message":"invalid certificate: private key does not match the certificate",`+
+		`"reason":"Invalid","code":422}}}`, requestId)
+	assert.Equal(t, expectedBody, responseRecorder.Body.String())
+}
+
+func TestHandleUploadCertToWaf_failOpen(t *testing.T) {
+	admissionReview, requestId := getAdmissionReview()
+	var retriedNamespace string
+	webhookHandler := &WebhookHandler{
+		createOrUpdateCertificate: func(secret apiv1.Secret) (*service.UploadResult, error) {
+			return nil, golangsdk.ErrDefault503{}
+		},
+		options: WebhookOptions{
+			FailOpenPolicy: service.FailOpenPolicy{service.ErrorClassWafUnavailable: true},
+			QueueUploadRetry: func(namespace string, name string, certificateHash string) {
+				retriedNamespace = namespace
+			},
+		},
+	}
+
+	request, err := http.NewRequest("PUT", "/upload-cert-to-waf", bytes.NewReader(admissionReview))
+	assert.Nil(t, err)
+	responseRecorder := httptest.NewRecorder()
+
+	http.HandlerFunc(webhookHandler.HandleUploadCertToWaf).ServeHTTP(responseRecorder, request)
+
+	var response v1.AdmissionReview
+	assert.Nil(t, json.Unmarshal(responseRecorder.Body.Bytes(), &response))
+	assert.Equal(t, requestId, response.Response.UID)
+	assert.True(t, response.Response.Allowed)
+	assert.Nil(t, response.Response.Result)
+	assert.Len(t, response.Response.Warnings, 1)
+	var patches []patchOperation
+	assert.Nil(t, json.Unmarshal(response.Response.Patch, &patches))
+	annotations := patches[0].Value.(map[string]interface{})
+	assert.Contains(t, annotations[service.UploadStatusAnnotation], "failed (waf_unavailable)")
+	assert.NotContains(t, annotations, service.CertIdsAnnotation)
+	assert.Equal(t, "waf", retriedNamespace)
+}
+
+func TestHandleUploadCertToWaf_failOpenWithoutAnnotations(t *testing.T) {
+	admissionReview, _ := getAdmissionReviewWithAnnotations(nil)
+	webhookHandler := &WebhookHandler{
+		createOrUpdateCertificate: func(secret apiv1.Secret) (*service.UploadResult, error) {
+			return nil, golangsdk.ErrDefault503{}
+		},
+		options: WebhookOptions{
+			FailOpenPolicy:   service.FailOpenPolicy{service.ErrorClassWafUnavailable: true},
+			QueueUploadRetry: func(namespace string, name string, certificateHash string) {},
+		},
+	}
+
+	request, err := http.NewRequest("PUT", "/upload-cert-to-waf", bytes.NewReader(admissionReview))
+	assert.Nil(t, err)
+	responseRecorder := httptest.NewRecorder()
+
+	http.HandlerFunc(webhookHandler.HandleUploadCertToWaf).ServeHTTP(responseRecorder, request)
+
+	var response v1.AdmissionReview
+	assert.Nil(t, json.Unmarshal(responseRecorder.Body.Bytes(), &response))
+	assert.True(t, response.Response.Allowed)
+	var patches []patchOperation
+	assert.Nil(t, json.Unmarshal(response.Response.Patch, &patches))
+	annotations := patches[0].Value.(map[string]interface{})
+	assert.Contains(t, annotations[service.UploadStatusAnnotation], "failed (waf_unavailable)")
+}
+
+func TestCreateCertificateIdPatch_withoutAnnotations(t *testing.T) {
+	patchBytes, err := createCertificateIdPatch(getSecret(nil), service.UploadResult{CertIds: map[service.TargetName]string{
+		service.TargetWaf: "waf-id",
+	}})
+
+	assert.Nil(t, err)
+	var patches []patchOperation
+	assert.Nil(t, json.Unmarshal(*patchBytes, &patches))
+	assert.Equal(t, map[string]interface{}{service.CertIdsAnnotation: `{"waf":"waf-id"}`}, patches[0].Value)
+}
+
+func TestHandleUploadCertToWaf_failOpenRejectsOtherErrorClasses(t *testing.T) {
+	admissionReview, _ := getAdmissionReview()
+	failOpenPolicy, _ := service.ParseFailOpenPolicy("all")
+	webhookHandler := &WebhookHandler{
+		createOrUpdateCertificate: func(secret apiv1.Secret) (*service.UploadResult, error) {
+			return nil, &service.CertificateValidationError{Reason: service.ErrKeyMismatch}
+		},
+		options: WebhookOptions{FailOpenPolicy: failOpenPolicy},
+	}
+
+	request, err := http.NewRequest("PUT", "/upload-cert-to-waf", bytes.NewReader(admissionReview))
+	assert.Nil(t, err)
+	responseRecorder := httptest.NewRecorder()
+
+	http.HandlerFunc(webhookHandler.HandleUploadCertToWaf).ServeHTTP(responseRecorder, request)
+
+	var response v1.AdmissionReview
+	assert.Nil(t, json.Unmarshal(responseRecorder.Body.Bytes(), &response))
+	assert.False(t, response.Response.Allowed)
+}
+
+func TestCreateRejectStatus(t *testing.T) {
+	status := createRejectStatus(fmt.Errorf("updating waf domain failed: %w", golangsdk.ErrDefault429{}))
+
+	assert.Equal(t, metav1.StatusFailure, status.Status)
+	assert.Equal(t, metav1.StatusReasonTooManyRequests, status.Reason)
+	assert.Equal(t, int32(http.StatusTooManyRequests), status.Code)
+	assert.Contains(t, status.Message, "updating waf domain failed")
+}
+
+func TestCreateCertificateIdPatch_replacesLegacyAnnotations(t *testing.T) {
+	secret := getSecret(map[string]string{
+		"waf-cert-uploader.iits.tech/waf-domain-id": "45656165da65456",
+		service.CertWafIdAnnotation:                 "previous-waf-id",
+		service.CertElbIdAnnotation:                 "previous-elb-id",
+	})
+
+	patchBytes, err := createCertificateIdPatch(secret, service.UploadResult{CertIds: map[service.TargetName]string{
+		service.TargetWaf: "waf-id",
+		service.TargetElb: "elb-id",
+	}})
+
+	assert.Nil(t, err)
+	var patches []patchOperation
+	assert.Nil(t, json.Unmarshal(*patchBytes, &patches))
+	assert.Equal(t, map[string]interface{}{
+		"waf-cert-uploader.iits.tech/waf-domain-id": "45656165da65456",
+		service.CertIdsAnnotation:                   `{"elb":"elb-id","waf":"waf-id"}`,
+	}, patches[0].Value)
+}
+
 func TestHandleUploadCertToWaf_invalidBody(t *testing.T) {
 	admissionReview := getInvalidAdmissionReview()
 
-	createOrUpdateCertificate = func(secret apiv1.Secret) (*string, error) {
+	webhookHandler := &WebhookHandler{createOrUpdateCertificate: func(secret apiv1.Secret) (*service.UploadResult, error) {
 		return nil, nil
-	}
+	}}
 
 	request, err := http.NewRequest("PUT", "/upload-cert-to-waf", bytes.NewReader(admissionReview))
 
 	assert.Nil(t, err)
 
 	responseRecorder := httptest.NewRecorder()
-	handler := http.HandlerFunc(HandleUploadCertToWaf)
+	handler := http.HandlerFunc(webhookHandler.HandleUploadCertToWaf)
 
 	handler.ServeHTTP(responseRecorder, request)
 
@@ -96,24 +268,33 @@ func getInvalidAdmissionReview() []byte {
 }
 
 func getAdmissionReview() ([]byte, types.UID) {
-	secret := apiv1.Secret{
+	return getAdmissionReviewWithAnnotations(map[string]string{
+		"waf-cert-uploader.iits.tech/waf-domain-id": "45656165da65456",
+	})
+}
+
+func getAdmissionReviewWithAnnotations(annotations map[string]string) ([]byte, types.UID) {
+	return getAdmissionReviewForSecret(apiv1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
+			Name:            "my.domain.com",
 			ResourceVersion: "version1",
-			Annotations: map[string]string{
-				"waf-cert-uploader.iits.tech/waf-domain-id": "45656165da65456",
-			},
+			Annotations:     annotations,
 		},
 		Data: map[string][]byte{
 			"tls.crt": []byte("any cert"),
 			"tls.key": []byte("any private key"),
 		},
-	}
+	})
+}
+
+func getAdmissionReviewForSecret(secret apiv1.Secret) ([]byte, types.UID) {
 	requestId := uuid.NewUUID()
 	secretMarshalled, _ := json.Marshal(secret)
 	admissionRequest := v1.AdmissionRequest{
-		UID:    requestId,
-		Kind:   metav1.GroupVersionKind{Kind: "UPDATE"},
-		Object: runtime.RawExtension{Raw: secretMarshalled},
+		UID:       requestId,
+		Kind:      metav1.GroupVersionKind{Kind: "UPDATE"},
+		Namespace: "waf",
+		Object:    runtime.RawExtension{Raw: secretMarshalled},
 	}
 	admissionReview := v1.AdmissionReview{
 		TypeMeta: metav1.TypeMeta{
@@ -0,0 +1,189 @@
+package controller
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/admission/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+	"waf-cert-uploader/adapter"
+	"waf-cert-uploader/adapter/otctest"
+	"waf-cert-uploader/service"
+)
+
+func createTestCertificatePem(hostname string) ([]byte, []byte) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: hostname},
+		DNSNames:     []string{hostname},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+// newE2eWebhookHandler returns a webhook handler that uploads to the fake wafs through the sdk.
+func newE2eWebhookHandler(t *testing.T) (*WebhookHandler, *otctest.OtcServer) {
+	server := otctest.NewServer()
+	t.Cleanup(server.Close)
+	server.AddDomain(otctest.Domain{Id: "45656165da65456", HostName: "my.domain.com",
+		Server: []otctest.Server{{ClientProtocol: "HTTP", ServerProtocol: "HTTP", Address: "10.0.0.1", Port: 80}}})
+	server.AddHost(otctest.Host{Id: "7a8b9c0d1e2f", HostName: "my.domain.com",
+		Server: []otctest.HostServer{{FrontProtocol: "HTTPS", BackProtocol: "HTTP", Address: "10.0.0.1", Port: 80}}})
+	server.AddListener(otctest.Listener{Id: "0c4a8a3e-listener", Protocol: "HTTPS"})
+
+	provider, err := server.NewProviderClient()
+	assert.Nil(t, err)
+	adapter.ConfigureProviderClient(provider)
+	retryPolicy := adapter.RetryPolicy{MaxAttempts: 1, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	certificateServices, err := service.NewCertificateServicesForProvider(
+		provider, otctest.Region, retryPolicy, service.DefaultOptions())
+	assert.Nil(t, err)
+	return NewWebhookHandler(certificateServices, WebhookOptions{}), server
+}
+
+func getE2eAdmissionReview(t *testing.T) []byte {
+	return getE2eAdmissionReviewWithAnnotations(t, map[string]string{
+		"waf-cert-uploader.iits.tech/waf-domain-id": "45656165da65456",
+	})
+}
+
+func getE2eAdmissionReviewWithAnnotations(t *testing.T, annotations map[string]string) []byte {
+	certPem, keyPem := createTestCertificatePem("my.domain.com")
+	secret, _ := json.Marshal(apiv1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "my.domain.com",
+			Annotations: annotations,
+		},
+		Data: map[string][]byte{"tls.crt": certPem, "tls.key": keyPem},
+	})
+	admissionReview, err := json.Marshal(v1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{Kind: "CREATE"},
+		Request: &v1.AdmissionRequest{
+			UID:       "4b3a0bd9-1898-4206-a999-a0947b82d921",
+			Namespace: "waf",
+			Object:    runtime.RawExtension{Raw: secret},
+		},
+	})
+	assert.Nil(t, err)
+	return admissionReview
+}
+
+func TestHandleUploadCertToWaf_e2e(t *testing.T) {
+	webhookHandler, server := newE2eWebhookHandler(t)
+
+	response := serveAdmissionReview(t, webhookHandler, getE2eAdmissionReview(t))
+
+	assert.True(t, response.Response.Allowed)
+	var patches []patchOperation
+	assert.Nil(t, json.Unmarshal(response.Response.Patch, &patches))
+	annotations := patches[0].Value.(map[string]interface{})
+	assert.Equal(t, `{"waf":"certificate-1"}`, annotations[service.CertIdsAnnotation])
+
+	domain, _ := server.Domain("45656165da65456")
+	assert.Equal(t, "certificate-1", domain.CertificateId)
+	assert.Contains(t, domain.Server,
+		otctest.Server{ClientProtocol: "HTTPS", ServerProtocol: "HTTPS", Address: "10.0.0.1", Port: 443})
+	assert.Len(t, server.Certificates(), 1)
+}
+
+func TestHandleUploadCertToWaf_e2eRollsBackOnWafFailure(t *testing.T) {
+	webhookHandler, server := newE2eWebhookHandler(t)
+	server.FailNext("update_domain", http.StatusInternalServerError)
+
+	response := serveAdmissionReview(t, webhookHandler, getE2eAdmissionReview(t))
+
+	assert.False(t, response.Response.Allowed)
+	assert.Equal(t, int32(http.StatusServiceUnavailable), response.Response.Result.Code)
+	assert.Empty(t, server.Certificates())
+	domain, _ := server.Domain("45656165da65456")
+	assert.Empty(t, domain.CertificateId)
+}
+
+func TestHandleUploadCertToWaf_e2eDedicatedWaf(t *testing.T) {
+	webhookHandler, server := newE2eWebhookHandler(t)
+
+	response := serveAdmissionReview(t, webhookHandler, getE2eAdmissionReviewWithAnnotations(t, map[string]string{
+		"waf-cert-uploader.iits.tech/waf-domain-id": "7a8b9c0d1e2f",
+		"waf-cert-uploader.iits.tech/waf-type":      "dedicated",
+	}))
+
+	assert.True(t, response.Response.Allowed)
+	var patches []patchOperation
+	assert.Nil(t, json.Unmarshal(response.Response.Patch, &patches))
+	annotations := patches[0].Value.(map[string]interface{})
+	assert.Equal(t, `{"waf":"certificate-1"}`, annotations[service.CertIdsAnnotation])
+
+	host, _ := server.Host("7a8b9c0d1e2f")
+	assert.Equal(t, "certificate-1", host.CertificateId)
+	assert.Len(t, server.DedicatedCertificates(), 1)
+	assert.Empty(t, server.Certificates())
+}
+
+func TestHandleUploadCertToWaf_e2eUnknownWafType(t *testing.T) {
+	webhookHandler, server := newE2eWebhookHandler(t)
+
+	response := serveAdmissionReview(t, webhookHandler, getE2eAdmissionReviewWithAnnotations(t, map[string]string{
+		"waf-cert-uploader.iits.tech/waf-domain-id": "45656165da65456",
+		"waf-cert-uploader.iits.tech/waf-type":      "premium",
+	}))
+
+	assert.False(t, response.Response.Allowed)
+	assert.Equal(t, int32(http.StatusBadRequest), response.Response.Result.Code)
+	assert.Empty(t, server.Certificates())
+	assert.Empty(t, server.DedicatedCertificates())
+}
+
+func TestHandleUploadCertToWaf_e2eElbListener(t *testing.T) {
+	webhookHandler, server := newE2eWebhookHandler(t)
+
+	response := serveAdmissionReview(t, webhookHandler, getE2eAdmissionReviewWithAnnotations(t, map[string]string{
+		"waf-cert-uploader.iits.tech/elb-listener-id": "0c4a8a3e-listener",
+	}))
+
+	assert.True(t, response.Response.Allowed)
+	var patches []patchOperation
+	assert.Nil(t, json.Unmarshal(response.Response.Patch, &patches))
+	annotations := patches[0].Value.(map[string]interface{})
+	assert.Equal(t, `{"elb":"elb-certificate-1"}`, annotations[service.CertIdsAnnotation])
+
+	listener, _ := server.Listener("0c4a8a3e-listener")
+	assert.Equal(t, "elb-certificate-1", listener.DefaultTlsContainerRef)
+	assert.Len(t, server.ElbCertificates(), 1)
+	assert.Empty(t, server.Certificates())
+}
+
+func TestHandleUploadCertToWaf_e2eWafAndElbListener(t *testing.T) {
+	webhookHandler, server := newE2eWebhookHandler(t)
+
+	response := serveAdmissionReview(t, webhookHandler, getE2eAdmissionReviewWithAnnotations(t, map[string]string{
+		"waf-cert-uploader.iits.tech/waf-domain-id":           "45656165da65456",
+		"waf-cert-uploader.iits.tech/elb-listener-id":         "0c4a8a3e-listener",
+		"waf-cert-uploader.iits.tech/elb-certificate-binding": "sni",
+	}))
+
+	assert.True(t, response.Response.Allowed)
+	var patches []patchOperation
+	assert.Nil(t, json.Unmarshal(response.Response.Patch, &patches))
+	annotations := patches[0].Value.(map[string]interface{})
+	assert.Equal(t, `{"elb":"elb-certificate-2","waf":"certificate-1"}`, annotations[service.CertIdsAnnotation])
+
+	listener, _ := server.Listener("0c4a8a3e-listener")
+	assert.Empty(t, listener.DefaultTlsContainerRef)
+	assert.Equal(t, []string{"elb-certificate-2"}, listener.SniContainerRefs)
+}
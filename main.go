@@ -1,78 +1,161 @@
 package main
 
 import (
-	"errors"
-	"flag"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 	"log"
 	"net/http"
 	"os"
+	"waf-cert-uploader/config"
 	"waf-cert-uploader/controller"
+	"waf-cert-uploader/reconciler"
 	"waf-cert-uploader/service"
 )
 
-type ServerParameters struct {
-	certFile string // path to the x509 certificate for https
-	keyFile  string // path to the x509 private key matching `CertFile`
-}
-
-var parameters ServerParameters
-
 func main() {
-	err := flagWebhookParameters()
+	uploaderConfig, err := config.Load(os.Args[1:])
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if uploaderConfig.PrintConfig {
+		fmt.Print(uploaderConfig.Redacted())
+		return
+	}
+	err = uploaderConfig.Validate()
+	if err != nil {
+		log.Println("invalid configuration", err)
+		return
+	}
+	log.Printf("effective configuration:\n%s", uploaderConfig.Redacted())
+
+	serviceOptions, err := uploaderConfig.Waf.Options()
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
-	err = service.SetupOtcClient()
+	certificateServices, credentialsWatcher, err := service.NewOtcCertificateServices(
+		uploaderConfig.Otc.OtcOptions(), uploaderConfig.Waf.RetryPolicy(), serviceOptions)
 	if err != nil {
 		log.Println("otc client setup failed", err)
 		return
 	}
+	go credentialsWatcher.Run(uploaderConfig.Otc.CredentialsReloadInterval, make(chan struct{}))
+
+	if uploaderConfig.GarbageCollection.Interval > 0 {
+		certificateServices.StartCertificateGarbageCollector(
+			uploaderConfig.GarbageCollection.CollectorConfig(), make(chan struct{}))
+	}
+
+	err = startDriftDetector(certificateServices, uploaderConfig)
+	if err != nil {
+		log.Println("drift detection setup failed", err)
+		return
+	}
+
+	if uploaderConfig.Mode == config.ReconcilerMode {
+		err = startReconciler(certificateServices, uploaderConfig)
+		if err != nil {
+			log.Println("reconciler setup failed", err)
+			return
+		}
+		http.HandleFunc("/health", controller.HandleHealth)
+		http.Handle("/metrics", promhttp.Handler())
+		setupHealthServer(uploaderConfig.Port)
+		return
+	}
 
-	registerHttpControllers()
-	setupHttpServers()
+	webhookOptions, err := startUploadQueue(certificateServices, uploaderConfig.Webhook)
+	if err != nil {
+		log.Println("upload queue setup failed", err)
+		return
+	}
+
+	registerHttpControllers(controller.NewWebhookHandler(certificateServices, webhookOptions))
+	setupHttpServers(uploaderConfig.Port, uploaderConfig.Webhook)
 }
 
-func registerHttpControllers() {
-	http.HandleFunc("/health", controller.HandleHealth)
-	http.HandleFunc("/upload-cert-to-waf", controller.HandleUploadCertToWaf)
+func startReconciler(certificateServices service.CertificateServices, uploaderConfig config.Config) error {
+	client, err := newKubernetesClient()
+	if err != nil {
+		return err
+	}
+
+	secretReconciler := reconciler.NewReconciler(client, certificateServices, uploaderConfig.WatchNamespace)
+	go secretReconciler.Run(uploaderConfig.Reconciler.Workers, make(chan struct{}))
+	return nil
 }
 
-func setupHttpServers() {
-	httpsPort, err := lookupPort()
+func startDriftDetector(certificateServices service.CertificateServices, uploaderConfig config.Config) error {
+	if uploaderConfig.DriftDetection.Interval == 0 {
+		return nil
+	}
+
+	client, err := newKubernetesClient()
 	if err != nil {
-		return
+		return err
 	}
-	err = http.ListenAndServeTLS(":"+*httpsPort, parameters.certFile, parameters.keyFile, nil)
+	driftDetector := reconciler.NewDriftDetector(
+		client, certificateServices, uploaderConfig.WatchNamespace, uploaderConfig.DriftDetection.Repair)
+	go driftDetector.Run(uploaderConfig.DriftDetection.Interval, make(chan struct{}))
+	return nil
+}
+
+// startUploadQueue starts the workers of the async mode and of the retries after failing open. The returned
+// webhook options queue the uploads of the webhook handler.
+func startUploadQueue(
+	certificateServices service.CertificateServices,
+	webhookConfig config.WebhookConfig) (controller.WebhookOptions, error) {
+	failOpenPolicy, err := service.ParseFailOpenPolicy(webhookConfig.FailOpenPolicy)
 	if err != nil {
-		log.Println("https server failed: ", err)
+		return controller.WebhookOptions{}, err
+	}
+	webhookOptions := controller.WebhookOptions{
+		AsyncUpload:    webhookConfig.UploadMode == "async",
+		FailOpenPolicy: failOpenPolicy,
 	}
+	if !webhookOptions.AsyncUpload && len(webhookOptions.FailOpenPolicy) == 0 {
+		return webhookOptions, nil
+	}
+
+	client, err := newKubernetesClient()
+	if err != nil {
+		return controller.WebhookOptions{}, err
+	}
+	uploadQueue := reconciler.NewUploadQueue(client, certificateServices)
+	go uploadQueue.Run(webhookConfig.UploadWorkers, make(chan struct{}))
+	webhookOptions.QueueUpload = uploadQueue.Add
+	webhookOptions.QueueUploadRetry = uploadQueue.AddRetry
+	return webhookOptions, nil
 }
 
-func lookupPort() (*string, error) {
-	httpsPort, httpsFound := os.LookupEnv("PORT")
-	if !httpsFound {
-		return nil, errors.New("environment variable for https port is not set")
+func newKubernetesClient() (kubernetes.Interface, error) {
+	restConfig, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
 	}
-	return &httpsPort, nil
+	return kubernetes.NewForConfig(restConfig)
 }
 
-func flagWebhookParameters() error {
-	certMountPath, foundMountPath := os.LookupEnv("CERT_MOUNT_PATH")
-	if !foundMountPath {
-		return errors.New("mount path environment variable was not set")
-	}
-	flag.StringVar(
-		&parameters.certFile,
-		"tlsCertFile",
-		certMountPath+"tls.crt",
-		"File containing the x509 Certificate for HTTPS.")
-	flag.StringVar(
-		&parameters.keyFile,
-		"tlsKeyFile",
-		certMountPath+"tls.key",
-		"File containing the x509 private key to --tlsCertFile.")
-	flag.Parse()
-	return nil
+func setupHealthServer(httpPort string) {
+	err := http.ListenAndServe(":"+httpPort, nil)
+	if err != nil {
+		log.Println("http server failed: ", err)
+	}
+}
+
+func registerHttpControllers(webhookHandler *controller.WebhookHandler) {
+	http.HandleFunc("/health", controller.HandleHealth)
+	http.HandleFunc("/upload-cert-to-waf", webhookHandler.HandleUploadCertToWaf)
+	http.Handle("/metrics", promhttp.Handler())
+}
+
+func setupHttpServers(httpsPort string, webhookConfig config.WebhookConfig) {
+	err := http.ListenAndServeTLS(":"+httpsPort, webhookConfig.TlsCertFile, webhookConfig.TlsKeyFile, nil)
+	if err != nil {
+		log.Println("https server failed: ", err)
+	}
 }
@@ -0,0 +1,183 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"sync"
+	"time"
+)
+
+const namespace = "waf_cert_uploader"
+
+var (
+	admissionReviews = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "admission_reviews_total",
+		Help:      "Number of admission reviews by outcome.",
+	}, []string{"outcome"})
+
+	admissionReviewDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "admission_review_duration_seconds",
+		Help:      "Duration of admission reviews by outcome.",
+		Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	}, []string{"outcome"})
+
+	wafApiCalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "waf_api_calls_total",
+		Help:      "Number of WAF API calls by operation.",
+	}, []string{"operation"})
+
+	wafApiErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "waf_api_errors_total",
+		Help:      "Number of failed WAF API calls by operation.",
+	}, []string{"operation"})
+
+	wafApiRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "waf_api_retries_total",
+		Help:      "Number of retried WAF API calls by operation.",
+	}, []string{"operation"})
+
+	elbApiCalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "elb_api_calls_total",
+		Help:      "Number of ELB API calls by operation.",
+	}, []string{"operation"})
+
+	elbApiErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "elb_api_errors_total",
+		Help:      "Number of failed ELB API calls by operation.",
+	}, []string{"operation"})
+
+	elbApiRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "elb_api_retries_total",
+		Help:      "Number of retried ELB API calls by operation.",
+	}, []string{"operation"})
+
+	driftedSecrets = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "drifted_secrets",
+		Help:      "Number of secrets found by the last drift detection by kind of drift.",
+	}, []string{"kind"})
+
+	certificateExpiry = newExpiryCollector()
+)
+
+func init() {
+	prometheus.MustRegister(certificateExpiry)
+}
+
+func ObserveAdmissionReview(outcome string, duration time.Duration) {
+	admissionReviews.WithLabelValues(outcome).Inc()
+	admissionReviewDuration.WithLabelValues(outcome).Observe(duration.Seconds())
+}
+
+func RecordWafApiCall(operation string, err error) {
+	wafApiCalls.WithLabelValues(operation).Inc()
+	if err != nil {
+		wafApiErrors.WithLabelValues(operation).Inc()
+	}
+}
+
+func RecordWafApiRetry(operation string) {
+	wafApiRetries.WithLabelValues(operation).Inc()
+}
+
+func RecordElbApiCall(operation string, err error) {
+	elbApiCalls.WithLabelValues(operation).Inc()
+	if err != nil {
+		elbApiErrors.WithLabelValues(operation).Inc()
+	}
+}
+
+func RecordElbApiRetry(operation string) {
+	elbApiRetries.WithLabelValues(operation).Inc()
+}
+
+func SetDriftedSecrets(countsByKind map[string]int) {
+	driftedSecrets.Reset()
+	for kind, count := range countsByKind {
+		driftedSecrets.WithLabelValues(kind).Set(float64(count))
+	}
+}
+
+// SetCertificateExpiry replaces the expiry of the certificate of a secret for all its waf domains.
+func SetCertificateExpiry(secretNamespace string, secretName string, wafDomainIds []string, notAfter time.Time) {
+	certificateExpiry.set(secretNamespace, secretName, wafDomainIds, notAfter)
+}
+
+// DeleteCertificateExpiry removes the expiry of the certificate of a deleted secret.
+func DeleteCertificateExpiry(secretNamespace string, secretName string) {
+	certificateExpiry.delete(secretNamespace, secretName)
+}
+
+var now = time.Now
+
+type expiryKey struct {
+	wafDomainId     string
+	secretNamespace string
+	secretName      string
+}
+
+// expiryCollector computes the seconds until expiry while being scraped instead of storing a stale value.
+type expiryCollector struct {
+	mutex       sync.Mutex
+	description *prometheus.Desc
+	expiries    map[expiryKey]time.Time
+}
+
+func newExpiryCollector() *expiryCollector {
+	return &expiryCollector{
+		description: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "certificate_expiry_seconds"),
+			"Seconds until the uploaded certificate expires.",
+			[]string{"waf_domain_id", "secret_namespace", "secret_name"},
+			nil),
+		expiries: map[expiryKey]time.Time{},
+	}
+}
+
+func (c *expiryCollector) set(secretNamespace string, secretName string, wafDomainIds []string, notAfter time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.deleteLocked(secretNamespace, secretName)
+	for _, wafDomainId := range wafDomainIds {
+		c.expiries[expiryKey{wafDomainId, secretNamespace, secretName}] = notAfter
+	}
+}
+
+func (c *expiryCollector) delete(secretNamespace string, secretName string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.deleteLocked(secretNamespace, secretName)
+}
+
+func (c *expiryCollector) deleteLocked(secretNamespace string, secretName string) {
+	for key := range c.expiries {
+		if key.secretNamespace == secretNamespace && key.secretName == secretName {
+			delete(c.expiries, key)
+		}
+	}
+}
+
+func (c *expiryCollector) Describe(descriptions chan<- *prometheus.Desc) {
+	descriptions <- c.description
+}
+
+func (c *expiryCollector) Collect(metrics chan<- prometheus.Metric) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	currentTime := now()
+	for key, notAfter := range c.expiries {
+		metrics <- prometheus.MustNewConstMetric(
+			c.description,
+			prometheus.GaugeValue,
+			notAfter.Sub(currentTime).Seconds(),
+			key.wafDomainId, key.secretNamespace, key.secretName)
+	}
+}
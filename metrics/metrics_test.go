@@ -0,0 +1,68 @@
+package metrics
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordWafApiCall(t *testing.T) {
+	RecordWafApiCall("get_domain", nil)
+	RecordWafApiCall("get_domain", errors.New("any error"))
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(wafApiCalls.WithLabelValues("get_domain")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(wafApiErrors.WithLabelValues("get_domain")))
+}
+
+func TestObserveAdmissionReview(t *testing.T) {
+	ObserveAdmissionReview("allowed", time.Second)
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(admissionReviews.WithLabelValues("allowed")))
+	assert.Equal(t, 1, testutil.CollectAndCount(admissionReviewDuration))
+}
+
+func TestSetCertificateExpiry(t *testing.T) {
+	currentTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	now = func() time.Time { return currentTime }
+	defer func() { now = time.Now }()
+
+	SetCertificateExpiry("waf", "my.domain.com", []string{"domain-1", "domain-2"}, currentTime.Add(time.Hour))
+	SetCertificateExpiry("waf", "my.domain.com", []string{"domain-1"}, currentTime.Add(2*time.Hour))
+
+	expected := `
+		# HELP waf_cert_uploader_certificate_expiry_seconds Seconds until the uploaded certificate expires.
+		# TYPE waf_cert_uploader_certificate_expiry_seconds gauge
+		waf_cert_uploader_certificate_expiry_seconds{secret_name="my.domain.com",secret_namespace="waf",waf_domain_id="domain-1"} 7200
+	`
+	assert.Nil(t, testutil.CollectAndCompare(certificateExpiry, strings.NewReader(expected)))
+}
+
+func TestDeleteCertificateExpiry(t *testing.T) {
+	SetCertificateExpiry("waf", "my.domain.com", []string{"domain-1", "domain-2"}, time.Now().Add(time.Hour))
+
+	DeleteCertificateExpiry("waf", "my.domain.com")
+
+	assert.Nil(t, testutil.CollectAndCompare(certificateExpiry, strings.NewReader(""),
+		"waf_cert_uploader_certificate_expiry_seconds"))
+}
+
+func TestRecordElbApiCall(t *testing.T) {
+	RecordElbApiCall("update_listener", nil)
+	RecordElbApiCall("update_listener", errors.New("any error"))
+	RecordElbApiRetry("update_listener")
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(elbApiCalls.WithLabelValues("update_listener")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(elbApiErrors.WithLabelValues("update_listener")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(elbApiRetries.WithLabelValues("update_listener")))
+	assert.Equal(t, 0, testutil.CollectAndCount(wafApiCalls, "update_listener"))
+}
+
+func TestSetDriftedSecrets(t *testing.T) {
+	SetDriftedSecrets(map[string]int{"domain-mismatch": 2, "certificate-missing": 0})
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(driftedSecrets.WithLabelValues("domain-mismatch")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(driftedSecrets.WithLabelValues("certificate-missing")))
+}
@@ -0,0 +1,122 @@
+package reconciler
+
+import (
+	"context"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"log"
+	"time"
+	"waf-cert-uploader/metrics"
+	"waf-cert-uploader/service"
+)
+
+type DriftDetector struct {
+	client                    kubernetes.Interface
+	namespace                 string
+	repair                    bool
+	detectDrift               func(secrets []apiv1.Secret) ([]service.SecretDrift, error)
+	createOrUpdateCertificate func(secret apiv1.Secret) (*service.UploadResult, error)
+}
+
+func NewDriftDetector(
+	client kubernetes.Interface,
+	certificateServices service.CertificateServices,
+	namespace string,
+	repair bool) *DriftDetector {
+	return &DriftDetector{
+		client:                    client,
+		namespace:                 namespace,
+		repair:                    repair,
+		detectDrift:               certificateServices.DetectDrift,
+		createOrUpdateCertificate: certificateServices.CreateOrUpdateCertificate,
+	}
+}
+
+func (d *DriftDetector) Run(interval time.Duration, stopCh <-chan struct{}) {
+	log.Printf("drift detection runs every %s, repair: %t", interval, d.repair)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			_, err := d.DetectAndRepair()
+			if err != nil {
+				log.Println("drift detection failed", err)
+			}
+		}
+	}
+}
+
+func (d *DriftDetector) DetectAndRepair() ([]service.SecretDrift, error) {
+	secretList, err := d.client.CoreV1().Secrets(d.namespace).List(
+		context.TODO(), metav1.ListOptions{LabelSelector: enabledLabelSelector})
+	if err != nil {
+		log.Println("couldn't list the managed secrets", err)
+		return nil, err
+	}
+
+	var secrets []apiv1.Secret
+	secretsByKey := map[string]apiv1.Secret{}
+	for _, secret := range secretList.Items {
+		if secret.Type == apiv1.SecretTypeTLS {
+			secrets = append(secrets, secret)
+			secretsByKey[secret.Namespace+"/"+secret.Name] = secret
+		}
+	}
+
+	secretDrifts, err := d.detectDrift(secrets)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("drift detection checked %d secrets, %d drifted", len(secrets), len(secretDrifts))
+	recordDriftMetrics(secretDrifts)
+
+	for _, secretDrift := range secretDrifts {
+		key := secretDrift.Namespace + "/" + secretDrift.Name
+		for _, drift := range secretDrift.Drifts {
+			log.Printf("secret %s drifted: %s", key, drift)
+		}
+		if d.repair && !secretDrift.DetectionFailed() {
+			secret := secretsByKey[key]
+			d.repairSecret(&secret)
+		}
+	}
+	return secretDrifts, nil
+}
+
+func (d *DriftDetector) repairSecret(secret *apiv1.Secret) {
+	log.Printf("repairing secret %s/%s...", secret.Namespace, secret.Name)
+	uploadResult, err := d.createOrUpdateCertificate(*secret.DeepCopy())
+	if err != nil {
+		log.Printf("secret %s/%s couldn't be repaired: %v", secret.Namespace, secret.Name, err)
+		return
+	}
+	if !hasCertificateIds(secret, uploadResult) {
+		err = patchCertificateIds(d.client, secret, uploadResult)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+	}
+	log.Printf("secret %s/%s was repaired", secret.Namespace, secret.Name)
+}
+
+func recordDriftMetrics(secretDrifts []service.SecretDrift) {
+	countsByKind := map[string]int{}
+	for _, kind := range service.DriftKinds {
+		countsByKind[string(kind)] = 0
+	}
+	for _, secretDrift := range secretDrifts {
+		kinds := map[service.DriftKind]bool{}
+		for _, drift := range secretDrift.Drifts {
+			kinds[drift.Kind] = true
+		}
+		for kind := range kinds {
+			countsByKind[string(kind)]++
+		}
+	}
+	metrics.SetDriftedSecrets(countsByKind)
+}
@@ -0,0 +1,77 @@
+package reconciler
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"testing"
+	"waf-cert-uploader/service"
+)
+
+func TestDetectAndRepair(t *testing.T) {
+	client := fake.NewSimpleClientset(getTlsSecret())
+	detector := NewDriftDetector(client, newTestCertificateServices(), "", true)
+	var checkedSecrets []apiv1.Secret
+	detector.detectDrift = func(secrets []apiv1.Secret) ([]service.SecretDrift, error) {
+		checkedSecrets = secrets
+		return []service.SecretDrift{{Namespace: "waf", Name: "my.domain.com", Drifts: []service.Drift{
+			{Kind: service.DriftAnnotationMismatch, Expected: "12345"},
+		}}}, nil
+	}
+	detector.createOrUpdateCertificate = func(secret apiv1.Secret) (*service.UploadResult, error) {
+		return &service.UploadResult{CertIds: map[service.TargetName]string{service.TargetWaf: "12345"}}, nil
+	}
+
+	result, err := detector.DetectAndRepair()
+
+	assert.Nil(t, err)
+	assert.Len(t, result, 1)
+	assert.Len(t, checkedSecrets, 1)
+	secret, err := client.CoreV1().Secrets("waf").Get(context.TODO(), "my.domain.com", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, `{"waf":"12345"}`, secret.Annotations[service.CertIdsAnnotation])
+}
+
+func TestDetectAndRepair_reportOnly(t *testing.T) {
+	client := fake.NewSimpleClientset(getTlsSecret())
+	detector := NewDriftDetector(client, newTestCertificateServices(), "", false)
+	detector.detectDrift = func(secrets []apiv1.Secret) ([]service.SecretDrift, error) {
+		return []service.SecretDrift{{Namespace: "waf", Name: "my.domain.com", Drifts: []service.Drift{
+			{Kind: service.DriftCertificateMissing},
+		}}}, nil
+	}
+	called := false
+	detector.createOrUpdateCertificate = func(secret apiv1.Secret) (*service.UploadResult, error) {
+		called = true
+		return &service.UploadResult{CertIds: map[service.TargetName]string{service.TargetWaf: "12345"}}, nil
+	}
+
+	result, err := detector.DetectAndRepair()
+
+	assert.Nil(t, err)
+	assert.Len(t, result, 1)
+	assert.False(t, called)
+}
+
+func TestDetectAndRepair_detectionFailed(t *testing.T) {
+	client := fake.NewSimpleClientset(getTlsSecret())
+	detector := NewDriftDetector(client, newTestCertificateServices(), "", true)
+	detector.detectDrift = func(secrets []apiv1.Secret) ([]service.SecretDrift, error) {
+		return []service.SecretDrift{{Namespace: "waf", Name: "my.domain.com", Drifts: []service.Drift{
+			{Kind: service.DriftDetectionFailed, Actual: "invalid configuration"},
+		}}}, nil
+	}
+	called := false
+	detector.createOrUpdateCertificate = func(secret apiv1.Secret) (*service.UploadResult, error) {
+		called = true
+		return nil, nil
+	}
+
+	result, err := detector.DetectAndRepair()
+
+	assert.Nil(t, err)
+	assert.Len(t, result, 1)
+	assert.False(t, called)
+}
@@ -0,0 +1,211 @@
+package reconciler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	apiv1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"log"
+	"reflect"
+	"time"
+	"waf-cert-uploader/metrics"
+	"waf-cert-uploader/service"
+)
+
+const (
+	enabledLabelSelector = "waf-cert-uploader.iits.tech/enabled=true"
+	defaultResyncPeriod  = 30 * time.Minute
+)
+
+type Reconciler struct {
+	client                    kubernetes.Interface
+	informerFactory           informers.SharedInformerFactory
+	secretInformer            cache.SharedIndexInformer
+	secretLister              listers.SecretLister
+	queue                     workqueue.RateLimitingInterface
+	createOrUpdateCertificate func(secret apiv1.Secret) (*service.UploadResult, error)
+}
+
+func NewReconciler(client kubernetes.Interface, certificateServices service.CertificateServices, namespace string) *Reconciler {
+	informerFactory := informers.NewSharedInformerFactoryWithOptions(
+		client,
+		defaultResyncPeriod,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = enabledLabelSelector
+		}))
+	secrets := informerFactory.Core().V1().Secrets()
+
+	reconciler := &Reconciler{
+		client:                    client,
+		informerFactory:           informerFactory,
+		secretInformer:            secrets.Informer(),
+		secretLister:              secrets.Lister(),
+		queue:                     workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		createOrUpdateCertificate: certificateServices.CreateOrUpdateCertificate,
+	}
+
+	_, err := reconciler.secretInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: reconciler.enqueue,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			if needsReconciliation(oldObj.(*apiv1.Secret), newObj.(*apiv1.Secret)) {
+				reconciler.enqueue(newObj)
+			}
+		},
+		DeleteFunc: reconciler.enqueue,
+	})
+	if err != nil {
+		log.Println("couldn't register the secret event handler", err)
+	}
+	return reconciler
+}
+
+func (r *Reconciler) Run(workers int, stopCh <-chan struct{}) {
+	defer r.queue.ShutDown()
+
+	r.informerFactory.Start(stopCh)
+	log.Println("waiting for the secret informer to sync...")
+	if !cache.WaitForCacheSync(stopCh, r.secretInformer.HasSynced) {
+		log.Println("the secret informer couldn't sync")
+		return
+	}
+
+	log.Printf("starting %d reconciler workers", workers)
+	for i := 0; i < workers; i++ {
+		go wait.Until(r.runWorker, time.Second, stopCh)
+	}
+	<-stopCh
+	log.Println("stopping the reconciler")
+}
+
+func (r *Reconciler) runWorker() {
+	for r.processNextItem() {
+	}
+}
+
+func (r *Reconciler) processNextItem() bool {
+	key, shutdown := r.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer r.queue.Done(key)
+
+	err := r.reconcile(key.(string))
+	if err == nil {
+		r.queue.Forget(key)
+		return true
+	}
+
+	log.Printf("reconciling secret %s failed %d times, retrying: %v", key, r.queue.NumRequeues(key)+1, err)
+	r.queue.AddRateLimited(key)
+	return true
+}
+
+func (r *Reconciler) reconcile(key string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		log.Println("invalid secret key", key)
+		return nil
+	}
+
+	secret, err := r.secretLister.Secrets(namespace).Get(name)
+	if k8serrors.IsNotFound(err) {
+		log.Printf("secret %s was deleted", key)
+		metrics.DeleteCertificateExpiry(namespace, name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if secret.Type != apiv1.SecretTypeTLS {
+		return nil
+	}
+
+	log.Printf("reconciling secret %s", key)
+	uploadResult, err := r.createOrUpdateCertificate(*secret.DeepCopy())
+	if err != nil {
+		return err
+	}
+	for _, warning := range uploadResult.Warnings {
+		log.Printf("secret %s: %s", key, warning)
+	}
+
+	_, hasUploadStatus := secret.Annotations[service.UploadStatusAnnotation]
+	if hasCertificateIds(secret, uploadResult) && !hasUploadStatus {
+		return nil
+	}
+	return patchCertificateIds(r.client, secret, uploadResult)
+}
+
+// hasCertificateIds tells whether the cert-ids annotation of the secret contains the certificate ids of the upload
+// already and the legacy annotations are gone.
+func hasCertificateIds(secret *apiv1.Secret, uploadResult *service.UploadResult) bool {
+	certIds, err := service.FormatCertIds(uploadResult.CertIds)
+	if err != nil {
+		return false
+	}
+	_, hasCertWafId := secret.Annotations[service.CertWafIdAnnotation]
+	_, hasCertElbId := secret.Annotations[service.CertElbIdAnnotation]
+	return secret.Annotations[service.CertIdsAnnotation] == certIds && !hasCertWafId && !hasCertElbId
+}
+
+// patchCertificateIds replaces the legacy certificate id annotations and removes the status of a failed upload.
+func patchCertificateIds(client kubernetes.Interface, secret *apiv1.Secret, uploadResult *service.UploadResult) error {
+	certIds, err := service.FormatCertIds(uploadResult.CertIds)
+	if err != nil {
+		return err
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": map[string]interface{}{
+			service.CertIdsAnnotation:      certIds,
+			service.CertWafIdAnnotation:    nil,
+			service.CertElbIdAnnotation:    nil,
+			service.UploadStatusAnnotation: nil,
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = client.CoreV1().Secrets(secret.Namespace).Patch(
+		context.TODO(), secret.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		return fmt.Errorf("patching the certificate id of secret %s/%s failed: %w", secret.Namespace, secret.Name, err)
+	}
+	log.Printf("secret %s/%s was patched with certificate ids %s", secret.Namespace, secret.Name, certIds)
+	return nil
+}
+
+// enqueue accepts the tombstones of deleted secrets as well, their expiry metrics are removed by reconcile.
+func (r *Reconciler) enqueue(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		log.Println("couldn't get the key of the secret", err)
+		return
+	}
+	r.queue.Add(key)
+}
+
+// needsReconciliation ignores the updates caused by our own certificate id and upload status patches,
+// but keeps resyncs of unchanged secrets so missed or failed uploads are retried.
+func needsReconciliation(oldSecret *apiv1.Secret, newSecret *apiv1.Secret) bool {
+	if oldSecret.ResourceVersion == newSecret.ResourceVersion {
+		return true
+	}
+	if !bytes.Equal(oldSecret.Data[apiv1.TLSCertKey], newSecret.Data[apiv1.TLSCertKey]) ||
+		!bytes.Equal(oldSecret.Data[apiv1.TLSPrivateKeyKey], newSecret.Data[apiv1.TLSPrivateKeyKey]) {
+		return true
+	}
+	return !reflect.DeepEqual(
+		service.WithoutUploaderAnnotations(oldSecret.Annotations), service.WithoutUploaderAnnotations(newSecret.Annotations))
+}
@@ -0,0 +1,180 @@
+package reconciler
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+	"testing"
+	"time"
+	"waf-cert-uploader/adapter"
+	"waf-cert-uploader/metrics"
+	"waf-cert-uploader/service"
+)
+
+func getTlsSecret() *apiv1.Secret {
+	return &apiv1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "my.domain.com",
+			Namespace:       "waf",
+			ResourceVersion: "version1",
+			Labels:          map[string]string{"waf-cert-uploader.iits.tech/enabled": "true"},
+			Annotations:     map[string]string{"waf-cert-uploader.iits.tech/waf-domain-id": "45656165da65456"},
+		},
+		Type: apiv1.SecretTypeTLS,
+		Data: map[string][]byte{
+			"tls.crt": []byte("any cert"),
+			"tls.key": []byte("any private key"),
+		},
+	}
+}
+
+func newTestCertificateServices() service.CertificateServices {
+	return service.NewCertificateServices(map[service.WafType]*service.CertificateService{
+		service.WafTypeCloud: service.NewCertificateService(adapter.NewFakeWafCertificateManager(), service.DefaultOptions()),
+	}, service.DefaultOptions())
+}
+
+func startReconciler(t *testing.T, client *fake.Clientset) (*Reconciler, chan struct{}) {
+	reconciler := NewReconciler(client, newTestCertificateServices(), "")
+	stopCh := make(chan struct{})
+	reconciler.informerFactory.Start(stopCh)
+	assert.True(t, cache.WaitForCacheSync(stopCh, reconciler.secretInformer.HasSynced))
+	return reconciler, stopCh
+}
+
+func TestReconcile(t *testing.T) {
+	client := fake.NewSimpleClientset(getTlsSecret())
+	reconciler, stopCh := startReconciler(t, client)
+	defer close(stopCh)
+	var secretSlot apiv1.Secret
+	reconciler.createOrUpdateCertificate = func(secret apiv1.Secret) (*service.UploadResult, error) {
+		secretSlot = secret
+		return &service.UploadResult{CertIds: map[service.TargetName]string{service.TargetWaf: "12345"}}, nil
+	}
+
+	err := reconciler.reconcile("waf/my.domain.com")
+
+	assert.Nil(t, err)
+	assert.Equal(t, "my.domain.com", secretSlot.Name)
+	secret, err := client.CoreV1().Secrets("waf").Get(context.TODO(), "my.domain.com", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, `{"waf":"12345"}`, secret.Annotations[service.CertIdsAnnotation])
+	assert.Equal(t, "45656165da65456", secret.Annotations["waf-cert-uploader.iits.tech/waf-domain-id"])
+}
+
+func TestReconcile_unchangedCertificateId(t *testing.T) {
+	tlsSecret := getTlsSecret()
+	tlsSecret.Annotations[service.CertIdsAnnotation] = `{"waf":"12345"}`
+	client := fake.NewSimpleClientset(tlsSecret)
+	reconciler, stopCh := startReconciler(t, client)
+	defer close(stopCh)
+	reconciler.createOrUpdateCertificate = func(secret apiv1.Secret) (*service.UploadResult, error) {
+		return &service.UploadResult{CertIds: map[service.TargetName]string{service.TargetWaf: "12345"}}, nil
+	}
+	client.ClearActions()
+
+	err := reconciler.reconcile("waf/my.domain.com")
+
+	assert.Nil(t, err)
+	assert.Empty(t, client.Actions())
+}
+
+func TestReconcile_replacesLegacyCertificateId(t *testing.T) {
+	tlsSecret := getTlsSecret()
+	tlsSecret.Annotations[service.CertWafIdAnnotation] = "12345"
+	client := fake.NewSimpleClientset(tlsSecret)
+	reconciler, stopCh := startReconciler(t, client)
+	defer close(stopCh)
+	reconciler.createOrUpdateCertificate = func(secret apiv1.Secret) (*service.UploadResult, error) {
+		return &service.UploadResult{CertIds: map[service.TargetName]string{service.TargetWaf: "12345"}}, nil
+	}
+
+	err := reconciler.reconcile("waf/my.domain.com")
+
+	assert.Nil(t, err)
+	secret, err := client.CoreV1().Secrets("waf").Get(context.TODO(), "my.domain.com", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, `{"waf":"12345"}`, secret.Annotations[service.CertIdsAnnotation])
+	assert.NotContains(t, secret.Annotations, service.CertWafIdAnnotation)
+}
+
+func TestProcessNextItem_retriesOnError(t *testing.T) {
+	client := fake.NewSimpleClientset(getTlsSecret())
+	reconciler, stopCh := startReconciler(t, client)
+	defer close(stopCh)
+	reconciler.createOrUpdateCertificate = func(secret apiv1.Secret) (*service.UploadResult, error) {
+		return nil, errors.New("waf unavailable")
+	}
+	for reconciler.queue.Len() > 0 {
+		key, _ := reconciler.queue.Get()
+		reconciler.queue.Forget(key)
+		reconciler.queue.Done(key)
+	}
+	reconciler.queue.Add("waf/my.domain.com")
+
+	assert.True(t, reconciler.processNextItem())
+
+	assert.Equal(t, 1, reconciler.queue.NumRequeues("waf/my.domain.com"))
+}
+
+func TestReconcile_deletedSecret(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	reconciler, stopCh := startReconciler(t, client)
+	defer close(stopCh)
+	called := false
+	reconciler.createOrUpdateCertificate = func(secret apiv1.Secret) (*service.UploadResult, error) {
+		called = true
+		return nil, nil
+	}
+	metrics.SetCertificateExpiry("waf", "my.domain.com", []string{"45656165da65456"}, time.Now().Add(time.Hour))
+
+	err := reconciler.reconcile("waf/my.domain.com")
+
+	assert.Nil(t, err)
+	assert.False(t, called)
+	count, err := testutil.GatherAndCount(prometheus.DefaultGatherer, "waf_cert_uploader_certificate_expiry_seconds")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, count)
+}
+
+func TestEnqueue_deletedSecret(t *testing.T) {
+	reconciler, stopCh := startReconciler(t, fake.NewSimpleClientset())
+	defer close(stopCh)
+
+	reconciler.enqueue(cache.DeletedFinalStateUnknown{Key: "waf/my.domain.com", Obj: getTlsSecret()})
+
+	key, _ := reconciler.queue.Get()
+	assert.Equal(t, "waf/my.domain.com", key)
+}
+
+func TestNeedsReconciliation(t *testing.T) {
+	oldSecret := getTlsSecret()
+
+	patchedSecret := getTlsSecret()
+	patchedSecret.ResourceVersion = "version2"
+	patchedSecret.Annotations[service.CertIdsAnnotation] = `{"waf":"12345"}`
+	assert.False(t, needsReconciliation(oldSecret, patchedSecret))
+
+	statusPatchedSecret := getTlsSecret()
+	statusPatchedSecret.ResourceVersion = "version2"
+	statusPatchedSecret.Annotations[service.UploadStatusAnnotation] = service.UploadStatusPending
+	assert.False(t, needsReconciliation(oldSecret, statusPatchedSecret))
+
+	renewedSecret := getTlsSecret()
+	renewedSecret.ResourceVersion = "version2"
+	renewedSecret.Data["tls.crt"] = []byte("renewed cert")
+	assert.True(t, needsReconciliation(oldSecret, renewedSecret))
+
+	retargetedSecret := getTlsSecret()
+	retargetedSecret.ResourceVersion = "version2"
+	retargetedSecret.Annotations["waf-cert-uploader.iits.tech/waf-domain-id"] = "other-domain"
+	assert.True(t, needsReconciliation(oldSecret, retargetedSecret))
+
+	assert.True(t, needsReconciliation(oldSecret, getTlsSecret()))
+}
@@ -0,0 +1,192 @@
+package reconciler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	apiv1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/workqueue"
+	"log"
+	"sync"
+	"time"
+	"waf-cert-uploader/service"
+)
+
+const (
+	retryBaseDelay = 10 * time.Second
+	retryMaxDelay  = 10 * time.Minute
+	// admissionCheckDelay and maxAdmissionChecks bound the wait for the api server to store the admitted secret.
+	admissionCheckDelay = time.Second
+	maxAdmissionChecks  = 30
+)
+
+// errNotAdmittedYet is returned while the stored secret doesn't contain the admitted certificate.
+var errNotAdmittedYet = errors.New("the admitted certificate is not stored yet")
+
+// uploadItem is the admitted version of a secret, identified by the hash of its certificate. It is the key of the
+// queue, so the same version is only uploaded by one worker at a time.
+type uploadItem struct {
+	namespace       string
+	name            string
+	certificateHash string
+}
+
+func (i uploadItem) String() string {
+	return i.namespace + "/" + i.name
+}
+
+// UploadQueue uploads the certificates of admitted secrets outside the admission review and writes the
+// certificate id back to the secret. Failed uploads are retried with an exponential backoff.
+type UploadQueue struct {
+	client                    kubernetes.Interface
+	queue                     workqueue.RateLimitingInterface
+	createOrUpdateCertificate func(secret apiv1.Secret) (*service.UploadResult, error)
+	// admissionChecks counts how often an item was checked for the admitted certificate, outside the key of the queue
+	admissionChecks      map[uploadItem]int
+	admissionChecksMutex sync.Mutex
+}
+
+func NewUploadQueue(client kubernetes.Interface, certificateServices service.CertificateServices) *UploadQueue {
+	return &UploadQueue{
+		client: client,
+		queue: workqueue.NewRateLimitingQueue(
+			workqueue.NewItemExponentialFailureRateLimiter(retryBaseDelay, retryMaxDelay)),
+		createOrUpdateCertificate: certificateServices.CreateOrUpdateCertificate,
+		admissionChecks:           map[uploadItem]int{},
+	}
+}
+
+// Add queues the upload of an admitted secret, the certificate hash is the one of the admitted version.
+func (q *UploadQueue) Add(namespace string, name string, certificateHash string) {
+	item := uploadItem{namespace: namespace, name: name, certificateHash: certificateHash}
+	log.Printf("the upload of secret %s is queued", item)
+	q.queue.Add(item)
+}
+
+// AddRetry queues the upload of an admitted secret whose upload already failed.
+func (q *UploadQueue) AddRetry(namespace string, name string, certificateHash string) {
+	item := uploadItem{namespace: namespace, name: name, certificateHash: certificateHash}
+	log.Printf("the upload of secret %s is queued for a retry", item)
+	q.queue.AddRateLimited(item)
+}
+
+func (q *UploadQueue) Run(workers int, stopCh <-chan struct{}) {
+	defer q.queue.ShutDown()
+	log.Printf("starting %d upload workers", workers)
+	for i := 0; i < workers; i++ {
+		go wait.Until(q.runWorker, time.Second, stopCh)
+	}
+	<-stopCh
+}
+
+func (q *UploadQueue) runWorker() {
+	for q.processNextItem() {
+	}
+}
+
+func (q *UploadQueue) processNextItem() bool {
+	queued, shutdown := q.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer q.queue.Done(queued)
+	item := queued.(uploadItem)
+
+	err := q.upload(item)
+	if err == nil {
+		q.queue.Forget(item)
+		q.forgetAdmissionChecks(item)
+		return true
+	}
+
+	if errors.Is(err, errNotAdmittedYet) {
+		q.queue.Forget(item)
+		q.requeueAdmissionCheck(item)
+		return true
+	}
+	q.forgetAdmissionChecks(item)
+
+	log.Printf("the upload of secret %s failed %d times, retrying: %v", item, q.queue.NumRequeues(item)+1, err)
+	q.queue.AddRateLimited(item)
+	return true
+}
+
+// requeueAdmissionCheck gives up on a secret that never contains the admitted certificate, it was rejected by
+// a later webhook or replaced by a newer version, which is queued itself.
+func (q *UploadQueue) requeueAdmissionCheck(item uploadItem) {
+	q.admissionChecksMutex.Lock()
+	checks := q.admissionChecks[item] + 1
+	if checks >= maxAdmissionChecks {
+		delete(q.admissionChecks, item)
+		q.admissionChecksMutex.Unlock()
+		log.Printf("secret %s doesn't contain the admitted certificate, the upload is dropped", item)
+		return
+	}
+	q.admissionChecks[item] = checks
+	q.admissionChecksMutex.Unlock()
+	q.queue.AddAfter(item, admissionCheckDelay)
+}
+
+func (q *UploadQueue) forgetAdmissionChecks(item uploadItem) {
+	q.admissionChecksMutex.Lock()
+	defer q.admissionChecksMutex.Unlock()
+	delete(q.admissionChecks, item)
+}
+
+// upload only uploads the admitted version of the secret, the api server stores it after the admission review.
+func (q *UploadQueue) upload(item uploadItem) error {
+	secret, err := q.client.CoreV1().Secrets(item.namespace).Get(context.TODO(), item.name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		log.Printf("secret %s doesn't exist (yet)", item)
+		return errNotAdmittedYet
+	}
+	if err != nil {
+		return err
+	}
+	if service.CertificateHash(*secret) != item.certificateHash {
+		log.Printf("secret %s doesn't contain the admitted certificate (yet)", item)
+		return errNotAdmittedYet
+	}
+
+	uploadResult, err := q.createOrUpdateCertificate(*secret)
+	if err != nil {
+		patchErr := patchUploadStatus(q.client, secret, service.UploadFailureStatus(err))
+		if patchErr != nil {
+			log.Println(patchErr)
+		}
+		return err
+	}
+	for _, warning := range uploadResult.Warnings {
+		log.Printf("secret %s: %s", item, warning)
+	}
+	log.Printf("the upload of secret %s succeeded", item)
+	return patchCertificateIds(q.client, secret, uploadResult)
+}
+
+// patchUploadStatus skips unchanged statuses, every patch is another admission review.
+func patchUploadStatus(client kubernetes.Interface, secret *apiv1.Secret, status string) error {
+	if secret.Annotations[service.UploadStatusAnnotation] == status {
+		return nil
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{service.UploadStatusAnnotation: status},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = client.CoreV1().Secrets(secret.Namespace).Patch(
+		context.TODO(), secret.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		return fmt.Errorf("patching the upload status of secret %s/%s failed: %w", secret.Namespace, secret.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package reconciler
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"testing"
+	"time"
+	"waf-cert-uploader/service"
+)
+
+func TestUploadQueue_upload(t *testing.T) {
+	tlsSecret := getTlsSecret()
+	tlsSecret.Annotations[service.UploadStatusAnnotation] = "failed (waf_unavailable): waf unavailable"
+	client := fake.NewSimpleClientset(tlsSecret)
+	uploadQueue := NewUploadQueue(client, newTestCertificateServices())
+	uploadQueue.createOrUpdateCertificate = func(secret apiv1.Secret) (*service.UploadResult, error) {
+		return &service.UploadResult{CertIds: map[service.TargetName]string{service.TargetWaf: "12345"}}, nil
+	}
+
+	err := uploadQueue.upload(admittedItem(getTlsSecret()))
+
+	assert.Nil(t, err)
+	secret, err := client.CoreV1().Secrets("waf").Get(context.TODO(), "my.domain.com", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, `{"waf":"12345"}`, secret.Annotations[service.CertIdsAnnotation])
+	assert.NotContains(t, secret.Annotations, service.UploadStatusAnnotation)
+}
+
+func TestUploadQueue_secretNotStoredYet(t *testing.T) {
+	uploadQueue := NewUploadQueue(fake.NewSimpleClientset(), newTestCertificateServices())
+	called := false
+	uploadQueue.createOrUpdateCertificate = func(secret apiv1.Secret) (*service.UploadResult, error) {
+		called = true
+		return nil, nil
+	}
+
+	err := uploadQueue.upload(admittedItem(getTlsSecret()))
+
+	assert.ErrorIs(t, err, errNotAdmittedYet)
+	assert.False(t, called)
+}
+
+func TestUploadQueue_processNextItemRequeuesOnError(t *testing.T) {
+	uploadQueue := NewUploadQueue(fake.NewSimpleClientset(getTlsSecret()), newTestCertificateServices())
+	uploadQueue.createOrUpdateCertificate = func(secret apiv1.Secret) (*service.UploadResult, error) {
+		return nil, errors.New("waf unavailable")
+	}
+	uploadQueue.queue.Add(admittedItem(getTlsSecret()))
+
+	assert.True(t, uploadQueue.processNextItem())
+
+	assert.Equal(t, 1, uploadQueue.queue.NumRequeues(admittedItem(getTlsSecret())))
+}
+
+func TestUploadQueue_otherCertificateIsNotUploaded(t *testing.T) {
+	uploadQueue := NewUploadQueue(fake.NewSimpleClientset(getTlsSecret()), newTestCertificateServices())
+	called := false
+	uploadQueue.createOrUpdateCertificate = func(secret apiv1.Secret) (*service.UploadResult, error) {
+		called = true
+		return nil, nil
+	}
+	admittedSecret := getTlsSecret()
+	admittedSecret.Data["tls.crt"] = []byte("newer cert")
+	uploadQueue.queue.Add(admittedItem(admittedSecret))
+
+	assert.True(t, uploadQueue.processNextItem())
+
+	assert.False(t, called)
+	assert.Equal(t, 0, uploadQueue.queue.Len())
+	assert.Equal(t, 0, uploadQueue.queue.NumRequeues(admittedItem(admittedSecret)))
+}
+
+func TestUploadQueue_requeueAdmissionCheck(t *testing.T) {
+	uploadQueue := NewUploadQueue(fake.NewSimpleClientset(), newTestCertificateServices())
+	item := admittedItem(getTlsSecret())
+	uploadQueue.admissionChecks[item] = maxAdmissionChecks - 1
+
+	uploadQueue.requeueAdmissionCheck(item)
+
+	assert.NotContains(t, uploadQueue.admissionChecks, item)
+	uploadQueue.requeueAdmissionCheck(item)
+	assert.Equal(t, 1, uploadQueue.admissionChecks[item])
+	assert.Eventually(t, func() bool { return uploadQueue.queue.Len() == 1 }, 5*admissionCheckDelay, 10*time.Millisecond)
+}
+
+func TestUploadQueue_admissionCheckIsDeduplicated(t *testing.T) {
+	uploadQueue := NewUploadQueue(fake.NewSimpleClientset(), newTestCertificateServices())
+	item := admittedItem(getTlsSecret())
+	uploadQueue.admissionChecks[item] = 3
+
+	uploadQueue.requeueAdmissionCheck(item)
+	uploadQueue.Add(item.namespace, item.name, item.certificateHash)
+
+	assert.Eventually(t, func() bool { return uploadQueue.queue.Len() == 1 }, 5*admissionCheckDelay, 10*time.Millisecond)
+	time.Sleep(2 * admissionCheckDelay)
+	assert.Equal(t, 1, uploadQueue.queue.Len())
+}
+
+func admittedItem(secret *apiv1.Secret) uploadItem {
+	return uploadItem{namespace: secret.Namespace, name: secret.Name, certificateHash: service.CertificateHash(*secret)}
+}
+
+func TestUploadQueue_failedUploadPatchesStatus(t *testing.T) {
+	client := fake.NewSimpleClientset(getTlsSecret())
+	uploadQueue := NewUploadQueue(client, newTestCertificateServices())
+	uploadQueue.createOrUpdateCertificate = func(secret apiv1.Secret) (*service.UploadResult, error) {
+		return nil, errors.New("waf unavailable")
+	}
+
+	err := uploadQueue.upload(admittedItem(getTlsSecret()))
+
+	assert.NotNil(t, err)
+	secret, err := client.CoreV1().Secrets("waf").Get(context.TODO(), "my.domain.com", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, "failed (internal): waf unavailable", secret.Annotations[service.UploadStatusAnnotation])
+}
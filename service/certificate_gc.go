@@ -0,0 +1,110 @@
+package service
+
+import (
+	waf "github.com/opentelekomcloud/gophertelekomcloud/openstack/waf/v1/certificates"
+	"log"
+	"regexp"
+	"sort"
+	"time"
+)
+
+var certificateHashName = regexp.MustCompile("^[0-9a-f]{64}$")
+
+type GarbageCollectorConfig struct {
+	Interval    time.Duration
+	GracePeriod time.Duration
+	Retention   int
+	DryRun      bool
+}
+
+const DefaultGarbageCollectionGracePeriod = 24 * time.Hour
+
+type GarbageCollectionReport struct {
+	Orphaned []waf.Certificate
+	Retained []waf.Certificate
+	Deleted  []waf.Certificate
+	Failed   []waf.Certificate
+}
+
+// StartCertificateGarbageCollector runs the garbage collection of every waf in the background until stopCh is closed.
+func (s CertificateServices) StartCertificateGarbageCollector(config GarbageCollectorConfig, stopCh <-chan struct{}) {
+	for _, wafType := range wafTypes {
+		if certificateService, found := s.Waf[wafType]; found {
+			log.Printf("starting the certificate garbage collection of the %s waf", wafType)
+			go certificateService.RunCertificateGarbageCollector(config, stopCh)
+		}
+	}
+}
+
+func (s *CertificateService) RunCertificateGarbageCollector(config GarbageCollectorConfig, stopCh <-chan struct{}) {
+	log.Printf("certificate garbage collection runs every %s, dry run: %t", config.Interval, config.DryRun)
+	ticker := time.NewTicker(config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			_, err := s.CollectOrphanedCertificates(config)
+			if err != nil {
+				log.Println("certificate garbage collection failed", err)
+			}
+		}
+	}
+}
+
+func (s *CertificateService) CollectOrphanedCertificates(config GarbageCollectorConfig) (*GarbageCollectionReport, error) {
+	log.Println("collecting orphaned certificates in the waf...")
+	certs, err := s.waf.ListCertificates()
+	if err != nil {
+		log.Println("couldn't get existing certificates from the waf ", err)
+		return nil, err
+	}
+
+	domains, err := s.waf.ListDomains()
+	if err != nil {
+		log.Println("couldn't list the waf domains", err)
+		return nil, err
+	}
+	attachedCertIds := map[string]bool{}
+	for _, domain := range domains {
+		attachedCertIds[domain.CertificateId] = true
+	}
+
+	report := GarbageCollectionReport{}
+	deadline := now().Add(-config.GracePeriod)
+	for _, cert := range certs {
+		uploadedAt := time.UnixMilli(int64(cert.Timestamp))
+		if certificateHashName.MatchString(cert.Name) && !attachedCertIds[cert.Id] && uploadedAt.Before(deadline) {
+			report.Orphaned = append(report.Orphaned, cert)
+		}
+	}
+
+	sort.SliceStable(report.Orphaned, func(i, j int) bool {
+		return report.Orphaned[i].Timestamp > report.Orphaned[j].Timestamp
+	})
+	retained := config.Retention
+	if retained > len(report.Orphaned) {
+		retained = len(report.Orphaned)
+	}
+	report.Retained = report.Orphaned[:retained]
+
+	for _, cert := range report.Orphaned[retained:] {
+		if config.DryRun {
+			log.Printf("dry run: orphaned certificate %s (%s) would be deleted", cert.Id, cert.Name)
+			continue
+		}
+		err := s.waf.DeleteCertificate(cert.Id)
+		if err != nil {
+			log.Printf("orphaned certificate %s couldn't be deleted: %v", cert.Id, err)
+			report.Failed = append(report.Failed, cert)
+		} else {
+			log.Printf("orphaned certificate %s was deleted", cert.Id)
+			report.Deleted = append(report.Deleted, cert)
+		}
+	}
+
+	log.Printf("certificate garbage collection finished: %d orphaned, %d retained, %d deleted, %d failed",
+		len(report.Orphaned), len(report.Retained), len(report.Deleted), len(report.Failed))
+	return &report, nil
+}
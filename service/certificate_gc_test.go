@@ -0,0 +1,103 @@
+package service
+
+import (
+	waf "github.com/opentelekomcloud/gophertelekomcloud/openstack/waf/v1/certificates"
+	wafDomain "github.com/opentelekomcloud/gophertelekomcloud/openstack/waf/v1/domains"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+	"waf-cert-uploader/adapter"
+)
+
+func setupGarbageCollectorTest() (*CertificateService, *adapter.FakeWafCertificateManager) {
+	hashName := getCertificateHash([]byte("cert"))
+	twoDaysAgo := int(time.Now().Add(-48 * time.Hour).UnixMilli())
+	threeDaysAgo := int(time.Now().Add(-72 * time.Hour).UnixMilli())
+	oneHourAgo := int(time.Now().Add(-time.Hour).UnixMilli())
+
+	fakeWaf := adapter.NewFakeWafCertificateManager()
+	fakeWaf.AddCertificate(waf.Certificate{Id: "attached", Name: hashName, Timestamp: threeDaysAgo})
+	fakeWaf.AddCertificate(waf.Certificate{Id: "manual", Name: "my-manual-cert", Timestamp: threeDaysAgo})
+	fakeWaf.AddCertificate(waf.Certificate{Id: "too-young", Name: hashName, Timestamp: oneHourAgo})
+	fakeWaf.AddCertificate(waf.Certificate{Id: "orphan-old", Name: hashName, Timestamp: threeDaysAgo})
+	fakeWaf.AddCertificate(waf.Certificate{Id: "orphan-new", Name: hashName, Timestamp: twoDaysAgo})
+	fakeWaf.AddDomain(wafDomain.Domain{Id: "domain-1", CertificateId: "attached"})
+	return NewCertificateService(fakeWaf, DefaultOptions()), fakeWaf
+}
+
+func getDeletedIds(fakeWaf *adapter.FakeWafCertificateManager) []string {
+	var ids []string
+	for _, call := range fakeWaf.Calls() {
+		if id, found := strings.CutPrefix(call, "DeleteCertificate "); found {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func getCertIds(certs []waf.Certificate) []string {
+	var ids []string
+	for _, cert := range certs {
+		ids = append(ids, cert.Id)
+	}
+	return ids
+}
+
+func TestCollectOrphanedCertificates(t *testing.T) {
+	certificateService, fakeWaf := setupGarbageCollectorTest()
+
+	report, err := certificateService.CollectOrphanedCertificates(GarbageCollectorConfig{GracePeriod: 24 * time.Hour})
+
+	assert.Nil(t, err)
+	assert.EqualValues(t, []string{"orphan-new", "orphan-old"}, getCertIds(report.Orphaned))
+	assert.EqualValues(t, []string{"orphan-new", "orphan-old"}, getCertIds(report.Deleted))
+	assert.EqualValues(t, []string{"orphan-new", "orphan-old"}, getDeletedIds(fakeWaf))
+}
+
+func TestCollectOrphanedCertificates_Retention(t *testing.T) {
+	certificateService, fakeWaf := setupGarbageCollectorTest()
+
+	report, err := certificateService.CollectOrphanedCertificates(GarbageCollectorConfig{GracePeriod: 24 * time.Hour, Retention: 1})
+
+	assert.Nil(t, err)
+	assert.EqualValues(t, []string{"orphan-new"}, getCertIds(report.Retained))
+	assert.EqualValues(t, []string{"orphan-old"}, getDeletedIds(fakeWaf))
+}
+
+func TestCollectOrphanedCertificates_DryRun(t *testing.T) {
+	certificateService, fakeWaf := setupGarbageCollectorTest()
+
+	report, err := certificateService.CollectOrphanedCertificates(GarbageCollectorConfig{GracePeriod: 24 * time.Hour, DryRun: true})
+
+	assert.Nil(t, err)
+	assert.EqualValues(t, []string{"orphan-new", "orphan-old"}, getCertIds(report.Orphaned))
+	assert.Empty(t, report.Deleted)
+	assert.Empty(t, getDeletedIds(fakeWaf))
+}
+
+func TestRunCertificateGarbageCollector(t *testing.T) {
+	certificateService, fakeWaf := setupGarbageCollectorTest()
+	stopCh := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		certificateService.RunCertificateGarbageCollector(
+			GarbageCollectorConfig{Interval: 10 * time.Millisecond, GracePeriod: 24 * time.Hour}, stopCh)
+		close(stopped)
+	}()
+
+	assert.Eventually(t, func() bool {
+		_, found := fakeWaf.Certificate("orphan-old")
+		return !found
+	}, time.Second, 10*time.Millisecond)
+	close(stopCh)
+	assert.Eventually(t, func() bool {
+		select {
+		case <-stopped:
+			return true
+		default:
+			return false
+		}
+	}, time.Second, 10*time.Millisecond)
+}
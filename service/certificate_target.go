@@ -0,0 +1,339 @@
+package service
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"github.com/thoas/go-funk"
+	apiv1 "k8s.io/api/core/v1"
+	"log"
+	"strings"
+)
+
+const (
+	targetsAnnotation = "waf-cert-uploader.iits.tech/targets"
+
+	// CertIdsAnnotation, the legacy certificate id annotations and UploadStatusAnnotation are written by the
+	// uploader itself.
+	CertIdsAnnotation      = "waf-cert-uploader.iits.tech/cert-ids"
+	CertWafIdAnnotation    = "waf-cert-uploader.iits.tech/cert-waf-id"
+	CertElbIdAnnotation    = "waf-cert-uploader.iits.tech/cert-elb-id"
+	UploadStatusAnnotation = "waf-cert-uploader.iits.tech/upload-status"
+)
+
+// legacyCertIdAnnotations were written before the certificate ids of all targets were kept in the cert-ids annotation,
+// they are still read for secrets that weren't uploaded since.
+var legacyCertIdAnnotations = map[TargetName]string{
+	TargetWaf: CertWafIdAnnotation,
+	TargetElb: CertElbIdAnnotation,
+}
+
+// WithoutUploaderAnnotations returns the annotations without the ones written by the uploader, so the patches of the
+// uploader aren't mistaken for changes of the secret.
+func WithoutUploaderAnnotations(annotations map[string]string) map[string]string {
+	filtered := map[string]string{}
+	for key, value := range annotations {
+		if key != CertIdsAnnotation && key != CertWafIdAnnotation && key != CertElbIdAnnotation &&
+			key != UploadStatusAnnotation {
+			filtered[key] = value
+		}
+	}
+	return filtered
+}
+
+// TargetName is the name of a certificate target in the targets and cert-ids annotations.
+type TargetName string
+
+const (
+	TargetWaf TargetName = "waf"
+	TargetElb TargetName = "elb"
+)
+
+// CertificateTarget is an otc service the certificates of secrets are uploaded to and bound to its resources,
+// e.g. the domains of the waf or the listeners of the elb. The steps are called by createOrUpdateCertificate.
+type CertificateTarget interface {
+	// FindCertificate returns the id of an uploaded certificate with the hash name of the secret, nil if there is none.
+	FindCertificate(certSecret CertificateSecret) (*string, error)
+	// PrepareBinding reads and checks the resources of the secret before anything is uploaded.
+	PrepareBinding(certSecret CertificateSecret, leafCertificate *x509.Certificate) (CertificateBinding, error)
+	UploadCertificate(certSecret CertificateSecret) (string, error)
+	// DeleteCertificate deletes the previous certificate of a secret, or a new one that couldn't be bound.
+	DeleteCertificate(certId string) error
+}
+
+// CertificateBinding binds a certificate to the resources read by CertificateTarget.PrepareBinding.
+type CertificateBinding interface {
+	// Bind binds the certificate to the resources that aren't bound to it yet.
+	Bind(certId string) error
+	// Restore binds the previous certificates to the resources changed by Bind again. It fails if a resource
+	// still uses the new certificate afterwards.
+	Restore() error
+	// Warnings returns the warnings about the resources, e.g. hostnames that aren't covered by the certificate.
+	Warnings() []string
+	// Attachments returns the result of every resource Bind attached the certificate to.
+	Attachments() []DomainAttachment
+}
+
+type selectedTarget struct {
+	name   TargetName
+	target CertificateTarget
+}
+
+// CertificateServices is the registry of the certificate targets. Each secret is uploaded to the targets of its
+// targets annotation, the waf target is the certificate service of the waf type of the secret.
+type CertificateServices struct {
+	Waf     map[WafType]*CertificateService
+	targets map[TargetName]CertificateTarget
+	options Options
+}
+
+func NewCertificateServices(waf map[WafType]*CertificateService, options Options) CertificateServices {
+	return CertificateServices{Waf: waf, options: options}
+}
+
+// RegisterTarget adds a target besides the waf, e.g. the elb.
+func (s *CertificateServices) RegisterTarget(name TargetName, target CertificateTarget) {
+	if s.targets == nil {
+		s.targets = map[TargetName]CertificateTarget{}
+	}
+	s.targets[name] = target
+}
+
+func (s CertificateServices) serviceOf(certSecret CertificateSecret) (*CertificateService, error) {
+	certificateService, found := s.Waf[certSecret.wafType]
+	if !found {
+		return nil, fmt.Errorf("%w: the %s waf is not configured", ErrInvalidConfiguration, certSecret.wafType)
+	}
+	return certificateService, nil
+}
+
+func (s CertificateServices) selectTargets(certSecret CertificateSecret) ([]selectedTarget, error) {
+	var targets []selectedTarget
+	for _, name := range certSecret.targets {
+		if name == TargetWaf {
+			certificateService, err := s.serviceOf(certSecret)
+			if err != nil {
+				return nil, err
+			}
+			targets = append(targets, selectedTarget{name: name, target: certificateService})
+			continue
+		}
+		target, found := s.targets[name]
+		if !found {
+			return nil, fmt.Errorf("%w: the %s target is not configured", ErrInvalidConfiguration, name)
+		}
+		targets = append(targets, selectedTarget{name: name, target: target})
+	}
+	return targets, nil
+}
+
+// CreateOrUpdateCertificate uploads the certificate to the targets of the secret in their order.
+func (s CertificateServices) CreateOrUpdateCertificate(secret apiv1.Secret) (*UploadResult, error) {
+	return createOrUpdateCertificate(secret, s.options, s.selectTargets)
+}
+
+// ValidateSecret runs the checks that don't need the waf and returns the warnings about the certificate.
+func (s CertificateServices) ValidateSecret(secret apiv1.Secret) ([]string, error) {
+	certSecret, err := getCertificateSecret(secret, s.options)
+	if err != nil {
+		return nil, err
+	}
+	if len(certSecret.wafDomainIds) == 0 && len(certSecret.wafDomainHostnames) == 0 && len(certSecret.elbListenerIds) == 0 {
+		return nil, fmt.Errorf(
+			"%w: the secret has neither a waf domain id, a waf domain hostname nor an elb listener id annotation",
+			ErrInvalidConfiguration)
+	}
+
+	leafCertificate, err := validateCertificate(certSecret)
+	if err != nil {
+		log.Println("the certificate is invalid", err)
+		return nil, err
+	}
+	return checkExpiry(leafCertificate, s.options.ExpiryWarningThreshold), nil
+}
+
+// createOrUpdateCertificate stops at the first target that fails, the targets before keep the new certificate
+// and find it by its hash on the next try.
+func createOrUpdateCertificate(
+	secret apiv1.Secret,
+	options Options,
+	selectTargets func(certSecret CertificateSecret) ([]selectedTarget, error)) (*UploadResult, error) {
+	certSecret, err := getCertificateSecret(secret, options)
+	if err != nil {
+		return nil, err
+	}
+
+	leafCertificate, err := validateCertificate(certSecret)
+	if err != nil {
+		log.Println("the certificate is invalid", err)
+		return nil, err
+	}
+
+	targets, err := selectTargets(certSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	uploadResult := &UploadResult{
+		CertIds:     map[TargetName]string{},
+		Attachments: map[TargetName][]DomainAttachment{},
+		Warnings:    checkExpiry(leafCertificate, options.ExpiryWarningThreshold),
+	}
+	for _, target := range targets {
+		certId, binding, err := uploadToTarget(target, certSecret, leafCertificate)
+		if err != nil {
+			return nil, err
+		}
+		uploadResult.CertIds[target.name] = certId
+		if attachments := binding.Attachments(); len(attachments) > 0 {
+			uploadResult.Attachments[target.name] = attachments
+		}
+		for _, warning := range binding.Warnings() {
+			if !funk.ContainsString(uploadResult.Warnings, warning) {
+				uploadResult.Warnings = append(uploadResult.Warnings, warning)
+			}
+		}
+	}
+	return uploadResult, nil
+}
+
+// uploadToTarget uploads the certificate unless the target has a certificate with the same hash already,
+// binds it to the resources of the secret and deletes the previous certificate of the secret afterwards.
+// A new certificate is deleted again and the resources are restored if the binding fails.
+func uploadToTarget(
+	target selectedTarget,
+	certSecret CertificateSecret,
+	leafCertificate *x509.Certificate) (string, CertificateBinding, error) {
+	log.Printf("trying to find the certificate in the %s...", target.name)
+	certId, err := target.target.FindCertificate(certSecret)
+	if err != nil {
+		return "", nil, err
+	}
+
+	binding, err := target.target.PrepareBinding(certSecret, leafCertificate)
+	if err != nil {
+		return "", nil, err
+	}
+
+	uploaded := false
+	if certId == nil {
+		log.Printf("the certificate does not exist in the %s yet...", target.name)
+		newCertId, err := target.target.UploadCertificate(certSecret)
+		if err != nil {
+			return "", nil, err
+		}
+		certId = &newCertId
+		uploaded = true
+	}
+
+	err = binding.Bind(*certId)
+	if err != nil {
+		if uploaded {
+			rollbackCertificateUpload(target, binding, *certId)
+		}
+		return "", nil, err
+	}
+
+	previousCertId := certSecret.certIds[target.name]
+	if len(previousCertId) > 0 && previousCertId != *certId {
+		deletePreviousCertificate(target, previousCertId)
+	}
+	return *certId, binding, nil
+}
+
+// rollbackCertificateUpload keeps the new certificate if a resource still uses it, it is found by its hash
+// and bound to the remaining resources on the next try.
+func rollbackCertificateUpload(target selectedTarget, binding CertificateBinding, certId string) {
+	log.Printf("rolling back the upload of %s certificate %s...", target.name, certId)
+	err := binding.Restore()
+	if err != nil {
+		log.Printf("uploaded %s certificate %s is kept because it is still in use: %v", target.name, certId, err)
+		return
+	}
+
+	err = target.target.DeleteCertificate(certId)
+	if err != nil {
+		log.Printf("uploaded %s certificate %s couldn't be deleted during rollback: %v", target.name, certId, err)
+	} else {
+		log.Printf("uploaded %s certificate %s was deleted during rollback", target.name, certId)
+	}
+}
+
+func deletePreviousCertificate(target selectedTarget, certId string) {
+	err := target.target.DeleteCertificate(certId)
+	if err != nil {
+		log.Printf("previous %s certificate couldn't be deleted: %v", target.name, err)
+	} else {
+		log.Printf("previous %s certificate with id %s was deleted successfully", target.name, certId)
+	}
+}
+
+// getTargets defaults to the waf and the elb if the secret has elb listeners, the waf is left out
+// if the secret only has elb listeners.
+func getTargets(secret apiv1.Secret) ([]TargetName, error) {
+	targetsValue, found := secret.Annotations[targetsAnnotation]
+	if !found {
+		hasWafDomains := len(parseAnnotationList(secret.Annotations["waf-cert-uploader.iits.tech/waf-domain-id"])) > 0 ||
+			len(parseAnnotationList(secret.Annotations["waf-cert-uploader.iits.tech/waf-domain-hostname"])) > 0
+		hasElbListeners := len(parseAnnotationList(secret.Annotations["waf-cert-uploader.iits.tech/elb-listener-id"])) > 0
+
+		var targets []TargetName
+		if hasWafDomains || !hasElbListeners {
+			targets = append(targets, TargetWaf)
+		}
+		if hasElbListeners {
+			targets = append(targets, TargetElb)
+		}
+		return targets, nil
+	}
+
+	var targets []TargetName
+	for _, name := range parseAnnotationList(strings.ToLower(targetsValue)) {
+		targets = append(targets, TargetName(name))
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("%w: the targets annotation is empty", ErrInvalidConfiguration)
+	}
+	return targets, nil
+}
+
+func hasTarget(targets []TargetName, name TargetName) bool {
+	for _, target := range targets {
+		if target == name {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCertIds falls back to the legacy annotation of a target that isn't in the cert-ids annotation.
+func parseCertIds(secret apiv1.Secret) (map[TargetName]string, error) {
+	certIds := map[TargetName]string{}
+	if certIdsValue, found := secret.Annotations[CertIdsAnnotation]; found {
+		var annotatedCertIds map[TargetName]string
+		err := json.Unmarshal([]byte(certIdsValue), &annotatedCertIds)
+		if err != nil {
+			log.Println("invalid cert ids annotation", err)
+			return nil, fmt.Errorf("%w: the cert ids annotation is not a json object: %w", ErrInvalidConfiguration, err)
+		}
+		for name, certId := range annotatedCertIds {
+			certIds[name] = certId
+		}
+	}
+
+	for name, annotation := range legacyCertIdAnnotations {
+		if _, found := certIds[name]; !found && len(secret.Annotations[annotation]) > 0 {
+			certIds[name] = secret.Annotations[annotation]
+		}
+	}
+	return certIds, nil
+}
+
+// FormatCertIds returns the value of the cert-ids annotation.
+func FormatCertIds(certIds map[TargetName]string) (string, error) {
+	certIdsJson, err := json.Marshal(certIds)
+	if err != nil {
+		return "", err
+	}
+	return string(certIdsJson), nil
+}
@@ -0,0 +1,204 @@
+package service
+
+import (
+	"crypto/x509"
+	"errors"
+	elbListener "github.com/opentelekomcloud/gophertelekomcloud/openstack/elb/v3/listeners"
+	wafDomain "github.com/opentelekomcloud/gophertelekomcloud/openstack/waf/v1/domains"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"testing"
+	"waf-cert-uploader/adapter"
+)
+
+// fakeTarget records the steps that are called, its binding fails if bindErr is set.
+type fakeTarget struct {
+	certId  *string
+	bindErr error
+	calls   []string
+}
+
+func (t *fakeTarget) FindCertificate(CertificateSecret) (*string, error) {
+	t.calls = append(t.calls, "FindCertificate")
+	return t.certId, nil
+}
+
+func (t *fakeTarget) PrepareBinding(CertificateSecret, *x509.Certificate) (CertificateBinding, error) {
+	t.calls = append(t.calls, "PrepareBinding")
+	return t, nil
+}
+
+func (t *fakeTarget) UploadCertificate(CertificateSecret) (string, error) {
+	t.calls = append(t.calls, "UploadCertificate")
+	return "new-id", nil
+}
+
+func (t *fakeTarget) DeleteCertificate(certId string) error {
+	t.calls = append(t.calls, "DeleteCertificate "+certId)
+	return nil
+}
+
+func (t *fakeTarget) Bind(certId string) error {
+	t.calls = append(t.calls, "Bind "+certId)
+	return t.bindErr
+}
+
+func (t *fakeTarget) Restore() error {
+	t.calls = append(t.calls, "Restore")
+	return nil
+}
+
+func (t *fakeTarget) Warnings() []string {
+	return nil
+}
+
+func (t *fakeTarget) Attachments() []DomainAttachment {
+	return nil
+}
+
+func getTargetTestSecret(testCert testCertificate, annotations map[string]string) apiv1.Secret {
+	return apiv1.Secret{
+		ObjectMeta: v1.ObjectMeta{Name: "my", Namespace: "waf", Annotations: annotations},
+		Data: map[string][]byte{
+			"tls.crt": testCert.certPem,
+			"tls.key": testCert.keyPem,
+		},
+	}
+}
+
+func TestCertificateServices_registeredTarget(t *testing.T) {
+	testCert := createTestLeafCertificate("my.domain.com")
+	cdn := &fakeTarget{}
+	certificateServices := NewCertificateServices(nil, DefaultOptions())
+	certificateServices.RegisterTarget("cdn", cdn)
+	secret := getTargetTestSecret(testCert, map[string]string{
+		"waf-cert-uploader.iits.tech/targets":  "cdn",
+		"waf-cert-uploader.iits.tech/cert-ids": `{"cdn":"previous-id"}`,
+	})
+
+	result, err := certificateServices.CreateOrUpdateCertificate(secret)
+
+	assert.Nil(t, err)
+	assert.Equal(t, map[TargetName]string{"cdn": "new-id"}, result.CertIds)
+	assert.Equal(t, []string{"FindCertificate", "PrepareBinding", "UploadCertificate", "Bind new-id",
+		"DeleteCertificate previous-id"}, cdn.calls)
+}
+
+func TestCertificateServices_rollbackOfRegisteredTarget(t *testing.T) {
+	testCert := createTestLeafCertificate("my.domain.com")
+	cdn := &fakeTarget{bindErr: errors.New("bind failed")}
+	certificateServices := NewCertificateServices(nil, DefaultOptions())
+	certificateServices.RegisterTarget("cdn", cdn)
+	secret := getTargetTestSecret(testCert, map[string]string{
+		"waf-cert-uploader.iits.tech/targets":  "cdn",
+		"waf-cert-uploader.iits.tech/cert-ids": `{"cdn":"previous-id"}`,
+	})
+
+	_, err := certificateServices.CreateOrUpdateCertificate(secret)
+
+	assert.Equal(t, "bind failed", err.Error())
+	assert.Equal(t, []string{"FindCertificate", "PrepareBinding", "UploadCertificate", "Bind new-id", "Restore",
+		"DeleteCertificate new-id"}, cdn.calls)
+}
+
+func TestCertificateServices_existingCertificateIsNotRolledBack(t *testing.T) {
+	testCert := createTestLeafCertificate("my.domain.com")
+	existingId := "existing-id"
+	cdn := &fakeTarget{certId: &existingId, bindErr: errors.New("bind failed")}
+	certificateServices := NewCertificateServices(nil, DefaultOptions())
+	certificateServices.RegisterTarget("cdn", cdn)
+
+	_, err := certificateServices.CreateOrUpdateCertificate(
+		getTargetTestSecret(testCert, map[string]string{"waf-cert-uploader.iits.tech/targets": "cdn"}))
+
+	assert.NotNil(t, err)
+	assert.Equal(t, []string{"FindCertificate", "PrepareBinding", "Bind existing-id"}, cdn.calls)
+}
+
+func TestCertificateServices_targetsAnnotation(t *testing.T) {
+	testCert := createTestLeafCertificate("my.domain.com")
+	cloudWaf := adapter.NewFakeWafCertificateManager()
+	cloudWaf.AddDomain(wafDomain.Domain{Id: "my-domain", HostName: "my.domain.com"})
+	fakeElb := adapter.NewFakeElbCertificateManager()
+	fakeElb.AddListener(elbListener.Listener{ID: "listener-1", Protocol: "HTTPS"})
+	certificateServices := NewCertificateServices(map[WafType]*CertificateService{
+		WafTypeCloud: NewCertificateService(cloudWaf, DefaultOptions()),
+	}, DefaultOptions())
+	certificateServices.RegisterTarget(TargetElb, NewElbCertificateService(fakeElb, DefaultOptions()))
+	secret := getTargetTestSecret(testCert, map[string]string{
+		"waf-cert-uploader.iits.tech/targets":         "elb",
+		"waf-cert-uploader.iits.tech/waf-domain-id":   "my-domain",
+		"waf-cert-uploader.iits.tech/elb-listener-id": "listener-1",
+	})
+
+	result, err := certificateServices.CreateOrUpdateCertificate(secret)
+
+	assert.Nil(t, err)
+	assert.Equal(t, map[TargetName]string{TargetElb: "elb-cert-1"}, result.CertIds)
+	assert.Empty(t, cloudWaf.Calls())
+}
+
+func TestCertificateServices_unknownTarget(t *testing.T) {
+	testCert := createTestLeafCertificate("my.domain.com")
+	cloudWaf := adapter.NewFakeWafCertificateManager()
+	certificateServices := NewCertificateServices(map[WafType]*CertificateService{
+		WafTypeCloud: NewCertificateService(cloudWaf, DefaultOptions()),
+	}, DefaultOptions())
+	secret := getTargetTestSecret(testCert, map[string]string{
+		"waf-cert-uploader.iits.tech/targets":       "waf, cdn",
+		"waf-cert-uploader.iits.tech/waf-domain-id": "my-domain",
+	})
+
+	_, err := certificateServices.CreateOrUpdateCertificate(secret)
+
+	assert.ErrorIs(t, err, ErrInvalidConfiguration)
+	assert.Equal(t, "invalid secret configuration: the cdn target is not configured", err.Error())
+	assert.Empty(t, cloudWaf.Calls())
+}
+
+func TestGetTargets(t *testing.T) {
+	targets, err := getTargets(apiv1.Secret{})
+	assert.Nil(t, err)
+	assert.Equal(t, []TargetName{TargetWaf}, targets)
+
+	targets, err = getTargets(apiv1.Secret{ObjectMeta: v1.ObjectMeta{Annotations: map[string]string{
+		"waf-cert-uploader.iits.tech/waf-domain-hostname": "my.domain.com",
+		"waf-cert-uploader.iits.tech/elb-listener-id":     "listener-1",
+	}}})
+	assert.Nil(t, err)
+	assert.Equal(t, []TargetName{TargetWaf, TargetElb}, targets)
+
+	targets, err = getTargets(apiv1.Secret{ObjectMeta: v1.ObjectMeta{Annotations: map[string]string{
+		"waf-cert-uploader.iits.tech/targets": "ELB, waf,elb",
+	}}})
+	assert.Nil(t, err)
+	assert.Equal(t, []TargetName{TargetElb, TargetWaf}, targets)
+
+	_, err = getTargets(apiv1.Secret{ObjectMeta: v1.ObjectMeta{Annotations: map[string]string{
+		"waf-cert-uploader.iits.tech/targets": " , ",
+	}}})
+	assert.ErrorIs(t, err, ErrInvalidConfiguration)
+}
+
+func TestParseCertIds(t *testing.T) {
+	certIds, err := parseCertIds(apiv1.Secret{ObjectMeta: v1.ObjectMeta{Annotations: map[string]string{
+		"waf-cert-uploader.iits.tech/cert-ids":    `{"waf":"waf-id"}`,
+		"waf-cert-uploader.iits.tech/cert-waf-id": "legacy-waf-id",
+		"waf-cert-uploader.iits.tech/cert-elb-id": "legacy-elb-id",
+	}}})
+	assert.Nil(t, err)
+	assert.Equal(t, map[TargetName]string{TargetWaf: "waf-id", TargetElb: "legacy-elb-id"}, certIds)
+
+	_, err = parseCertIds(apiv1.Secret{ObjectMeta: v1.ObjectMeta{Annotations: map[string]string{
+		"waf-cert-uploader.iits.tech/cert-ids": "waf-id",
+	}}})
+	assert.ErrorIs(t, err, ErrInvalidConfiguration)
+}
+
+func TestFormatCertIds(t *testing.T) {
+	certIds, err := FormatCertIds(map[TargetName]string{TargetWaf: "waf-id", TargetElb: "elb-id"})
+
+	assert.Nil(t, err)
+	assert.Equal(t, `{"elb":"elb-id","waf":"waf-id"}`, certIds)
+}
@@ -0,0 +1,228 @@
+package service
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNoCertificate          = errors.New("no certificate found in tls.crt")
+	ErrMalformedCertificate   = errors.New("certificate could not be parsed")
+	ErrMalformedPrivateKey    = errors.New("private key could not be parsed")
+	ErrKeyMismatch            = errors.New("private key does not match the certificate")
+	ErrCertificateExpired     = errors.New("certificate has expired")
+	ErrCertificateNotYetValid = errors.New("certificate is not valid yet")
+	ErrInvalidChainOrder      = errors.New("certificate chain is not in leaf to root order")
+	ErrHostnameMismatch       = errors.New("certificate does not cover the waf domain hostname")
+)
+
+type CertificateValidationError struct {
+	Reason error
+	Detail string
+}
+
+func (e *CertificateValidationError) Error() string {
+	if len(e.Detail) == 0 {
+		return "invalid certificate: " + e.Reason.Error()
+	}
+	return fmt.Sprintf("invalid certificate: %s: %s", e.Reason.Error(), e.Detail)
+}
+
+func (e *CertificateValidationError) Unwrap() error {
+	return e.Reason
+}
+
+var now = time.Now
+
+const DefaultExpiryWarningThreshold = 14 * 24 * time.Hour
+
+func validateCertificate(certSecret CertificateSecret) (*x509.Certificate, error) {
+	chain, err := parseCertificateChain([]byte(certSecret.tlsCert))
+	if err != nil {
+		return nil, err
+	}
+
+	privateKey, err := parsePrivateKey([]byte(certSecret.tlsKey))
+	if err != nil {
+		return nil, err
+	}
+
+	leaf := chain[0]
+	err = checkKeyPair(leaf, privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkValidityPeriods(chain)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkChainOrder(chain)
+	if err != nil {
+		return nil, err
+	}
+	return leaf, nil
+}
+
+func checkExpiry(leaf *x509.Certificate, threshold time.Duration) []string {
+	remaining := leaf.NotAfter.Sub(now())
+	if remaining > threshold {
+		return nil
+	}
+	warning := fmt.Sprintf("certificate %s expires in %d hours at %s",
+		leaf.Subject, int(remaining.Hours()), leaf.NotAfter.UTC().Format(time.RFC3339))
+	log.Println(warning)
+	return []string{warning}
+}
+
+func parseCertificateChain(certPem []byte) ([]*x509.Certificate, error) {
+	var chain []*x509.Certificate
+	rest := certPem
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, &CertificateValidationError{Reason: ErrMalformedCertificate, Detail: err.Error()}
+		}
+		chain = append(chain, certificate)
+	}
+
+	if len(chain) == 0 {
+		return nil, &CertificateValidationError{Reason: ErrNoCertificate}
+	}
+	return chain, nil
+}
+
+func parsePrivateKey(keyPem []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyPem)
+	if block == nil {
+		return nil, &CertificateValidationError{Reason: ErrMalformedPrivateKey, Detail: "no pem block found in tls.key"}
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, &CertificateValidationError{Reason: ErrMalformedPrivateKey, Detail: err.Error()}
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, &CertificateValidationError{Reason: ErrMalformedPrivateKey, Detail: "unsupported key type"}
+	}
+	return signer, nil
+}
+
+func checkKeyPair(leaf *x509.Certificate, privateKey crypto.Signer) error {
+	publicKey, ok := leaf.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !publicKey.Equal(privateKey.Public()) {
+		return &CertificateValidationError{Reason: ErrKeyMismatch}
+	}
+	return nil
+}
+
+func checkValidityPeriods(chain []*x509.Certificate) error {
+	currentTime := now()
+	for _, certificate := range chain {
+		if currentTime.Before(certificate.NotBefore) {
+			return &CertificateValidationError{
+				Reason: ErrCertificateNotYetValid,
+				Detail: fmt.Sprintf("%s is valid from %s", certificate.Subject, certificate.NotBefore),
+			}
+		}
+		if currentTime.After(certificate.NotAfter) {
+			return &CertificateValidationError{
+				Reason: ErrCertificateExpired,
+				Detail: fmt.Sprintf("%s expired at %s", certificate.Subject, certificate.NotAfter),
+			}
+		}
+	}
+	return nil
+}
+
+func checkChainOrder(chain []*x509.Certificate) error {
+	for i := 0; i < len(chain)-1; i++ {
+		err := chain[i].CheckSignatureFrom(chain[i+1])
+		if err != nil {
+			return &CertificateValidationError{
+				Reason: ErrInvalidChainOrder,
+				Detail: fmt.Sprintf("%s is not signed by %s", chain[i].Subject, chain[i+1].Subject),
+			}
+		}
+	}
+	return nil
+}
+
+type HostnameMismatchPolicy string
+
+const (
+	HostnameMismatchReject HostnameMismatchPolicy = "reject"
+	HostnameMismatchWarn   HostnameMismatchPolicy = "warn"
+	HostnameMismatchIgnore HostnameMismatchPolicy = "ignore"
+)
+
+// DefaultHostnameMismatchPolicy only warns, so secrets that were admitted before the check was added still are.
+const DefaultHostnameMismatchPolicy = HostnameMismatchWarn
+
+func ParseHostnameMismatchPolicy(value string) (HostnameMismatchPolicy, error) {
+	switch policy := HostnameMismatchPolicy(strings.ToLower(strings.TrimSpace(value))); policy {
+	case HostnameMismatchReject, HostnameMismatchWarn, HostnameMismatchIgnore:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown hostname mismatch policy %q", value)
+	}
+}
+
+func checkHostnameCoverage(
+	leaf *x509.Certificate,
+	hostname string,
+	policy HostnameMismatchPolicy) ([]string, error) {
+	if policy == HostnameMismatchIgnore || certificateCoversHostname(leaf, hostname) {
+		return nil, nil
+	}
+
+	mismatchError := &CertificateValidationError{
+		Reason: ErrHostnameMismatch,
+		Detail: fmt.Sprintf("waf domain %s is not covered by %v", hostname, leaf.DNSNames),
+	}
+	if policy == HostnameMismatchWarn {
+		log.Println(mismatchError)
+		return []string{mismatchError.Error()}, nil
+	}
+	return nil, mismatchError
+}
+
+func certificateCoversHostname(leaf *x509.Certificate, hostname string) bool {
+	hostname = strings.ToLower(strings.TrimSuffix(hostname, "."))
+	for _, dnsName := range leaf.DNSNames {
+		dnsName = strings.ToLower(strings.TrimSuffix(dnsName, "."))
+		if dnsName == hostname {
+			return true
+		}
+		if !strings.HasPrefix(dnsName, "*.") || strings.HasPrefix(hostname, "*.") {
+			continue
+		}
+		labelEnd := strings.Index(hostname, ".")
+		if labelEnd > 0 && hostname[labelEnd:] == dnsName[1:] {
+			return true
+		}
+	}
+	return false
+}
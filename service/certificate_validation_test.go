@@ -0,0 +1,197 @@
+package service
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"testing"
+	"time"
+)
+
+type testCertificate struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	certPem     []byte
+	keyPem      []byte
+}
+
+func createTestCertificate(template *x509.Certificate, parent *testCertificate) testCertificate {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if template.SerialNumber == nil {
+		template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	}
+	if template.NotBefore.IsZero() {
+		template.NotBefore = time.Now().Add(-time.Hour)
+	}
+	if template.NotAfter.IsZero() {
+		template.NotAfter = time.Now().Add(90 * 24 * time.Hour)
+	}
+
+	parentCertificate, parentKey := template, key
+	if parent != nil {
+		parentCertificate, parentKey = parent.certificate, parent.key
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, parentCertificate, &key.PublicKey, parentKey)
+	certificate, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+
+	return testCertificate{
+		certificate: certificate,
+		key:         key,
+		certPem:     pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPem:      pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+	}
+}
+
+func createTestLeafCertificate(dnsNames ...string) testCertificate {
+	return createTestCertificate(&x509.Certificate{
+		Subject:  pkix.Name{CommonName: "leaf"},
+		DNSNames: dnsNames,
+	}, nil)
+}
+
+func createTestChain() (leaf testCertificate, intermediate testCertificate) {
+	root := createTestCertificate(&x509.Certificate{
+		Subject:               pkix.Name{CommonName: "root"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	intermediate = createTestCertificate(&x509.Certificate{
+		Subject:               pkix.Name{CommonName: "intermediate"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, &root)
+	leaf = createTestCertificate(&x509.Certificate{
+		Subject:  pkix.Name{CommonName: "leaf"},
+		DNSNames: []string{"my.domain.com"},
+	}, &intermediate)
+	return leaf, intermediate
+}
+
+func TestValidateCertificate(t *testing.T) {
+	leaf, intermediate := createTestChain()
+	chainPem := string(leaf.certPem) + string(intermediate.certPem)
+
+	result, err := validateCertificate(CertificateSecret{tlsCert: chainPem, tlsKey: string(leaf.keyPem)})
+
+	assert.Nil(t, err)
+	assert.Equal(t, "leaf", result.Subject.CommonName)
+}
+
+func TestValidateCertificate_noCertificate(t *testing.T) {
+	_, err := validateCertificate(CertificateSecret{tlsCert: "any cert", tlsKey: "any private key"})
+
+	var validationError *CertificateValidationError
+	assert.True(t, errors.As(err, &validationError))
+	assert.ErrorIs(t, err, ErrNoCertificate)
+}
+
+func TestValidateCertificate_malformedKey(t *testing.T) {
+	leaf := createTestLeafCertificate("my.domain.com")
+
+	_, err := validateCertificate(CertificateSecret{tlsCert: string(leaf.certPem), tlsKey: "any private key"})
+
+	assert.ErrorIs(t, err, ErrMalformedPrivateKey)
+}
+
+func TestValidateCertificate_keyMismatch(t *testing.T) {
+	leaf := createTestLeafCertificate("my.domain.com")
+	other := createTestLeafCertificate("my.domain.com")
+
+	_, err := validateCertificate(CertificateSecret{tlsCert: string(leaf.certPem), tlsKey: string(other.keyPem)})
+
+	assert.ErrorIs(t, err, ErrKeyMismatch)
+}
+
+func TestValidateCertificate_expired(t *testing.T) {
+	leaf := createTestCertificate(&x509.Certificate{
+		Subject:   pkix.Name{CommonName: "leaf"},
+		NotBefore: time.Now().Add(-48 * time.Hour),
+		NotAfter:  time.Now().Add(-24 * time.Hour),
+	}, nil)
+
+	_, err := validateCertificate(CertificateSecret{tlsCert: string(leaf.certPem), tlsKey: string(leaf.keyPem)})
+
+	assert.ErrorIs(t, err, ErrCertificateExpired)
+}
+
+func TestCheckExpiry(t *testing.T) {
+	expiringSoon := createTestCertificate(&x509.Certificate{
+		Subject:  pkix.Name{CommonName: "leaf"},
+		NotAfter: time.Now().Add(3 * 24 * time.Hour),
+	}, nil)
+	longLived := createTestLeafCertificate()
+
+	warnings := checkExpiry(expiringSoon.certificate, DefaultExpiryWarningThreshold)
+
+	assert.Len(t, warnings, 1)
+	assert.Contains(t, warnings[0], "CN=leaf expires in")
+	assert.Empty(t, checkExpiry(longLived.certificate, DefaultExpiryWarningThreshold))
+	assert.Empty(t, checkExpiry(expiringSoon.certificate, 24*time.Hour))
+}
+
+func TestValidateCertificate_notYetValid(t *testing.T) {
+	leaf := createTestCertificate(&x509.Certificate{
+		Subject:   pkix.Name{CommonName: "leaf"},
+		NotBefore: time.Now().Add(24 * time.Hour),
+		NotAfter:  time.Now().Add(48 * time.Hour),
+	}, nil)
+
+	_, err := validateCertificate(CertificateSecret{tlsCert: string(leaf.certPem), tlsKey: string(leaf.keyPem)})
+
+	assert.ErrorIs(t, err, ErrCertificateNotYetValid)
+}
+
+func TestValidateCertificate_wrongChainOrder(t *testing.T) {
+	leaf, intermediate := createTestChain()
+	chainPem := string(intermediate.certPem) + string(leaf.certPem)
+
+	_, err := validateCertificate(CertificateSecret{tlsCert: chainPem, tlsKey: string(intermediate.keyPem)})
+
+	assert.ErrorIs(t, err, ErrInvalidChainOrder)
+}
+
+func TestCertificateCoversHostname(t *testing.T) {
+	leaf := createTestLeafCertificate("my.domain.com", "*.apps.domain.com")
+
+	assert.True(t, certificateCoversHostname(leaf.certificate, "my.domain.com"))
+	assert.True(t, certificateCoversHostname(leaf.certificate, "MY.domain.com."))
+	assert.True(t, certificateCoversHostname(leaf.certificate, "shop.apps.domain.com"))
+	assert.False(t, certificateCoversHostname(leaf.certificate, "apps.domain.com"))
+	assert.False(t, certificateCoversHostname(leaf.certificate, "a.shop.apps.domain.com"))
+	assert.False(t, certificateCoversHostname(leaf.certificate, "*.domain.com"))
+	assert.True(t, certificateCoversHostname(leaf.certificate, "*.apps.domain.com"))
+}
+
+func TestCheckHostnameCoverage_policies(t *testing.T) {
+	leaf := createTestLeafCertificate("my.domain.com")
+
+	warnings, err := checkHostnameCoverage(leaf.certificate, "other.domain.com", HostnameMismatchReject)
+	assert.ErrorIs(t, err, ErrHostnameMismatch)
+	assert.Empty(t, warnings)
+
+	warnings, err = checkHostnameCoverage(leaf.certificate, "other.domain.com", HostnameMismatchWarn)
+	assert.Nil(t, err)
+	assert.Len(t, warnings, 1)
+
+	warnings, err = checkHostnameCoverage(leaf.certificate, "other.domain.com", HostnameMismatchIgnore)
+	assert.Nil(t, err)
+	assert.Empty(t, warnings)
+}
+
+func TestParseHostnameMismatchPolicy(t *testing.T) {
+	policy, err := ParseHostnameMismatchPolicy(" Warn ")
+	assert.Nil(t, err)
+	assert.Equal(t, HostnameMismatchWarn, policy)
+
+	_, err = ParseHostnameMismatchPolicy("sometimes")
+	assert.Equal(t, `unknown hostname mismatch policy "sometimes"`, err.Error())
+}
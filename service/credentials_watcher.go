@@ -0,0 +1,208 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	golangsdk "github.com/opentelekomcloud/gophertelekomcloud"
+	"github.com/opentelekomcloud/gophertelekomcloud/openstack"
+	"github.com/opentelekomcloud/gophertelekomcloud/openstack/identity/v3/tokens"
+	"log"
+	"os"
+	"time"
+	"waf-cert-uploader/adapter"
+)
+
+// kubernetesDataDir is the symlink to the directory with the current files of a mounted secret. Kubernetes writes
+// the files of an updated secret to a new directory and swaps the symlink to it atomically.
+const kubernetesDataDir = "..data"
+
+// DefaultCredentialsReloadInterval is how often the credentials mount path is checked for changes.
+const DefaultCredentialsReloadInterval = 30 * time.Second
+
+// AgencyTokenRefreshMargin is how long before the token of an agency expires the clients of credentials delegated
+// to the agency are rebuilt, the sdk can't reauthenticate the token.
+const AgencyTokenRefreshMargin = time.Hour
+
+// AgencyTokenRefreshInterval is how long the clients of an agency are used if the expiry of its token can't be read.
+// The token of an agency expires after 24 hours.
+const AgencyTokenRefreshInterval = 23 * time.Hour
+
+var getTokenExpiry = readTokenExpiry
+
+// readTokenExpiry asks the iam for the expiry of the token of the provider client, the sdk doesn't keep it.
+func readTokenExpiry(provider *golangsdk.ProviderClient) (time.Time, error) {
+	identityClient, err := openstack.NewIdentityV3(provider, golangsdk.EndpointOpts{})
+	if err != nil {
+		return time.Time{}, err
+	}
+	token, err := tokens.Get(identityClient, provider.Token()).ExtractToken()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return token.ExpiresAt, nil
+}
+
+// CredentialsWatcher rebuilds the provider client and the otc clients of the certificate services when the mounted
+// credentials change, so a rotated password or ak/sk is used without restarting the pod. The clients are swapped
+// atomically, calls that already started finish on the previous clients.
+type CredentialsWatcher struct {
+	otcOptions     OtcOptions
+	defaultWafType WafType
+	version        string
+	wafManagers    map[WafType]*adapter.SwappableWafCertificateManager
+	elbManager     *adapter.SwappableElbCertificateManager
+	// refreshAt is when the clients are rebuilt even if the credentials didn't change, zero if they never expire
+	refreshAt time.Time
+	now       func() time.Time
+}
+
+func newCredentialsWatcher(
+	otcOptions OtcOptions,
+	defaultWafType WafType,
+	version string,
+	managers otcCertificateManagers,
+	provider *golangsdk.ProviderClient,
+	authOptions OtcAuthOptionsSecret) *CredentialsWatcher {
+	watcher := &CredentialsWatcher{
+		otcOptions:     otcOptions,
+		defaultWafType: defaultWafType,
+		version:        version,
+		wafManagers:    map[WafType]*adapter.SwappableWafCertificateManager{},
+		now:            time.Now,
+	}
+	watcher.scheduleRefresh(provider, authOptions)
+	for wafType, manager := range managers.waf {
+		watcher.wafManagers[wafType] = adapter.NewSwappableWafCertificateManager(manager)
+	}
+	if managers.elb != nil {
+		watcher.elbManager = adapter.NewSwappableElbCertificateManager(managers.elb)
+	}
+	return watcher
+}
+
+func (w *CredentialsWatcher) swappableManagers() otcCertificateManagers {
+	managers := otcCertificateManagers{waf: map[WafType]adapter.WafCertificateManager{}}
+	for wafType, manager := range w.wafManagers {
+		managers.waf[wafType] = manager
+	}
+	if w.elbManager != nil {
+		managers.elb = w.elbManager
+	}
+	return managers
+}
+
+func (w *CredentialsWatcher) Run(interval time.Duration, stopCh <-chan struct{}) {
+	log.Printf("checking the otc credentials for changes every %s", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			_, err := w.ReloadIfChanged()
+			if err != nil {
+				log.Println("reloading the otc credentials failed, keeping the previous otc clients", err)
+			}
+		}
+	}
+}
+
+// ReloadIfChanged rebuilds the otc clients if the credentials changed or the token of the agency is about to expire
+// and tells whether they were rebuilt. The version and the auth options of the credentials are only kept once the
+// new clients are swapped in, so credentials that can't be used yet are tried again on the next check and don't
+// change the refresh of the previous clients. A waf that wasn't available at startup isn't added, the certificate
+// services are only created once.
+func (w *CredentialsWatcher) ReloadIfChanged() (bool, error) {
+	version, err := credentialsVersion(w.otcOptions.CredentialsMountPath)
+	if err != nil {
+		return false, err
+	}
+	refreshDue := !w.refreshAt.IsZero() && !w.now().Before(w.refreshAt)
+	if version == w.version && !refreshDue {
+		return false, nil
+	}
+
+	if version == w.version {
+		log.Println("the token of the agency expires soon, rebuilding the otc clients...")
+	} else {
+		log.Println("the otc credentials changed, rebuilding the otc clients...")
+	}
+	provider, authOptions, err := createProviderClient(w.otcOptions)
+	if err != nil {
+		return false, err
+	}
+	managers, err := createOtcCertificateManagers(provider, authOptions.region, w.defaultWafType)
+	if err != nil {
+		return false, err
+	}
+
+	for wafType, swappableManager := range w.wafManagers {
+		manager, found := managers.waf[wafType]
+		if !found {
+			log.Printf("the %s waf is not available with the new credentials, keeping its previous client", wafType)
+			continue
+		}
+		swappableManager.Swap(manager)
+	}
+	for wafType := range managers.waf {
+		if _, found := w.wafManagers[wafType]; !found {
+			log.Printf("the %s waf is available with the new credentials, but only used after a restart", wafType)
+		}
+	}
+	if w.elbManager != nil && managers.elb != nil {
+		w.elbManager.Swap(managers.elb)
+	} else if w.elbManager == nil && managers.elb != nil {
+		log.Println("the elb is available with the new credentials, but only used after a restart")
+	}
+	w.version = version
+	w.scheduleRefresh(provider, authOptions)
+	log.Println("the otc clients were rebuilt")
+	return true, nil
+}
+
+// scheduleRefresh is called with the provider client and the auth options of the clients that are used from now on.
+// A token that expires within twice the margin is refreshed after half of its remaining lifetime.
+func (w *CredentialsWatcher) scheduleRefresh(provider *golangsdk.ProviderClient, authOptions OtcAuthOptionsSecret) {
+	w.refreshAt = time.Time{}
+	if !authOptions.hasAgency() {
+		return
+	}
+
+	now := w.now()
+	expiresAt, err := getTokenExpiry(provider)
+	if err != nil {
+		log.Println("couldn't read the expiry of the token of the agency", err)
+		w.refreshAt = now.Add(AgencyTokenRefreshInterval)
+	} else if lifetime := expiresAt.Sub(now); lifetime < 2*AgencyTokenRefreshMargin {
+		w.refreshAt = now.Add(lifetime / 2)
+	} else {
+		w.refreshAt = expiresAt.Add(-AgencyTokenRefreshMargin)
+	}
+	log.Printf("the token of the agency is refreshed at %s", w.refreshAt.Format(time.RFC3339))
+}
+
+// credentialsVersion is the target of the ..data symlink of a secret mounted by Kubernetes,
+// the files of other credentials mount paths are versioned by their content. The static credentials don't change.
+func credentialsVersion(credentialsMountPath string) (string, error) {
+	if len(credentialsMountPath) == 0 {
+		return "", nil
+	}
+	dataDir, err := os.Readlink(credentialsMountPath + kubernetesDataDir)
+	if err == nil {
+		return dataDir, nil
+	}
+
+	credentials, err := readCredentialsFiles(credentialsMountPath)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	for _, file := range credentialsFiles {
+		hash.Write([]byte(file))
+		hash.Write([]byte{0})
+		hash.Write([]byte(credentials[file]))
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,304 @@
+package service
+
+import (
+	"errors"
+	golangsdk "github.com/opentelekomcloud/gophertelekomcloud"
+	"github.com/opentelekomcloud/gophertelekomcloud/openstack"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"waf-cert-uploader/adapter"
+	"waf-cert-uploader/adapter/otctest"
+)
+
+// userTransport records the user of the provider client of each request.
+type userTransport struct {
+	user     string
+	requests *[]string
+	next     http.RoundTripper
+}
+
+func (t userTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	*t.requests = append(*t.requests, t.user+" "+request.URL.Path)
+	return t.next.RoundTrip(request)
+}
+
+func requestsOf(user string, requests []string) []string {
+	var userRequests []string
+	for _, request := range requests {
+		if strings.HasPrefix(request, user+" ") {
+			userRequests = append(userRequests, request)
+		}
+	}
+	return userRequests
+}
+
+// writeMountedCredentials writes the credentials like Kubernetes updates a mounted secret, into a new directory
+// the ..data symlink is swapped to.
+func writeMountedCredentials(t *testing.T, mountPath string, version string, username string) {
+	dataDir := "..2024_01_01_00_00_00." + version
+	assert.Nil(t, os.Mkdir(filepath.Join(mountPath, dataDir), 0755))
+	files := map[string]string{
+		"username":       username,
+		"password":       "password",
+		"accessKey":      "",
+		"secretKey":      "",
+		"otcAccountName": "account",
+		"projectName":    otctest.ProjectName,
+	}
+	for file, content := range files {
+		assert.Nil(t, os.WriteFile(filepath.Join(mountPath, dataDir, file), []byte(content), 0644))
+		_ = os.Symlink(filepath.Join(kubernetesDataDir, file), filepath.Join(mountPath, file))
+	}
+	assert.Nil(t, os.Symlink(dataDir, filepath.Join(mountPath, "..data_tmp")))
+	assert.Nil(t, os.Rename(filepath.Join(mountPath, "..data_tmp"), filepath.Join(mountPath, kubernetesDataDir)))
+}
+
+func setupCredentialsWatcherTest(t *testing.T) (string, *otctest.OtcServer, *[]string) {
+	server := otctest.NewServer()
+	t.Cleanup(server.Close)
+	mountPath := t.TempDir() + "/"
+
+	var requests []string
+	loadCredentials = readCredentials
+	getProviderClient = func(authOpts golangsdk.AuthOptionsProvider, _ OtcEndpoints) (*golangsdk.ProviderClient, error) {
+		passwordAuthOpts := authOpts.(golangsdk.AuthOptions)
+		passwordAuthOpts.IdentityEndpoint = server.IdentityEndpoint()
+		provider, err := openstack.AuthenticatedClient(passwordAuthOpts)
+		if err != nil {
+			return nil, err
+		}
+		provider.HTTPClient.Transport = userTransport{
+			user: passwordAuthOpts.Username, requests: &requests, next: http.DefaultTransport}
+		return provider, nil
+	}
+	newWafV1 = func(provider *golangsdk.ProviderClient, opts golangsdk.EndpointOpts) (*golangsdk.ServiceClient, error) {
+		return openstack.NewWAFV1(provider, opts)
+	}
+	newWafdV1 = func(provider *golangsdk.ProviderClient, opts golangsdk.EndpointOpts) (*golangsdk.ServiceClient, error) {
+		return openstack.NewWAFDV1(provider, opts)
+	}
+	newElbV3 = func(provider *golangsdk.ProviderClient, opts golangsdk.EndpointOpts) (*golangsdk.ServiceClient, error) {
+		return openstack.NewELBV3(provider, opts)
+	}
+	return mountPath, server, &requests
+}
+
+func TestCredentialsWatcher_reloadsChangedCredentials(t *testing.T) {
+	mountPath, _, requests := setupCredentialsWatcherTest(t)
+	writeMountedCredentials(t, mountPath, "1", "user-1")
+
+	certificateServices, credentialsWatcher, err := NewOtcCertificateServices(
+		OtcOptions{CredentialsMountPath: mountPath}, adapter.DefaultRetryPolicy, DefaultOptions())
+	assert.Nil(t, err)
+
+	reloaded, err := credentialsWatcher.ReloadIfChanged()
+	assert.Nil(t, err)
+	assert.False(t, reloaded)
+
+	writeMountedCredentials(t, mountPath, "2", "user-2")
+	reloaded, err = credentialsWatcher.ReloadIfChanged()
+	assert.Nil(t, err)
+	assert.True(t, reloaded)
+
+	_, err = certificateServices.Waf[WafTypeCloud].waf.ListCertificates()
+	assert.Nil(t, err)
+	_, err = certificateServices.Waf[WafTypeDedicated].waf.ListCertificates()
+	assert.Nil(t, err)
+	_, err = certificateServices.targets[TargetElb].(*ElbCertificateService).elb.ListCertificates()
+	assert.Nil(t, err)
+	assert.Contains(t, *requests, "user-2 /v1/project-id/waf/certificate")
+	assert.Contains(t, *requests, "user-2 /dedicated/v1/project-id/waf/certificate")
+	assert.Contains(t, *requests, "user-2 /elb/v3/project-id/elb/certificates")
+	assert.Empty(t, requestsOf("user-1", *requests))
+}
+
+func TestCredentialsWatcher_keepsClientsIfReloadFails(t *testing.T) {
+	mountPath, server, requests := setupCredentialsWatcherTest(t)
+	writeMountedCredentials(t, mountPath, "1", "user-1")
+
+	certificateServices, credentialsWatcher, err := NewOtcCertificateServices(
+		OtcOptions{CredentialsMountPath: mountPath}, adapter.DefaultRetryPolicy, DefaultOptions())
+	assert.Nil(t, err)
+
+	writeMountedCredentials(t, mountPath, "2", "user-2")
+	server.FailNext("create_token", http.StatusUnauthorized)
+	reloaded, err := credentialsWatcher.ReloadIfChanged()
+	assert.NotNil(t, err)
+	assert.False(t, reloaded)
+
+	_, err = certificateServices.Waf[WafTypeCloud].waf.ListCertificates()
+	assert.Nil(t, err)
+	assert.Contains(t, *requests, "user-1 /v1/project-id/waf/certificate")
+	assert.Empty(t, requestsOf("user-2", *requests))
+
+	reloaded, err = credentialsWatcher.ReloadIfChanged()
+	assert.Nil(t, err)
+	assert.True(t, reloaded)
+}
+
+func TestCredentialsVersion_withoutDataSymlink(t *testing.T) {
+	mountPath := t.TempDir() + "/"
+	for _, file := range credentialsFiles {
+		assert.Nil(t, os.WriteFile(mountPath+file, []byte(file), 0644))
+	}
+
+	version, err := credentialsVersion(mountPath)
+	assert.Nil(t, err)
+	unchangedVersion, err := credentialsVersion(mountPath)
+	assert.Nil(t, err)
+	assert.Equal(t, version, unchangedVersion)
+
+	assert.Nil(t, os.WriteFile(mountPath+"password", []byte("rotated"), 0644))
+	changedVersion, err := credentialsVersion(mountPath)
+	assert.Nil(t, err)
+	assert.NotEqual(t, version, changedVersion)
+}
+
+func TestCredentialsWatcher_refreshesTheTokenOfTheAgency(t *testing.T) {
+	otcOptions := writeCredentialsFiles(t, map[string]string{
+		"username":         "Robin",
+		"password":         "abc123",
+		"otcAccountName":   "OTC-EU-DE-00000001",
+		"projectName":      "eu-de_project",
+		"agencyName":       "waf-cert-uploader",
+		"agencyDomainName": "OTC-EU-DE-00000000",
+	})
+	providerClients := 0
+	loadCredentials = readCredentials
+	getProviderClient = func(authOpts golangsdk.AuthOptionsProvider, _ OtcEndpoints) (*golangsdk.ProviderClient, error) {
+		providerClients++
+		return &golangsdk.ProviderClient{}, nil
+	}
+	tokenExpiresAt := time.Now().Add(24 * time.Hour)
+	setTokenExpiry(t, func(*golangsdk.ProviderClient) (time.Time, error) {
+		return tokenExpiresAt, nil
+	})
+	newWafV1 = func(provider *golangsdk.ProviderClient, opts golangsdk.EndpointOpts) (*golangsdk.ServiceClient, error) {
+		return &golangsdk.ServiceClient{}, nil
+	}
+	newWafdV1 = func(provider *golangsdk.ProviderClient, opts golangsdk.EndpointOpts) (*golangsdk.ServiceClient, error) {
+		return nil, errors.New("no dedicated waf endpoint")
+	}
+	newElbV3 = func(provider *golangsdk.ProviderClient, opts golangsdk.EndpointOpts) (*golangsdk.ServiceClient, error) {
+		return nil, errors.New("no elb endpoint")
+	}
+	_, credentialsWatcher, err := NewOtcCertificateServices(otcOptions, adapter.DefaultRetryPolicy, DefaultOptions())
+	assert.Nil(t, err)
+	assert.Equal(t, tokenExpiresAt.Add(-AgencyTokenRefreshMargin), credentialsWatcher.refreshAt)
+	currentTime := credentialsWatcher.refreshAt.Add(-time.Minute)
+	credentialsWatcher.now = func() time.Time { return currentTime }
+
+	reloaded, err := credentialsWatcher.ReloadIfChanged()
+	assert.Nil(t, err)
+	assert.False(t, reloaded)
+
+	currentTime = currentTime.Add(time.Minute)
+	reloaded, err = credentialsWatcher.ReloadIfChanged()
+	assert.Nil(t, err)
+	assert.True(t, reloaded)
+	assert.Equal(t, 2, providerClients)
+	assert.Equal(t, currentTime.Add(AgencyTokenRefreshMargin/2), credentialsWatcher.refreshAt)
+}
+
+func setTokenExpiry(t *testing.T, tokenExpiry func(*golangsdk.ProviderClient) (time.Time, error)) {
+	getTokenExpiry = tokenExpiry
+	t.Cleanup(func() { getTokenExpiry = readTokenExpiry })
+}
+
+func TestCredentialsWatcher_scheduleRefresh(t *testing.T) {
+	currentTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	watcher := &CredentialsWatcher{now: func() time.Time { return currentTime }}
+	agency := OtcAuthOptionsSecret{agencyName: "waf-cert-uploader"}
+
+	watcher.scheduleRefresh(&golangsdk.ProviderClient{}, OtcAuthOptionsSecret{})
+	assert.True(t, watcher.refreshAt.IsZero())
+
+	setTokenExpiry(t, func(*golangsdk.ProviderClient) (time.Time, error) {
+		return currentTime.Add(12 * time.Hour), nil
+	})
+	watcher.scheduleRefresh(&golangsdk.ProviderClient{}, agency)
+	assert.Equal(t, currentTime.Add(11*time.Hour), watcher.refreshAt)
+
+	setTokenExpiry(t, func(*golangsdk.ProviderClient) (time.Time, error) {
+		return currentTime.Add(30 * time.Minute), nil
+	})
+	watcher.scheduleRefresh(&golangsdk.ProviderClient{}, agency)
+	assert.Equal(t, currentTime.Add(15*time.Minute), watcher.refreshAt)
+
+	setTokenExpiry(t, func(*golangsdk.ProviderClient) (time.Time, error) {
+		return time.Time{}, golangsdk.ErrDefault401{}
+	})
+	watcher.scheduleRefresh(&golangsdk.ProviderClient{}, agency)
+	assert.Equal(t, currentTime.Add(AgencyTokenRefreshInterval), watcher.refreshAt)
+}
+
+func TestReadTokenExpiry(t *testing.T) {
+	server := otctest.NewServer()
+	t.Cleanup(server.Close)
+	provider, err := server.NewProviderClient()
+	assert.Nil(t, err)
+
+	expiresAt, err := readTokenExpiry(provider)
+
+	assert.Nil(t, err)
+	assert.True(t, server.TokenExpiresAt().Equal(expiresAt))
+	assert.Equal(t, []string{"create_token", "get_token"}, server.Calls())
+}
+
+func TestCredentialsWatcher_failedReloadKeepsTheRefreshOfThePreviousClients(t *testing.T) {
+	otcOptions := writeCredentialsFiles(t, map[string]string{
+		"username":         "Robin",
+		"password":         "abc123",
+		"otcAccountName":   "OTC-EU-DE-00000001",
+		"projectName":      "eu-de_project",
+		"agencyName":       "waf-cert-uploader",
+		"agencyDomainName": "OTC-EU-DE-00000000",
+	})
+	var regions []string
+	setTokenExpiry(t, func(*golangsdk.ProviderClient) (time.Time, error) {
+		return time.Now().Add(24 * time.Hour), nil
+	})
+	loadCredentials = readCredentials
+	getProviderClient = func(authOpts golangsdk.AuthOptionsProvider, _ OtcEndpoints) (*golangsdk.ProviderClient, error) {
+		if authOpts.(golangsdk.AuthOptions).Password == "wrong" {
+			return nil, golangsdk.ErrDefault401{}
+		}
+		return &golangsdk.ProviderClient{}, nil
+	}
+	newWafV1 = func(provider *golangsdk.ProviderClient, opts golangsdk.EndpointOpts) (*golangsdk.ServiceClient, error) {
+		regions = append(regions, opts.Region)
+		return &golangsdk.ServiceClient{}, nil
+	}
+	newWafdV1 = func(provider *golangsdk.ProviderClient, opts golangsdk.EndpointOpts) (*golangsdk.ServiceClient, error) {
+		return nil, errors.New("no dedicated waf endpoint")
+	}
+	newElbV3 = func(provider *golangsdk.ProviderClient, opts golangsdk.EndpointOpts) (*golangsdk.ServiceClient, error) {
+		return nil, errors.New("no elb endpoint")
+	}
+	_, credentialsWatcher, err := NewOtcCertificateServices(otcOptions, adapter.DefaultRetryPolicy, DefaultOptions())
+	assert.Nil(t, err)
+	refreshAt := credentialsWatcher.refreshAt
+	assert.False(t, refreshAt.IsZero())
+
+	mountPath := otcOptions.CredentialsMountPath
+	assert.Nil(t, os.Remove(mountPath+"agencyName"))
+	assert.Nil(t, os.Remove(mountPath+"agencyDomainName"))
+	assert.Nil(t, os.WriteFile(mountPath+"projectName", []byte("eu-ch2_project"), 0644))
+	assert.Nil(t, os.WriteFile(mountPath+"password", []byte("wrong"), 0644))
+	reloaded, err := credentialsWatcher.ReloadIfChanged()
+	assert.False(t, reloaded)
+	assert.NotNil(t, err)
+	assert.Equal(t, refreshAt, credentialsWatcher.refreshAt)
+
+	assert.Nil(t, os.WriteFile(mountPath+"password", []byte("rotated"), 0644))
+	reloaded, err = credentialsWatcher.ReloadIfChanged()
+	assert.True(t, reloaded)
+	assert.Nil(t, err)
+	assert.True(t, credentialsWatcher.refreshAt.IsZero())
+	assert.Equal(t, []string{"eu-de", "eu-ch2"}, regions)
+}
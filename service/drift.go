@@ -0,0 +1,169 @@
+package service
+
+import (
+	"fmt"
+	apiv1 "k8s.io/api/core/v1"
+	"log"
+)
+
+type DriftKind string
+
+const (
+	DriftCertificateMissing DriftKind = "certificate-missing"
+	DriftAnnotationMismatch DriftKind = "annotation-mismatch"
+	DriftDomainMismatch     DriftKind = "domain-mismatch"
+	// DriftDetectionFailed is reported for a managed secret that couldn't be compared with the waf, e.g. because
+	// its annotations are invalid, so it isn't mistaken for a secret without drift.
+	DriftDetectionFailed DriftKind = "detection-failed"
+)
+
+// DriftKinds are all kinds of drift, e.g. to reset their metrics.
+var DriftKinds = []DriftKind{DriftCertificateMissing, DriftAnnotationMismatch, DriftDomainMismatch, DriftDetectionFailed}
+
+type Drift struct {
+	Kind     DriftKind
+	DomainId string
+	Expected string
+	Actual   string
+}
+
+func (d Drift) String() string {
+	if d.Kind == DriftDetectionFailed {
+		return fmt.Sprintf("%s: %s", d.Kind, d.Actual)
+	}
+	if len(d.DomainId) > 0 {
+		return fmt.Sprintf("%s on waf domain %s: expected %q, found %q", d.Kind, d.DomainId, d.Expected, d.Actual)
+	}
+	return fmt.Sprintf("%s: expected %q, found %q", d.Kind, d.Expected, d.Actual)
+}
+
+type SecretDrift struct {
+	Namespace string
+	Name      string
+	Drifts    []Drift
+}
+
+func detectionFailed(secret apiv1.Secret, err error) SecretDrift {
+	log.Printf("drift of secret %s/%s couldn't be detected: %v", secret.Namespace, secret.Name, err)
+	return SecretDrift{Namespace: secret.Namespace, Name: secret.Name, Drifts: []Drift{
+		{Kind: DriftDetectionFailed, Actual: err.Error()},
+	}}
+}
+
+// DetectionFailed tells whether the secret couldn't be compared with the waf.
+func (s SecretDrift) DetectionFailed() bool {
+	for _, drift := range s.Drifts {
+		if drift.Kind == DriftDetectionFailed {
+			return true
+		}
+	}
+	return false
+}
+
+// DetectDrift compares the secrets of each waf type with their waf, the other targets are not checked.
+func (s CertificateServices) DetectDrift(secrets []apiv1.Secret) ([]SecretDrift, error) {
+	var secretDrifts []SecretDrift
+	secretsByWafType := map[WafType][]apiv1.Secret{}
+	for _, secret := range secrets {
+		targets, err := getTargets(secret)
+		if err != nil {
+			secretDrifts = append(secretDrifts, detectionFailed(secret, err))
+			continue
+		}
+		if !hasTarget(targets, TargetWaf) {
+			continue
+		}
+		wafType, err := getWafType(secret, s.options.WafType)
+		if err != nil {
+			secretDrifts = append(secretDrifts, detectionFailed(secret, err))
+			continue
+		}
+		secretsByWafType[wafType] = append(secretsByWafType[wafType], secret)
+	}
+
+	for _, wafType := range wafTypes {
+		if len(secretsByWafType[wafType]) == 0 {
+			continue
+		}
+		certificateService, found := s.Waf[wafType]
+		if !found {
+			for _, secret := range secretsByWafType[wafType] {
+				secretDrifts = append(secretDrifts,
+					detectionFailed(secret, fmt.Errorf("the %s waf is not configured", wafType)))
+			}
+			continue
+		}
+		drifts, err := certificateService.DetectDrift(secretsByWafType[wafType])
+		if err != nil {
+			return nil, err
+		}
+		secretDrifts = append(secretDrifts, drifts...)
+	}
+	return secretDrifts, nil
+}
+
+func (s *CertificateService) DetectDrift(secrets []apiv1.Secret) ([]SecretDrift, error) {
+	certs, err := s.waf.ListCertificates()
+	if err != nil {
+		log.Println("couldn't get existing certificates from the waf ", err)
+		return nil, err
+	}
+	certIdsByName := map[string]string{}
+	for _, cert := range certs {
+		certIdsByName[cert.Name] = cert.Id
+	}
+
+	var secretDrifts []SecretDrift
+	for _, secret := range secrets {
+		drifts, err := s.detectSecretDrift(secret, certIdsByName)
+		if err != nil {
+			secretDrifts = append(secretDrifts, detectionFailed(secret, err))
+			continue
+		}
+		if len(drifts) > 0 {
+			secretDrifts = append(secretDrifts, SecretDrift{Namespace: secret.Namespace, Name: secret.Name, Drifts: drifts})
+		}
+	}
+	return secretDrifts, nil
+}
+
+func (s *CertificateService) detectSecretDrift(secret apiv1.Secret, certIdsByName map[string]string) ([]Drift, error) {
+	certSecret, err := getCertificateSecret(secret, s.options)
+	if err != nil {
+		return nil, err
+	}
+	leafCertificate, err := validateCertificate(certSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	certId, found := certIdsByName[certSecret.certName]
+	if !found {
+		return []Drift{{Kind: DriftCertificateMissing, Expected: certSecret.certName}}, nil
+	}
+
+	var drifts []Drift
+	if certSecret.certIds[TargetWaf] != certId {
+		drifts = append(drifts, Drift{Kind: DriftAnnotationMismatch, Expected: certId, Actual: certSecret.certIds[TargetWaf]})
+	}
+
+	wafDomainIds, err := s.resolveWafDomainIds(certSecret, leafCertificate)
+	if err != nil {
+		return nil, err
+	}
+	for _, domainId := range wafDomainIds {
+		existingDomain, err := s.waf.GetDomain(domainId)
+		if err != nil {
+			return nil, err
+		}
+		if existingDomain.CertificateId != certId {
+			drifts = append(drifts, Drift{
+				Kind:     DriftDomainMismatch,
+				DomainId: domainId,
+				Expected: certId,
+				Actual:   existingDomain.CertificateId,
+			})
+		}
+	}
+	return drifts, nil
+}
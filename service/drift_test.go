@@ -0,0 +1,107 @@
+package service
+
+import (
+	waf "github.com/opentelekomcloud/gophertelekomcloud/openstack/waf/v1/certificates"
+	wafDomain "github.com/opentelekomcloud/gophertelekomcloud/openstack/waf/v1/domains"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"testing"
+	"waf-cert-uploader/adapter"
+)
+
+func getDriftTestSecret(name string, certWafId string, testCert testCertificate) apiv1.Secret {
+	return apiv1.Secret{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      name,
+			Namespace: "waf",
+			Annotations: map[string]string{
+				"waf-cert-uploader.iits.tech/cert-waf-id":   certWafId,
+				"waf-cert-uploader.iits.tech/waf-domain-id": name + "-domain",
+			},
+		},
+		Data: map[string][]byte{
+			"tls.crt": testCert.certPem,
+			"tls.key": testCert.keyPem,
+		},
+	}
+}
+
+func TestDetectDrift(t *testing.T) {
+	inSyncCert := createTestLeafCertificate("in-sync.domain.com")
+	annotationCert := createTestLeafCertificate("annotation.domain.com")
+	domainCert := createTestLeafCertificate("domain.domain.com")
+	missingCert := createTestLeafCertificate("missing.domain.com")
+
+	fakeWaf := adapter.NewFakeWafCertificateManager()
+	fakeWaf.AddCertificate(waf.Certificate{Id: "in-sync-id", Name: getCertificateHash(inSyncCert.certPem)})
+	fakeWaf.AddCertificate(waf.Certificate{Id: "annotation-id", Name: getCertificateHash(annotationCert.certPem)})
+	fakeWaf.AddCertificate(waf.Certificate{Id: "domain-id", Name: getCertificateHash(domainCert.certPem)})
+	fakeWaf.AddDomain(wafDomain.Domain{Id: "in-sync-domain", CertificateId: "in-sync-id"})
+	fakeWaf.AddDomain(wafDomain.Domain{Id: "annotation-domain", CertificateId: "annotation-id"})
+	fakeWaf.AddDomain(wafDomain.Domain{Id: "domain-domain", CertificateId: "manually-changed-id"})
+
+	result, err := NewCertificateService(fakeWaf, DefaultOptions()).DetectDrift([]apiv1.Secret{
+		getDriftTestSecret("in-sync", "in-sync-id", inSyncCert),
+		getDriftTestSecret("annotation", "outdated-id", annotationCert),
+		getDriftTestSecret("domain", "domain-id", domainCert),
+		getDriftTestSecret("missing", "missing-id", missingCert),
+	})
+
+	assert.Nil(t, err)
+	assert.EqualValues(t, []SecretDrift{
+		{Namespace: "waf", Name: "annotation", Drifts: []Drift{
+			{Kind: DriftAnnotationMismatch, Expected: "annotation-id", Actual: "outdated-id"},
+		}},
+		{Namespace: "waf", Name: "domain", Drifts: []Drift{
+			{Kind: DriftDomainMismatch, DomainId: "domain-domain", Expected: "domain-id", Actual: "manually-changed-id"},
+		}},
+		{Namespace: "waf", Name: "missing", Drifts: []Drift{
+			{Kind: DriftCertificateMissing, Expected: getCertificateHash(missingCert.certPem)},
+		}},
+	}, result)
+}
+
+func TestDetectDrift_detectionFailed(t *testing.T) {
+	testCert := createTestLeafCertificate("invalid.domain.com")
+	secret := getDriftTestSecret("invalid", "invalid-id", testCert)
+	secret.Annotations["waf-cert-uploader.iits.tech/hostname-mismatch-policy"] = "sometimes"
+
+	result, err := NewCertificateService(adapter.NewFakeWafCertificateManager(), DefaultOptions()).DetectDrift([]apiv1.Secret{secret})
+
+	assert.Nil(t, err)
+	assert.Len(t, result, 1)
+	assert.True(t, result[0].DetectionFailed())
+	assert.Equal(t, `detection-failed: invalid secret configuration: unknown hostname mismatch policy "sometimes"`,
+		result[0].Drifts[0].String())
+}
+
+func TestCertificateServices_detectDriftPerWafType(t *testing.T) {
+	testCert := createTestLeafCertificate("my.domain.com")
+	cloudWaf := adapter.NewFakeWafCertificateManager()
+	dedicatedWaf := adapter.NewFakeWafCertificateManager()
+	dedicatedWaf.AddCertificate(waf.Certificate{Id: "dedicated-id", Name: getCertificateHash(testCert.certPem)})
+	dedicatedWaf.AddDomain(wafDomain.Domain{Id: "my-domain", CertificateId: "dedicated-id"})
+	certificateServices := NewCertificateServices(map[WafType]*CertificateService{
+		WafTypeCloud:     NewCertificateService(cloudWaf, DefaultOptions()),
+		WafTypeDedicated: NewCertificateService(dedicatedWaf, DefaultOptions()),
+	}, DefaultOptions())
+	cloudSecret := getWafTypeTestSecret("", testCert)
+	cloudSecret.Name = "cloud"
+	dedicatedSecret := getWafTypeTestSecret("dedicated", testCert)
+	dedicatedSecret.Annotations["waf-cert-uploader.iits.tech/cert-waf-id"] = "dedicated-id"
+	invalidSecret := getWafTypeTestSecret("premium", testCert)
+
+	result, err := certificateServices.DetectDrift([]apiv1.Secret{cloudSecret, dedicatedSecret, invalidSecret})
+
+	assert.Nil(t, err)
+	assert.EqualValues(t, []SecretDrift{
+		{Namespace: "waf", Name: "my", Drifts: []Drift{
+			{Kind: DriftDetectionFailed,
+				Actual: `invalid secret configuration: unknown waf type "premium", expected cloud or dedicated`},
+		}},
+		{Namespace: "waf", Name: "cloud", Drifts: []Drift{
+			{Kind: DriftCertificateMissing, Expected: getCertificateHash(testCert.certPem)},
+		}},
+	}, result)
+}
@@ -0,0 +1,205 @@
+package service
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	elb "github.com/opentelekomcloud/gophertelekomcloud/openstack/elb/v3/certificates"
+	elbListener "github.com/opentelekomcloud/gophertelekomcloud/openstack/elb/v3/listeners"
+	"github.com/thoas/go-funk"
+	apiv1 "k8s.io/api/core/v1"
+	"log"
+	"strings"
+	"waf-cert-uploader/adapter"
+)
+
+// ElbCertificateBinding tells whether the certificate is the default certificate of a listener or one of its sni certificates.
+type ElbCertificateBinding string
+
+const (
+	ElbCertificateBindingDefault ElbCertificateBinding = "default"
+	ElbCertificateBindingSni     ElbCertificateBinding = "sni"
+)
+
+func ParseElbCertificateBinding(value string) (ElbCertificateBinding, error) {
+	switch binding := ElbCertificateBinding(strings.ToLower(strings.TrimSpace(value))); binding {
+	case ElbCertificateBindingDefault, ElbCertificateBindingSni:
+		return binding, nil
+	default:
+		return "", fmt.Errorf("unknown elb certificate binding %q, expected %s or %s",
+			value, ElbCertificateBindingDefault, ElbCertificateBindingSni)
+	}
+}
+
+// ElbCertificateService uploads the certificates of secrets to the certificate store of the elastic load balancers
+// and binds them to https listeners.
+type ElbCertificateService struct {
+	elb     adapter.ElbCertificateManager
+	options Options
+}
+
+func NewElbCertificateService(elbCertificateManager adapter.ElbCertificateManager, options Options) *ElbCertificateService {
+	return &ElbCertificateService{elb: elbCertificateManager, options: options}
+}
+
+// CreateOrUpdateCertificate uploads the certificate of the secret to the elb, regardless of the targets of the secret.
+func (s *ElbCertificateService) CreateOrUpdateCertificate(secret apiv1.Secret) (*UploadResult, error) {
+	return createOrUpdateCertificate(secret, s.options, func(CertificateSecret) ([]selectedTarget, error) {
+		return []selectedTarget{{name: TargetElb, target: s}}, nil
+	})
+}
+
+// elbListenerBinding binds a certificate to the https listeners of a secret.
+type elbListenerBinding struct {
+	service           *ElbCertificateService
+	certSecret        CertificateSecret
+	existingListeners map[string]elbListener.Listener
+	boundListenerIds  []string
+}
+
+// PrepareBinding reads the listeners of the secret, they have to use HTTPS. An sni certificate needs the
+// domain names of the leaf certificate, the elb selects it by them.
+func (s *ElbCertificateService) PrepareBinding(
+	certSecret CertificateSecret,
+	leafCertificate *x509.Certificate) (CertificateBinding, error) {
+	if len(certSecret.elbListenerIds) == 0 {
+		return nil, fmt.Errorf("%w: the secret has no elb listener id annotation", ErrInvalidConfiguration)
+	}
+	if certSecret.elbCertificateBinding == ElbCertificateBindingSni && len(leafCertificate.DNSNames) == 0 {
+		return nil, fmt.Errorf("%w: an sni certificate of the elb needs dns names", ErrInvalidConfiguration)
+	}
+
+	existingListeners := map[string]elbListener.Listener{}
+	for _, listenerId := range certSecret.elbListenerIds {
+		listener, err := s.elb.GetListener(listenerId)
+		if err != nil {
+			log.Printf("couldn't get the elb listener %s: %v", listenerId, err)
+			return nil, err
+		}
+		if listener.Protocol != string(elbListener.ProtocolHTTPS) {
+			return nil, fmt.Errorf("%w: the elb listener %s uses %s instead of HTTPS",
+				ErrInvalidConfiguration, listenerId, listener.Protocol)
+		}
+		existingListeners[listenerId] = *listener
+	}
+	return &elbListenerBinding{service: s, certSecret: certSecret, existingListeners: existingListeners}, nil
+}
+
+func (s *ElbCertificateService) FindCertificate(certSecret CertificateSecret) (*string, error) {
+	certs, err := s.elb.ListCertificates()
+	if err != nil {
+		log.Println("couldn't get existing certificates from the elb ", err)
+		return nil, err
+	}
+	for _, cert := range certs {
+		if cert.Name == certSecret.certName {
+			log.Println("the certificate exists in the elb already with id " + cert.ID)
+			return &cert.ID, nil
+		}
+	}
+	return nil, nil
+}
+
+// UploadCertificate always sets the domain names, so a certificate found by its hash can be bound as sni
+// certificate as well.
+func (s *ElbCertificateService) UploadCertificate(certSecret CertificateSecret) (string, error) {
+	chain, err := parseCertificateChain([]byte(certSecret.tlsCert))
+	if err != nil {
+		return "", err
+	}
+	certificate, err := s.elb.CreateCertificate(elb.CreateOpts{
+		Name:        certSecret.certName,
+		Type:        "server",
+		Domain:      strings.Join(chain[0].DNSNames, ","),
+		Certificate: certSecret.tlsCert,
+		PrivateKey:  certSecret.tlsKey,
+	})
+	if err != nil {
+		log.Println("couldn't upload the certificate to the elb", err)
+		return "", err
+	}
+	log.Println("created a new certificate in elb with id " + certificate.ID)
+	return certificate.ID, nil
+}
+
+func (s *ElbCertificateService) DeleteCertificate(certId string) error {
+	return s.elb.DeleteCertificate(certId)
+}
+
+// Bind keeps the ids of the listeners that were changed, also when a later binding fails.
+func (b *elbListenerBinding) Bind(certId string) error {
+	for _, listenerId := range b.certSecret.elbListenerIds {
+		opts, changed := getListenerUpdateOpts(
+			b.existingListeners[listenerId], b.certSecret.elbCertificateBinding, b.certSecret.certIds[TargetElb], certId)
+		if !changed {
+			log.Printf("the certificate is bound to elb listener %s already", listenerId)
+			continue
+		}
+		_, err := b.service.elb.UpdateListener(listenerId, opts)
+		if err != nil {
+			log.Printf("certificate %s couldn't be bound to elb listener %s: %v", certId, listenerId, err)
+			return err
+		}
+		b.boundListenerIds = append(b.boundListenerIds, listenerId)
+		log.Printf("certificate %s has been bound to elb listener %s successfully", certId, listenerId)
+	}
+	return nil
+}
+
+// getListenerUpdateOpts replaces the default certificate or the previous sni certificate of the secret,
+// other sni certificates of the listener are kept.
+func getListenerUpdateOpts(
+	listener elbListener.Listener,
+	binding ElbCertificateBinding,
+	previousCertId string,
+	certId string) (elbListener.UpdateOpts, bool) {
+	if binding == ElbCertificateBindingDefault {
+		if listener.DefaultTlsContainerRef == certId {
+			return elbListener.UpdateOpts{}, false
+		}
+		return elbListener.UpdateOpts{DefaultTlsContainerRef: &certId}, true
+	}
+
+	if funk.ContainsString(listener.SniContainerRefs, certId) {
+		return elbListener.UpdateOpts{}, false
+	}
+	sniContainerRefs := []string{}
+	for _, ref := range listener.SniContainerRefs {
+		if ref != previousCertId {
+			sniContainerRefs = append(sniContainerRefs, ref)
+		}
+	}
+	sniContainerRefs = append(sniContainerRefs, certId)
+	return elbListener.UpdateOpts{SniContainerRefs: &sniContainerRefs}, true
+}
+
+func (b *elbListenerBinding) Restore() error {
+	var errs []error
+	for _, listenerId := range b.boundListenerIds {
+		listener := b.existingListeners[listenerId]
+		sniContainerRefs := append([]string{}, listener.SniContainerRefs...)
+		_, err := b.service.elb.UpdateListener(listenerId, elbListener.UpdateOpts{
+			DefaultTlsContainerRef: &listener.DefaultTlsContainerRef,
+			SniContainerRefs:       &sniContainerRefs,
+		})
+		if err != nil {
+			log.Printf("elb listener %s couldn't be restored: %v", listenerId, err)
+			errs = append(errs, fmt.Errorf("elb listener %s couldn't be restored: %w", listenerId, err))
+		} else {
+			log.Printf("elb listener %s was restored", listenerId)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (b *elbListenerBinding) Warnings() []string {
+	return nil
+}
+
+func (b *elbListenerBinding) Attachments() []DomainAttachment {
+	var attachments []DomainAttachment
+	for _, listenerId := range b.boundListenerIds {
+		attachments = append(attachments, DomainAttachment{DomainId: listenerId})
+	}
+	return attachments
+}
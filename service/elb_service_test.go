@@ -0,0 +1,138 @@
+package service
+
+import (
+	golangsdk "github.com/opentelekomcloud/gophertelekomcloud"
+	elb "github.com/opentelekomcloud/gophertelekomcloud/openstack/elb/v3/certificates"
+	elbListener "github.com/opentelekomcloud/gophertelekomcloud/openstack/elb/v3/listeners"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"testing"
+	"waf-cert-uploader/adapter"
+)
+
+func getElbTestSecret(testCert testCertificate, annotations map[string]string) apiv1.Secret {
+	return apiv1.Secret{
+		ObjectMeta: v1.ObjectMeta{Name: "my", Namespace: "waf", Annotations: annotations},
+		Data: map[string][]byte{
+			"tls.crt": testCert.certPem,
+			"tls.key": testCert.keyPem,
+		},
+	}
+}
+
+func TestElbCreateOrUpdateCertificate_defaultCertificate(t *testing.T) {
+	testCert := createTestLeafCertificate("my.domain.com")
+	fakeElb := adapter.NewFakeElbCertificateManager()
+	fakeElb.AddCertificate(elb.Certificate{ID: "previous-id", Name: "previous-hash"})
+	fakeElb.AddListener(elbListener.Listener{ID: "listener-1", Protocol: "HTTPS", DefaultTlsContainerRef: "previous-id"})
+	secret := getElbTestSecret(testCert, map[string]string{
+		"waf-cert-uploader.iits.tech/elb-listener-id": "listener-1",
+		"waf-cert-uploader.iits.tech/cert-elb-id":     "previous-id",
+	})
+
+	result, err := NewElbCertificateService(fakeElb, DefaultOptions()).CreateOrUpdateCertificate(secret)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "elb-cert-1", result.CertIds[TargetElb])
+	assert.Equal(t, "elb-cert-1", fakeElb.Listener("listener-1").DefaultTlsContainerRef)
+	certificate, _ := fakeElb.Certificate("elb-cert-1")
+	assert.Equal(t, getCertificateHash(testCert.certPem), certificate.Name)
+	assert.Equal(t, "server", certificate.Type)
+	assert.Equal(t, []string{"ListCertificates", "GetListener listener-1", "CreateCertificate",
+		"UpdateListener listener-1", "DeleteCertificate previous-id"}, fakeElb.Calls())
+}
+
+func TestElbCreateOrUpdateCertificate_alreadyBound(t *testing.T) {
+	testCert := createTestLeafCertificate("my.domain.com")
+	fakeElb := adapter.NewFakeElbCertificateManager()
+	fakeElb.AddCertificate(elb.Certificate{ID: "elb-id", Name: getCertificateHash(testCert.certPem)})
+	fakeElb.AddListener(elbListener.Listener{ID: "listener-1", Protocol: "HTTPS", DefaultTlsContainerRef: "elb-id"})
+	secret := getElbTestSecret(testCert, map[string]string{
+		"waf-cert-uploader.iits.tech/elb-listener-id": "listener-1",
+		"waf-cert-uploader.iits.tech/cert-elb-id":     "elb-id",
+	})
+
+	result, err := NewElbCertificateService(fakeElb, DefaultOptions()).CreateOrUpdateCertificate(secret)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "elb-id", result.CertIds[TargetElb])
+	assert.Equal(t, []string{"ListCertificates", "GetListener listener-1"}, fakeElb.Calls())
+}
+
+func TestElbCreateOrUpdateCertificate_sniCertificate(t *testing.T) {
+	testCert := createTestLeafCertificate("my.domain.com")
+	fakeElb := adapter.NewFakeElbCertificateManager()
+	fakeElb.AddListener(elbListener.Listener{ID: "listener-1", Protocol: "HTTPS", DefaultTlsContainerRef: "default-id",
+		SniContainerRefs: []string{"other-id", "previous-id"}})
+	secret := getElbTestSecret(testCert, map[string]string{
+		"waf-cert-uploader.iits.tech/elb-listener-id":         "listener-1",
+		"waf-cert-uploader.iits.tech/elb-certificate-binding": "sni",
+		"waf-cert-uploader.iits.tech/cert-elb-id":             "previous-id",
+	})
+
+	result, err := NewElbCertificateService(fakeElb, DefaultOptions()).CreateOrUpdateCertificate(secret)
+
+	assert.Nil(t, err)
+	listener := fakeElb.Listener("listener-1")
+	assert.Equal(t, "default-id", listener.DefaultTlsContainerRef)
+	assert.Equal(t, []string{"other-id", "elb-cert-1"}, listener.SniContainerRefs)
+	assert.Equal(t, map[TargetName][]DomainAttachment{TargetElb: {{DomainId: "listener-1"}}}, result.Attachments)
+	certificate, _ := fakeElb.Certificate("elb-cert-1")
+	assert.Equal(t, "my.domain.com", certificate.Domain)
+}
+
+func TestElbCreateOrUpdateCertificate_sniCertificateWithoutDnsNames(t *testing.T) {
+	testCert := createTestLeafCertificate()
+	fakeElb := adapter.NewFakeElbCertificateManager()
+	fakeElb.AddListener(elbListener.Listener{ID: "listener-1", Protocol: "HTTPS", DefaultTlsContainerRef: "default-id"})
+	secret := getElbTestSecret(testCert, map[string]string{
+		"waf-cert-uploader.iits.tech/elb-listener-id":         "listener-1",
+		"waf-cert-uploader.iits.tech/elb-certificate-binding": "sni",
+	})
+
+	_, err := NewElbCertificateService(fakeElb, DefaultOptions()).CreateOrUpdateCertificate(secret)
+
+	assert.ErrorIs(t, err, ErrInvalidConfiguration)
+	assert.Equal(t, []string{"ListCertificates"}, fakeElb.Calls())
+}
+
+func TestElbCreateOrUpdateCertificate_rollbackOnBindFailure(t *testing.T) {
+	testCert := createTestLeafCertificate("my.domain.com")
+	fakeElb := adapter.NewFakeElbCertificateManager()
+	fakeElb.AddListener(elbListener.Listener{ID: "listener-1", Protocol: "HTTPS", DefaultTlsContainerRef: "previous-id"})
+	fakeElb.AddListener(elbListener.Listener{ID: "listener-2", Protocol: "HTTPS", DefaultTlsContainerRef: "previous-id"})
+	fakeElb.FailNext("UpdateListener listener-2", golangsdk.ErrDefault500{})
+	secret := getElbTestSecret(testCert, map[string]string{
+		"waf-cert-uploader.iits.tech/elb-listener-id": "listener-1,listener-2",
+		"waf-cert-uploader.iits.tech/cert-elb-id":     "previous-id",
+	})
+
+	_, err := NewElbCertificateService(fakeElb, DefaultOptions()).CreateOrUpdateCertificate(secret)
+
+	assert.NotNil(t, err)
+	assert.Equal(t, "previous-id", fakeElb.Listener("listener-1").DefaultTlsContainerRef)
+	_, found := fakeElb.Certificate("elb-cert-1")
+	assert.False(t, found)
+}
+
+func TestElbCreateOrUpdateCertificate_notAnHttpsListener(t *testing.T) {
+	testCert := createTestLeafCertificate("my.domain.com")
+	fakeElb := adapter.NewFakeElbCertificateManager()
+	fakeElb.AddListener(elbListener.Listener{ID: "listener-1", Protocol: "TCP"})
+	secret := getElbTestSecret(testCert, map[string]string{"waf-cert-uploader.iits.tech/elb-listener-id": "listener-1"})
+
+	_, err := NewElbCertificateService(fakeElb, DefaultOptions()).CreateOrUpdateCertificate(secret)
+
+	assert.ErrorIs(t, err, ErrInvalidConfiguration)
+	assert.Equal(t, []string{"ListCertificates", "GetListener listener-1"}, fakeElb.Calls())
+}
+
+func TestParseElbCertificateBinding(t *testing.T) {
+	binding, err := ParseElbCertificateBinding(" SNI ")
+	assert.Nil(t, err)
+	assert.Equal(t, ElbCertificateBindingSni, binding)
+
+	_, err = ParseElbCertificateBinding("all")
+	assert.Equal(t, `unknown elb certificate binding "all", expected default or sni`, err.Error())
+}
@@ -0,0 +1,77 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	golangsdk "github.com/opentelekomcloud/gophertelekomcloud"
+	"strings"
+	"waf-cert-uploader/adapter"
+)
+
+// ErrInvalidConfiguration is shared with the adapters, which reject options the waf can't apply.
+var ErrInvalidConfiguration = adapter.ErrInvalidConfiguration
+
+type ErrorClass string
+
+const (
+	ErrorClassInvalidCertificate   ErrorClass = "invalid_certificate"
+	ErrorClassInvalidConfiguration ErrorClass = "invalid_configuration"
+	ErrorClassDomainNotFound       ErrorClass = "domain_not_found"
+	ErrorClassAuthFailure          ErrorClass = "auth_failure"
+	ErrorClassQuotaExceeded        ErrorClass = "quota_exceeded"
+	ErrorClassThrottled            ErrorClass = "throttled"
+	ErrorClassWafUnavailable       ErrorClass = "waf_unavailable"
+	ErrorClassInternal             ErrorClass = "internal"
+)
+
+func ClassifyError(err error) ErrorClass {
+	// the error after a successful reauthentication is classified by the original error of the retried request
+	var afterReauthentication *golangsdk.ErrErrorAfterReauthentication
+	if errors.As(err, &afterReauthentication) && afterReauthentication.ErrOriginal != nil {
+		return ClassifyError(afterReauthentication.ErrOriginal)
+	}
+
+	var validationError *CertificateValidationError
+	var badRequest golangsdk.ErrDefault400
+	var unauthorized golangsdk.ErrDefault401
+	var forbidden golangsdk.ErrDefault403
+	// the sdk returns the reauthentication errors as pointers, unlike the errors of the status codes
+	var reauthentication *golangsdk.ErrUnableToReauthenticate
+	var notFound golangsdk.ErrDefault404
+	var throttled golangsdk.ErrDefault429
+	var internalServerError golangsdk.ErrDefault500
+	var serviceUnavailable golangsdk.ErrDefault503
+	var timeout golangsdk.ErrDefault408
+
+	switch {
+	case errors.As(err, &validationError):
+		return ErrorClassInvalidCertificate
+	case errors.Is(err, ErrInvalidConfiguration), errors.Is(err, ErrWafDomainAmbiguous):
+		return ErrorClassInvalidConfiguration
+	case errors.Is(err, ErrWafDomainNotFound), errors.As(err, &notFound):
+		return ErrorClassDomainNotFound
+	case errors.As(err, &badRequest) && isQuotaError(badRequest.Body):
+		return ErrorClassQuotaExceeded
+	case errors.As(err, &forbidden) && isQuotaError(forbidden.Body):
+		return ErrorClassQuotaExceeded
+	case errors.As(err, &unauthorized), errors.As(err, &forbidden), errors.As(err, &reauthentication):
+		return ErrorClassAuthFailure
+	case errors.As(err, &throttled):
+		return ErrorClassThrottled
+	case errors.As(err, &internalServerError), errors.As(err, &serviceUnavailable), errors.As(err, &timeout):
+		return ErrorClassWafUnavailable
+	default:
+		return ErrorClassInternal
+	}
+}
+
+func isQuotaError(body []byte) bool {
+	return strings.Contains(strings.ToLower(string(body)), "quota")
+}
+
+const UploadStatusPending = "pending"
+
+// UploadFailureStatus describes a failed upload in the upload status annotation of a secret.
+func UploadFailureStatus(err error) string {
+	return fmt.Sprintf("failed (%s): %s", ClassifyError(err), err.Error())
+}
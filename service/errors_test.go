@@ -0,0 +1,45 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	golangsdk "github.com/opentelekomcloud/gophertelekomcloud"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestClassifyError(t *testing.T) {
+	quotaBody := []byte(`{"error_code":"WAF.00014002","error_msg":"resource quota exceeded"}`)
+
+	tests := []struct {
+		err      error
+		expected ErrorClass
+	}{
+		{&CertificateValidationError{Reason: ErrKeyMismatch}, ErrorClassInvalidCertificate},
+		{fmt.Errorf("%w: missing annotation", ErrInvalidConfiguration), ErrorClassInvalidConfiguration},
+		{fmt.Errorf("%w: my.domain.com", ErrWafDomainAmbiguous), ErrorClassInvalidConfiguration},
+		{fmt.Errorf("%w: my.domain.com", ErrWafDomainNotFound), ErrorClassDomainNotFound},
+		{golangsdk.ErrDefault404{}, ErrorClassDomainNotFound},
+		{golangsdk.ErrDefault401{}, ErrorClassAuthFailure},
+		{golangsdk.ErrDefault403{}, ErrorClassAuthFailure},
+		{&golangsdk.ErrUnableToReauthenticate{ErrOriginal: golangsdk.ErrDefault401{}}, ErrorClassAuthFailure},
+		{&golangsdk.ErrErrorAfterReauthentication{ErrOriginal: golangsdk.ErrDefault429{}}, ErrorClassThrottled},
+		{&golangsdk.ErrErrorAfterReauthentication{ErrOriginal: golangsdk.ErrDefault503{}}, ErrorClassWafUnavailable},
+		{fmt.Errorf("uploading failed: %w",
+			&golangsdk.ErrErrorAfterReauthentication{ErrOriginal: golangsdk.ErrDefault403{}}), ErrorClassAuthFailure},
+		{golangsdk.ErrDefault400{ErrUnexpectedResponseCode: golangsdk.ErrUnexpectedResponseCode{Body: quotaBody}},
+			ErrorClassQuotaExceeded},
+		{golangsdk.ErrDefault403{ErrUnexpectedResponseCode: golangsdk.ErrUnexpectedResponseCode{Body: quotaBody}},
+			ErrorClassQuotaExceeded},
+		{golangsdk.ErrDefault429{}, ErrorClassThrottled},
+		{golangsdk.ErrDefault500{}, ErrorClassWafUnavailable},
+		{golangsdk.ErrDefault503{}, ErrorClassWafUnavailable},
+		{&DomainAttachmentError{CertId: "12345", Attachments: []DomainAttachment{
+			{DomainId: "domain-1"}, {DomainId: "domain-2", Err: golangsdk.ErrDefault503{}}}}, ErrorClassWafUnavailable},
+		{errors.New("any error"), ErrorClassInternal},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, ClassifyError(test.err), test.err.Error())
+	}
+}
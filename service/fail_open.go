@@ -0,0 +1,57 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+)
+
+// FailOpenPolicy contains the error classes for which the admission review is allowed without a certificate id.
+type FailOpenPolicy map[ErrorClass]bool
+
+// failOpenErrorClasses are the error classes that can be solved by retrying, invalid certificates and
+// configurations are always rejected.
+var failOpenErrorClasses = []ErrorClass{
+	ErrorClassDomainNotFound,
+	ErrorClassAuthFailure,
+	ErrorClassQuotaExceeded,
+	ErrorClassThrottled,
+	ErrorClassWafUnavailable,
+	ErrorClassInternal,
+}
+
+func ParseFailOpenPolicy(value string) (FailOpenPolicy, error) {
+	policy := FailOpenPolicy{}
+	switch strings.TrimSpace(value) {
+	case "", "none":
+		return policy, nil
+	case "all":
+		for _, errorClass := range failOpenErrorClasses {
+			policy[errorClass] = true
+		}
+		return policy, nil
+	}
+
+	for _, class := range strings.Split(value, ",") {
+		errorClass := ErrorClass(strings.TrimSpace(class))
+		if !isFailOpenErrorClass(errorClass) {
+			return nil, fmt.Errorf("invalid fail open error class %q, expected one of %v, all or none",
+				errorClass, failOpenErrorClasses)
+		}
+		policy[errorClass] = true
+	}
+	return policy, nil
+}
+
+func isFailOpenErrorClass(errorClass ErrorClass) bool {
+	for _, failOpenErrorClass := range failOpenErrorClasses {
+		if errorClass == failOpenErrorClass {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows tells whether the admission review is allowed despite the error of the upload.
+func (p FailOpenPolicy) Allows(uploadError error) bool {
+	return p[ClassifyError(uploadError)]
+}
@@ -0,0 +1,24 @@
+package service
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseFailOpenPolicy(t *testing.T) {
+	policy, err := ParseFailOpenPolicy("none")
+	assert.Nil(t, err)
+	assert.Empty(t, policy)
+
+	policy, err = ParseFailOpenPolicy("all")
+	assert.Nil(t, err)
+	assert.True(t, policy[ErrorClassWafUnavailable])
+	assert.False(t, policy[ErrorClassInvalidCertificate])
+
+	policy, err = ParseFailOpenPolicy("waf_unavailable, throttled")
+	assert.Nil(t, err)
+	assert.Equal(t, FailOpenPolicy{ErrorClassWafUnavailable: true, ErrorClassThrottled: true}, policy)
+
+	_, err = ParseFailOpenPolicy("invalid_certificate")
+	assert.NotNil(t, err)
+}
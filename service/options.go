@@ -0,0 +1,23 @@
+package service
+
+import (
+	"time"
+)
+
+// Options are the defaults of the secrets that don't override them with an annotation.
+type Options struct {
+	WafType                WafType
+	HostnameMismatchPolicy HostnameMismatchPolicy
+	HttpsBackend           HttpsBackend
+	// ExpiryWarningThreshold is how long before its expiry a certificate is warned about.
+	ExpiryWarningThreshold time.Duration
+}
+
+func DefaultOptions() Options {
+	return Options{
+		WafType:                DefaultWafType,
+		HostnameMismatchPolicy: DefaultHostnameMismatchPolicy,
+		HttpsBackend:           HttpsBackend{ServerProtocol: "HTTPS", Port: 443},
+		ExpiryWarningThreshold: DefaultExpiryWarningThreshold,
+	}
+}
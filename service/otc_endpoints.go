@@ -0,0 +1,127 @@
+package service
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	golangsdk "github.com/opentelekomcloud/gophertelekomcloud"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// OtcEndpoints overrides the region and the endpoints that are derived from the project name by default, e.g. for
+// the Swiss region, project names without the region prefix or private endpoints. The ca bundle and the proxy are
+// used for all requests to the otc, the iam and the waf alike.
+type OtcEndpoints struct {
+	IamEndpoint          string
+	Region               string
+	WafEndpoint          string
+	DedicatedWafEndpoint string
+	CaBundle             string
+	HttpProxy            string
+}
+
+func (e OtcEndpoints) Validate() error {
+	endpoints := map[string]string{
+		"iam endpoint":           e.IamEndpoint,
+		"waf endpoint":           e.WafEndpoint,
+		"dedicated waf endpoint": e.DedicatedWafEndpoint,
+		"http proxy":             e.HttpProxy,
+	}
+	for name, endpoint := range endpoints {
+		if len(endpoint) == 0 {
+			continue
+		}
+		parsedEndpoint, err := url.Parse(endpoint)
+		// neither the url nor the parse error, which contains the url, is returned as is, so the password of
+		// a proxy url isn't logged
+		if err != nil {
+			return fmt.Errorf("invalid %s, expected an http or https url", name)
+		}
+		if (parsedEndpoint.Scheme != "https" && parsedEndpoint.Scheme != "http") || len(parsedEndpoint.Host) == 0 {
+			return fmt.Errorf("invalid %s %q, expected an http or https url", name, parsedEndpoint.Redacted())
+		}
+	}
+	if len(e.CaBundle) > 0 {
+		_, err := e.loadCaBundle()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// regionOf falls back to the prefix of the project name, e.g. eu-de of eu-de_my_project.
+func (e OtcEndpoints) regionOf(projectName string) string {
+	if len(e.Region) > 0 {
+		return e.Region
+	}
+	return strings.Split(projectName, "_")[0]
+}
+
+func (e OtcEndpoints) iamEndpointOf(region string) string {
+	if len(e.IamEndpoint) > 0 {
+		return e.IamEndpoint
+	}
+	return fmt.Sprintf("https://iam.%s.otc.t-systems.com:443/v3", region)
+}
+
+// newTransport returns the transport of the provider client, which adds the ca bundle to the system certificates.
+func (e OtcEndpoints) newTransport() (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if len(e.CaBundle) > 0 {
+		certPool, err := e.loadCaBundle()
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: certPool, MinVersion: tls.VersionTLS12}
+	}
+	if len(e.HttpProxy) > 0 {
+		proxyUrl, err := url.Parse(e.HttpProxy)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(proxyUrl)
+	}
+	return transport, nil
+}
+
+func (e OtcEndpoints) loadCaBundle() (*x509.CertPool, error) {
+	caBundle, err := os.ReadFile(e.CaBundle)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read the ca bundle: %w", err)
+	}
+	certPool, err := x509.SystemCertPool()
+	if err != nil {
+		certPool = x509.NewCertPool()
+	}
+	if !certPool.AppendCertsFromPEM(caBundle) {
+		return nil, fmt.Errorf("the ca bundle %s contains no pem certificates", e.CaBundle)
+	}
+	return certPool, nil
+}
+
+// overrideEndpoints makes the provider client return the configured endpoints instead of the ones of the catalog
+// when the waf service clients are created.
+func (e OtcEndpoints) overrideEndpoints(provider *golangsdk.ProviderClient) {
+	overrides := map[string]string{}
+	if len(e.WafEndpoint) > 0 {
+		overrides["waf"] = golangsdk.NormalizeURL(e.WafEndpoint)
+	}
+	if len(e.DedicatedWafEndpoint) > 0 {
+		overrides["premium-waf"] = golangsdk.NormalizeURL(e.DedicatedWafEndpoint)
+	}
+	if len(overrides) == 0 {
+		return
+	}
+
+	locateEndpoint := provider.EndpointLocator
+	provider.EndpointLocator = func(opts golangsdk.EndpointOpts) (string, error) {
+		if endpoint, found := overrides[opts.Type]; found {
+			return endpoint, nil
+		}
+		return locateEndpoint(opts)
+	}
+}
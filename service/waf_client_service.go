@@ -5,24 +5,32 @@ import (
 	"fmt"
 	golangsdk "github.com/opentelekomcloud/gophertelekomcloud"
 	"github.com/opentelekomcloud/gophertelekomcloud/openstack"
+	"github.com/thoas/go-funk"
+	"io/fs"
 	"log"
+	"net/http"
 	"os"
 	"strings"
+	"waf-cert-uploader/adapter"
 )
 
-var WafClient *golangsdk.ServiceClient
-
 type OtcAuthOptionsSecret struct {
-	username       string
-	password       string
-	accessKey      string
-	secretKey      string
-	otcAccountName string
-	projectName    string
-	region         string
+	username         string
+	password         string
+	accessKey        string
+	secretKey        string
+	securityToken    string
+	otcAccountName   string
+	projectName      string
+	region           string
+	agencyName       string
+	agencyDomainName string
 }
 
-var authOptions OtcAuthOptionsSecret
+// hasAgency tells whether the credentials are delegated to the agency of another domain.
+func (o OtcAuthOptionsSecret) hasAgency() bool {
+	return len(o.agencyName) > 0
+}
 
 var newWafV1 = func(
 	provider *golangsdk.ProviderClient,
@@ -30,71 +38,206 @@ var newWafV1 = func(
 	return openstack.NewWAFV1(provider, opts)
 }
 
-var getProviderClient = func(authOpts golangsdk.AuthOptionsProvider) (*golangsdk.ProviderClient, error) {
-	return openstack.AuthenticatedClient(authOpts)
+var newWafdV1 = func(
+	provider *golangsdk.ProviderClient,
+	opts golangsdk.EndpointOpts) (*golangsdk.ServiceClient, error) {
+	return openstack.NewWAFDV1(provider, opts)
+}
+
+var newElbV3 = func(
+	provider *golangsdk.ProviderClient,
+	opts golangsdk.EndpointOpts) (*golangsdk.ServiceClient, error) {
+	return openstack.NewELBV3(provider, opts)
 }
 
-func SetupOtcClient() error {
-	provider, err := createProviderClient()
+var getProviderClient = authenticateProviderClient
+
+// authenticateProviderClient authenticates like openstack.AuthenticatedClient, but with the transport of the
+// otc endpoints.
+func authenticateProviderClient(
+	authOpts golangsdk.AuthOptionsProvider,
+	endpoints OtcEndpoints) (*golangsdk.ProviderClient, error) {
+	provider, err := openstack.NewClient(authOpts.GetIdentityEndpoint())
+	if err != nil {
+		return nil, err
+	}
+	transport, err := endpoints.newTransport()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	err = createWafServiceClient(provider)
+	provider.HTTPClient = http.Client{Transport: transport}
+
+	err = openstack.Authenticate(provider, authOpts)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	return provider, nil
 }
 
-func createWafServiceClient(provider *golangsdk.ProviderClient) error {
-	opts := golangsdk.EndpointOpts{Region: authOptions.region}
-	var err error
-	WafClient, err = newWafV1(provider, opts)
+// NewOtcCertificateServices creates the certificate services of both waf types for the otc credentials.
+// The returned CredentialsWatcher rebuilds their otc clients when the credentials change.
+func NewOtcCertificateServices(
+	otcOptions OtcOptions,
+	retryPolicy adapter.RetryPolicy,
+	options Options) (CertificateServices, *CredentialsWatcher, error) {
+	// the version is read before the credentials, so a change in between is reloaded by the watcher
+	version, err := credentialsVersion(otcOptions.CredentialsMountPath)
+	if err != nil {
+		return CertificateServices{}, nil, err
+	}
+	provider, authOptions, err := createProviderClient(otcOptions)
+	if err != nil {
+		return CertificateServices{}, nil, err
+	}
+	managers, err := createOtcCertificateManagers(provider, authOptions.region, options.WafType)
+	if err != nil {
+		return CertificateServices{}, nil, err
+	}
+
+	credentialsWatcher := newCredentialsWatcher(otcOptions, options.WafType, version, managers, provider, authOptions)
+	return newCertificateServicesForManagers(credentialsWatcher.swappableManagers(), retryPolicy, options),
+		credentialsWatcher, nil
+}
+
+// NewCertificateServicesForProvider creates a certificate service for each waf type and registers the elb target if
+// the provider has an endpoint for it. Only the waf of the default waf type is required, the others are left out if they aren't available.
+func NewCertificateServicesForProvider(
+	provider *golangsdk.ProviderClient,
+	region string,
+	retryPolicy adapter.RetryPolicy,
+	options Options) (CertificateServices, error) {
+	managers, err := createOtcCertificateManagers(provider, region, options.WafType)
+	if err != nil {
+		return CertificateServices{}, err
+	}
+	return newCertificateServicesForManagers(managers, retryPolicy, options), nil
+}
+
+// otcCertificateManagers are the managers of the otc services available to a provider client,
+// elb is nil if the elb isn't available.
+type otcCertificateManagers struct {
+	waf map[WafType]adapter.WafCertificateManager
+	elb adapter.ElbCertificateManager
+}
+
+// createOtcCertificateManagers fails if the waf of the default waf type isn't available.
+func createOtcCertificateManagers(
+	provider *golangsdk.ProviderClient,
+	region string,
+	defaultWafType WafType) (otcCertificateManagers, error) {
+	managers := otcCertificateManagers{waf: map[WafType]adapter.WafCertificateManager{}}
+
+	wafClient, err := createWafServiceClient(provider, region)
+	if err == nil {
+		managers.waf[WafTypeCloud] = adapter.NewOtcWafCertificateManager(wafClient)
+	} else if defaultWafType == WafTypeCloud {
+		return otcCertificateManagers{}, err
+	} else {
+		log.Println("the cloud waf is not available", err)
+	}
+
+	dedicatedWafClient, err := createDedicatedWafServiceClient(provider, region)
+	if err == nil {
+		managers.waf[WafTypeDedicated] = adapter.NewDedicatedWafCertificateManager(dedicatedWafClient)
+	} else if defaultWafType == WafTypeDedicated {
+		return otcCertificateManagers{}, err
+	} else {
+		log.Println("the dedicated waf is not available", err)
+	}
+
+	elbClient, err := newElbV3(provider, golangsdk.EndpointOpts{Region: region})
+	if err == nil {
+		managers.elb = adapter.NewOtcElbCertificateManager(elbClient)
+		log.Println("new elb client created successfully!")
+	} else {
+		log.Println("the elb is not available", err)
+	}
+	return managers, nil
+}
+
+func newCertificateServicesForManagers(
+	managers otcCertificateManagers,
+	retryPolicy adapter.RetryPolicy,
+	options Options) CertificateServices {
+	certificateServices := NewCertificateServices(map[WafType]*CertificateService{}, options)
+	for wafType, manager := range managers.waf {
+		certificateServices.Waf[wafType] = NewCertificateService(
+			adapter.NewRetryingWafCertificateManager(manager, retryPolicy), options)
+	}
+	if managers.elb != nil {
+		certificateServices.RegisterTarget(TargetElb, NewElbCertificateService(
+			adapter.NewRetryingElbCertificateManager(managers.elb, retryPolicy), options))
+	}
+	return certificateServices
+}
+
+func createWafServiceClient(provider *golangsdk.ProviderClient, region string) (*golangsdk.ServiceClient, error) {
+	opts := golangsdk.EndpointOpts{Region: region}
+	wafClient, err := newWafV1(provider, opts)
 
 	if err != nil {
 		log.Println("error creating waf service client", err)
-		return err
+		return nil, err
 	}
 	log.Println("new waf client created successfully!")
-	return nil
+	return wafClient, nil
 }
 
-func createProviderClient() (*golangsdk.ProviderClient, error) {
-	authOptsProvider, err := getAuthOptions()
+func createDedicatedWafServiceClient(provider *golangsdk.ProviderClient, region string) (*golangsdk.ServiceClient, error) {
+	opts := golangsdk.EndpointOpts{Region: region}
+	wafClient, err := newWafdV1(provider, opts)
+
 	if err != nil {
-		log.Println("couldn't get auth options", err)
+		log.Println("error creating dedicated waf service client", err)
 		return nil, err
 	}
-	provider, err := getProviderClient(*authOptsProvider)
+	log.Println("new dedicated waf client created successfully!")
+	return wafClient, nil
+}
+
+// createProviderClient returns the credentials the provider client was authenticated with as well, the clients of
+// the services are created for their region.
+func createProviderClient(otcOptions OtcOptions) (*golangsdk.ProviderClient, OtcAuthOptionsSecret, error) {
+	authOptions, err := loadCredentials(otcOptions)
+	if err != nil {
+		log.Println("couldn't get auth options", err)
+		return nil, OtcAuthOptionsSecret{}, err
+	}
+	provider, err := getProviderClient(getAuthOptions(authOptions, otcOptions.Endpoints), otcOptions.Endpoints)
 	if err != nil {
 		log.Println("error creating otc client", err)
-		return nil, err
+		return nil, OtcAuthOptionsSecret{}, err
 	}
+	adapter.ConfigureProviderClient(provider)
+	otcOptions.Endpoints.overrideEndpoints(provider)
 
 	log.Println("new otc client created successfully!")
-	return provider, nil
+	return provider, authOptions, nil
 }
 
-func getAuthOptions() (*golangsdk.AuthOptionsProvider, error) {
-	err := getAuthOptionsFromMountedSecret()
-	if err != nil {
-		return nil, err
-	}
-
-	var authOptsProvider golangsdk.AuthOptionsProvider
-	identityEndpoint := fmt.Sprintf("https://iam.%s.otc.t-systems.com:443/v3", authOptions.region)
+func getAuthOptions(authOptions OtcAuthOptionsSecret, endpoints OtcEndpoints) golangsdk.AuthOptionsProvider {
+	identityEndpoint := endpoints.iamEndpointOf(authOptions.region)
 	if len(authOptions.accessKey) > 0 && len(authOptions.secretKey) > 0 {
-		authOptsProvider = golangsdk.AKSKAuthOptions{
+		akskAuthOptions := golangsdk.AKSKAuthOptions{
 			IdentityEndpoint: identityEndpoint,
 			Region:           authOptions.region,
 			ProjectName:      authOptions.projectName,
 			AccessKey:        authOptions.accessKey,
 			SecretKey:        authOptions.secretKey,
+			SecurityToken:    authOptions.securityToken,
 		}
-		return &authOptsProvider, nil
+		if authOptions.hasAgency() {
+			// the project belongs to the delegating domain, the token of the agency is scoped to it instead
+			akskAuthOptions.ProjectName = ""
+			akskAuthOptions.Domain = authOptions.otcAccountName
+			akskAuthOptions.AgencyName = authOptions.agencyName
+			akskAuthOptions.AgencyDomainName = authOptions.agencyDomainName
+			akskAuthOptions.DelegatedProject = authOptions.projectName
+		}
+		return akskAuthOptions
 	}
 
-	authOptsProvider = golangsdk.AuthOptions{
+	passwordAuthOptions := golangsdk.AuthOptions{
 		IdentityEndpoint: identityEndpoint,
 		Username:         authOptions.username,
 		Password:         authOptions.password,
@@ -102,52 +245,133 @@ func getAuthOptions() (*golangsdk.AuthOptionsProvider, error) {
 		TenantName:       authOptions.projectName,
 		AllowReauth:      true,
 	}
-	return &authOptsProvider, nil
+	if authOptions.hasAgency() {
+		// the token of the user is scoped to its own domain and only used to get the token of the agency
+		passwordAuthOptions.TenantName = ""
+		passwordAuthOptions.AgencyName = authOptions.agencyName
+		passwordAuthOptions.AgencyDomainName = authOptions.agencyDomainName
+		passwordAuthOptions.DelegatedProject = authOptions.projectName
+	}
+	return passwordAuthOptions
 }
 
-var getAuthOptionsFromMountedSecret = func() error {
-	credentialsMountPath, foundMountPath := os.LookupEnv("CREDENTIALS_MOUNT_PATH")
-	if !foundMountPath {
-		return errors.New("environment variable for the credentials mount path was not found")
-	}
-	username, err := os.ReadFile(credentialsMountPath + "username")
-	if err != nil {
-		return err
-	}
-	password, err := os.ReadFile(credentialsMountPath + "password")
-	if err != nil {
-		return err
-	}
-	accessKey, err := os.ReadFile(credentialsMountPath + "accessKey")
-	if err != nil {
-		return err
+// OtcOptions are the credentials and the endpoints the otc clients are created with.
+type OtcOptions struct {
+	// CredentialsMountPath is the directory of the mounted credentials secret with a file per credential.
+	CredentialsMountPath string
+	// StaticCredentials are used if no CredentialsMountPath is set, e.g. for local runs. The keys are the names of
+	// the credentials files.
+	StaticCredentials map[string]string
+	Endpoints         OtcEndpoints
+}
+
+var loadCredentials = readCredentials
+
+// authMode is the kind of otc credentials.
+type authMode string
+
+const (
+	authModeAkSk          authMode = "ak/sk"
+	authModeTemporaryAkSk authMode = "temporary ak/sk"
+	authModePassword      authMode = "password"
+)
+
+var credentialsFiles = []string{"username", "password", "accessKey", "secretKey", "securityToken", "otcAccountName",
+	"projectName", "agencyName", "agencyDomainName"}
+
+// authModeFields are the credentials files required by each auth mode, the files of the other modes may be absent.
+var authModeFields = map[authMode][]string{
+	authModeAkSk:          {"accessKey", "secretKey", "projectName"},
+	authModeTemporaryAkSk: {"accessKey", "secretKey", "securityToken", "projectName"},
+	authModePassword:      {"username", "password", "otcAccountName", "projectName"},
+}
+
+// agencyFields are required in addition to the fields of the auth mode if the credentials are delegated to an agency.
+// The otc account name is the domain of the user or the ak/sk that assumes the agency.
+var agencyFields = []string{"agencyName", "agencyDomainName", "otcAccountName"}
+
+func readCredentials(otcOptions OtcOptions) (OtcAuthOptionsSecret, error) {
+	credentials := otcOptions.StaticCredentials
+	source := "configured"
+	if len(otcOptions.CredentialsMountPath) > 0 {
+		var err error
+		credentials, err = readCredentialsFiles(otcOptions.CredentialsMountPath)
+		if err != nil {
+			return OtcAuthOptionsSecret{}, err
+		}
+		source = "mounted"
 	}
-	secretKey, err := os.ReadFile(credentialsMountPath + "secretKey")
+	mode, err := detectAuthMode(credentials)
 	if err != nil {
-		return err
+		return OtcAuthOptionsSecret{}, err
 	}
-	otcAccountName, err := os.ReadFile(credentialsMountPath + "otcAccountName")
-	if err != nil {
-		return err
+	log.Printf("using the %s %s credentials", source, mode)
+
+	return OtcAuthOptionsSecret{
+		username:         credentials["username"],
+		password:         credentials["password"],
+		accessKey:        credentials["accessKey"],
+		secretKey:        credentials["secretKey"],
+		securityToken:    credentials["securityToken"],
+		otcAccountName:   credentials["otcAccountName"],
+		projectName:      credentials["projectName"],
+		region:           otcOptions.Endpoints.regionOf(credentials["projectName"]),
+		agencyName:       credentials["agencyName"],
+		agencyDomainName: credentials["agencyDomainName"],
+	}, nil
+}
+
+// readCredentialsFiles skips absent files and trims the trailing newlines that editors and
+// kubectl create secret --from-file leave in the files.
+func readCredentialsFiles(credentialsMountPath string) (map[string]string, error) {
+	credentials := map[string]string{}
+	for _, file := range credentialsFiles {
+		content, err := os.ReadFile(credentialsMountPath + file)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		credentials[file] = strings.TrimRight(string(content), "\r\n")
 	}
-	projectName, err := os.ReadFile(credentialsMountPath + "projectName")
-	if err != nil {
-		return err
+	return credentials, nil
+}
+
+// ValidateCredentials checks that the credentials contain all fields of their auth mode.
+func ValidateCredentials(credentials map[string]string) error {
+	_, err := detectAuthMode(credentials)
+	return err
+}
+
+// detectAuthMode selects temporary ak/sk if a security token is given, ak/sk if an access key or a secret key is
+// given and the password otherwise. Each mode can be delegated to an agency by giving its name.
+func detectAuthMode(credentials map[string]string) (authMode, error) {
+	mode := authModePassword
+	if len(credentials["securityToken"]) > 0 {
+		mode = authModeTemporaryAkSk
+	} else if len(credentials["accessKey"]) > 0 || len(credentials["secretKey"]) > 0 {
+		mode = authModeAkSk
 	}
-	region := strings.Split(string(projectName), "_")[0]
 
-	if err != nil {
-		return err
+	requiredFields := append([]string{}, authModeFields[mode]...)
+	if len(credentials["agencyName"]) > 0 || len(credentials["agencyDomainName"]) > 0 {
+		mode += " agency"
+		for _, field := range agencyFields {
+			if !funk.ContainsString(requiredFields, field) {
+				requiredFields = append(requiredFields, field)
+			}
+		}
 	}
 
-	authOptions = OtcAuthOptionsSecret{
-		username:       string(username),
-		password:       string(password),
-		accessKey:      string(accessKey),
-		secretKey:      string(secretKey),
-		otcAccountName: string(otcAccountName),
-		projectName:    string(projectName),
-		region:         region,
+	var missingFields []string
+	for _, field := range requiredFields {
+		if len(credentials[field]) == 0 {
+			missingFields = append(missingFields, field)
+		}
+	}
+	if len(missingFields) > 0 {
+		return "", fmt.Errorf("the %s credentials are incomplete, missing: %s", mode, strings.Join(missingFields, ", "))
 	}
-	return nil
+	return mode, nil
 }
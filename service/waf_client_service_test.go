@@ -4,18 +4,30 @@ import (
 	"errors"
 	golangsdk "github.com/opentelekomcloud/gophertelekomcloud"
 	"github.com/stretchr/testify/assert"
+	"os"
 	"testing"
+	"waf-cert-uploader/adapter"
 )
 
-func TestSetupOtcClient(t *testing.T) {
+// stubOtcClients makes the dedicated waf and the elb unavailable, the cloud waf client is created by newWafV1.
+func stubOtcClients(newWafClient func(*golangsdk.ProviderClient, golangsdk.EndpointOpts) (*golangsdk.ServiceClient, error)) {
+	newWafV1 = newWafClient
+	newWafdV1 = func(provider *golangsdk.ProviderClient, opts golangsdk.EndpointOpts) (*golangsdk.ServiceClient, error) {
+		return nil, errors.New("no dedicated waf endpoint")
+	}
+	newElbV3 = func(provider *golangsdk.ProviderClient, opts golangsdk.EndpointOpts) (*golangsdk.ServiceClient, error) {
+		return nil, errors.New("no elb endpoint")
+	}
+}
+
+func TestNewOtcCertificateServices(t *testing.T) {
 	var authOptsSlot golangsdk.AuthOptionsProvider
 	var providerAddress *golangsdk.ProviderClient
 	var providerSlot *golangsdk.ProviderClient
 	var endpointOptsSlot golangsdk.EndpointOpts
-	var serviceClientSlot *golangsdk.ServiceClient
 
-	getAuthOptionsFromMountedSecret = func() error {
-		authOptions = OtcAuthOptionsSecret{
+	loadCredentials = func(OtcOptions) (OtcAuthOptionsSecret, error) {
+		return OtcAuthOptionsSecret{
 			username:       "Robin",
 			password:       "abc123",
 			accessKey:      "",
@@ -23,24 +35,21 @@ func TestSetupOtcClient(t *testing.T) {
 			otcAccountName: "asdf5455fd4",
 			projectName:    "qwer541235g3",
 			region:         "eu-de",
-		}
-		return nil
+		}, nil
 	}
-	getProviderClient = func(authOpts golangsdk.AuthOptionsProvider) (*golangsdk.ProviderClient, error) {
+	getProviderClient = func(authOpts golangsdk.AuthOptionsProvider, _ OtcEndpoints) (*golangsdk.ProviderClient, error) {
 		authOptsSlot = authOpts
 		provider := golangsdk.ProviderClient{}
 		providerAddress = &provider
 		return &provider, nil
 	}
-	newWafV1 = func(provider *golangsdk.ProviderClient, opts golangsdk.EndpointOpts) (*golangsdk.ServiceClient, error) {
+	stubOtcClients(func(provider *golangsdk.ProviderClient, opts golangsdk.EndpointOpts) (*golangsdk.ServiceClient, error) {
 		providerSlot = provider
 		endpointOptsSlot = opts
-		serviceClient := golangsdk.ServiceClient{}
-		serviceClientSlot = &golangsdk.ServiceClient{}
-		return &serviceClient, nil
-	}
+		return &golangsdk.ServiceClient{}, nil
+	})
 
-	err := SetupOtcClient()
+	certificateServices, _, err := NewOtcCertificateServices(OtcOptions{}, adapter.DefaultRetryPolicy, DefaultOptions())
 
 	assert.Nil(t, err)
 	assert.Equal(t, "Robin", authOptsSlot.(golangsdk.AuthOptions).Username)
@@ -51,18 +60,16 @@ func TestSetupOtcClient(t *testing.T) {
 	assert.Equal(t, true, authOptsSlot.(golangsdk.AuthOptions).AllowReauth)
 	assert.Equal(t, providerAddress, providerSlot)
 	assert.Equal(t, "eu-de", endpointOptsSlot.Region)
-	assert.Equal(t, WafClient, serviceClientSlot)
+	assert.Contains(t, certificateServices.Waf, WafTypeCloud)
+	assert.NotContains(t, certificateServices.Waf, WafTypeDedicated)
+	assert.NotContains(t, certificateServices.targets, TargetElb)
 }
 
-func TestSetupOtcClientForAkSk(t *testing.T) {
+func TestNewOtcCertificateServicesForAkSk(t *testing.T) {
 	var authOptsSlot golangsdk.AuthOptionsProvider
-	var providerAddress *golangsdk.ProviderClient
-	var providerSlot *golangsdk.ProviderClient
-	var endpointOptsSlot golangsdk.EndpointOpts
-	var serviceClientSlot *golangsdk.ServiceClient
 
-	getAuthOptionsFromMountedSecret = func() error {
-		authOptions = OtcAuthOptionsSecret{
+	loadCredentials = func(OtcOptions) (OtcAuthOptionsSecret, error) {
+		return OtcAuthOptionsSecret{
 			username:       "",
 			password:       "",
 			accessKey:      "access-key",
@@ -70,67 +77,202 @@ func TestSetupOtcClientForAkSk(t *testing.T) {
 			otcAccountName: "",
 			projectName:    "qwer541235g3",
 			region:         "eu-de",
-		}
-		return nil
+		}, nil
 	}
-	getProviderClient = func(authOpts golangsdk.AuthOptionsProvider) (*golangsdk.ProviderClient, error) {
+	getProviderClient = func(authOpts golangsdk.AuthOptionsProvider, _ OtcEndpoints) (*golangsdk.ProviderClient, error) {
 		authOptsSlot = authOpts
-		provider := golangsdk.ProviderClient{}
-		providerAddress = &provider
-		return &provider, nil
-	}
-	newWafV1 = func(provider *golangsdk.ProviderClient, opts golangsdk.EndpointOpts) (*golangsdk.ServiceClient, error) {
-		providerSlot = provider
-		endpointOptsSlot = opts
-		serviceClient := golangsdk.ServiceClient{}
-		serviceClientSlot = &golangsdk.ServiceClient{}
-		return &serviceClient, nil
+		return &golangsdk.ProviderClient{}, nil
 	}
+	stubOtcClients(func(provider *golangsdk.ProviderClient, opts golangsdk.EndpointOpts) (*golangsdk.ServiceClient, error) {
+		return &golangsdk.ServiceClient{}, nil
+	})
 
-	err := SetupOtcClient()
+	_, _, err := NewOtcCertificateServices(OtcOptions{}, adapter.DefaultRetryPolicy, DefaultOptions())
 
 	assert.Nil(t, err)
-
 	assert.Equal(t, "", authOptsSlot.(golangsdk.AKSKAuthOptions).Domain)
 	assert.Equal(t, "", authOptsSlot.(golangsdk.AKSKAuthOptions).DomainID)
 	assert.Equal(t, "qwer541235g3", authOptsSlot.(golangsdk.AKSKAuthOptions).ProjectName)
 	assert.Equal(t, "access-key", authOptsSlot.(golangsdk.AKSKAuthOptions).AccessKey)
 	assert.Equal(t, "secret-key", authOptsSlot.(golangsdk.AKSKAuthOptions).SecretKey)
 	assert.Equal(t, "https://iam.eu-de.otc.t-systems.com:443/v3", authOptsSlot.(golangsdk.AKSKAuthOptions).IdentityEndpoint)
-	assert.Equal(t, providerAddress, providerSlot)
-	assert.Equal(t, "eu-de", endpointOptsSlot.Region)
-	assert.Equal(t, WafClient, serviceClientSlot)
 }
 
-func TestSetupOtcClient_providerFails(t *testing.T) {
-
-	getAuthOptionsFromMountedSecret = func() error {
-		authOptions = OtcAuthOptionsSecret{}
-		return nil
+func TestNewOtcCertificateServices_providerFails(t *testing.T) {
+	loadCredentials = func(OtcOptions) (OtcAuthOptionsSecret, error) {
+		return OtcAuthOptionsSecret{}, nil
 	}
-	getProviderClient = func(authOpts golangsdk.AuthOptionsProvider) (*golangsdk.ProviderClient, error) {
+	getProviderClient = func(golangsdk.AuthOptionsProvider, OtcEndpoints) (*golangsdk.ProviderClient, error) {
 		return nil, errors.New("auth fail")
 	}
 
-	err := SetupOtcClient()
+	_, credentialsWatcher, err := NewOtcCertificateServices(OtcOptions{}, adapter.DefaultRetryPolicy, DefaultOptions())
 
+	assert.Nil(t, credentialsWatcher)
 	assert.Equal(t, "auth fail", err.Error())
 }
 
-func TestSetupOtcClient_wafClientFails(t *testing.T) {
-
-	getAuthOptionsFromMountedSecret = func() error {
-		authOptions = OtcAuthOptionsSecret{}
-		return nil
-	}
-	getProviderClient = func(authOpts golangsdk.AuthOptionsProvider) (*golangsdk.ProviderClient, error) {
-		provider := golangsdk.ProviderClient{}
-		return &provider, nil
-	}
-	newWafV1 = func(provider *golangsdk.ProviderClient, opts golangsdk.EndpointOpts) (*golangsdk.ServiceClient, error) {
+func TestNewCertificateServicesForProvider_wafClientFails(t *testing.T) {
+	stubOtcClients(func(provider *golangsdk.ProviderClient, opts golangsdk.EndpointOpts) (*golangsdk.ServiceClient, error) {
 		return nil, errors.New("service client not created")
-	}
-	err := SetupOtcClient()
+	})
+
+	_, err := NewCertificateServicesForProvider(
+		&golangsdk.ProviderClient{}, "eu-de", adapter.DefaultRetryPolicy, DefaultOptions())
 
 	assert.Equal(t, "service client not created", err.Error())
 }
+
+func TestNewCertificateServicesForProvider_defaultWafTypeIsRequired(t *testing.T) {
+	stubOtcClients(func(provider *golangsdk.ProviderClient, opts golangsdk.EndpointOpts) (*golangsdk.ServiceClient, error) {
+		return &golangsdk.ServiceClient{}, nil
+	})
+	options := DefaultOptions()
+	options.WafType = WafTypeDedicated
+
+	_, err := NewCertificateServicesForProvider(&golangsdk.ProviderClient{}, "eu-de", adapter.DefaultRetryPolicy, options)
+
+	assert.Equal(t, "no dedicated waf endpoint", err.Error())
+}
+
+// writeCredentialsFiles returns the otc options with the credentials mount path the files are written to.
+func writeCredentialsFiles(t *testing.T, files map[string]string) OtcOptions {
+	credentialsMountPath := t.TempDir() + "/"
+	for file, content := range files {
+		assert.Nil(t, os.WriteFile(credentialsMountPath+file, []byte(content), 0644))
+	}
+	return OtcOptions{CredentialsMountPath: credentialsMountPath}
+}
+
+func TestReadMountedCredentials_akSkWithoutPasswordFiles(t *testing.T) {
+	otcOptions := writeCredentialsFiles(t, map[string]string{
+		"accessKey":   "access-key\n",
+		"secretKey":   "secret-key\r\n",
+		"projectName": "eu-de_project\n",
+	})
+
+	authOptions, err := readCredentials(otcOptions)
+
+	assert.Nil(t, err)
+	assert.Equal(t, OtcAuthOptionsSecret{
+		accessKey:   "access-key",
+		secretKey:   "secret-key",
+		projectName: "eu-de_project",
+		region:      "eu-de",
+	}, authOptions)
+}
+
+func TestReadMountedCredentials_passwordWithoutAkSkFiles(t *testing.T) {
+	otcOptions := writeCredentialsFiles(t, map[string]string{
+		"username":       "Robin\n",
+		"password":       "abc123 \n",
+		"otcAccountName": "OTC-EU-DE-00000000",
+		"projectName":    "eu-de_project",
+	})
+
+	authOptions, err := readCredentials(otcOptions)
+
+	assert.Nil(t, err)
+	assert.Equal(t, OtcAuthOptionsSecret{
+		username:       "Robin",
+		password:       "abc123 ",
+		otcAccountName: "OTC-EU-DE-00000000",
+		projectName:    "eu-de_project",
+		region:         "eu-de",
+	}, authOptions)
+}
+
+func TestReadMountedCredentials_missingFields(t *testing.T) {
+	otcOptions := writeCredentialsFiles(t, map[string]string{"username": "Robin", "otcAccountName": "\n"})
+	_, err := readCredentials(otcOptions)
+	assert.Equal(t, "the password credentials are incomplete, missing: password, otcAccountName, projectName", err.Error())
+
+	otcOptions = writeCredentialsFiles(t, map[string]string{"accessKey": "access-key", "projectName": "eu-de_project"})
+	_, err = readCredentials(otcOptions)
+	assert.Equal(t, "the ak/sk credentials are incomplete, missing: secretKey", err.Error())
+}
+
+func TestReadCredentials_static(t *testing.T) {
+	otcOptions := OtcOptions{StaticCredentials: map[string]string{
+		"accessKey":   "access-key",
+		"secretKey":   "secret-key",
+		"projectName": "eu-de_project",
+	}}
+
+	authOptions, err := readCredentials(otcOptions)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "access-key", authOptions.accessKey)
+	assert.Equal(t, "eu-de", authOptions.region)
+	version, err := credentialsVersion(otcOptions.CredentialsMountPath)
+	assert.Nil(t, err)
+	assert.Empty(t, version)
+}
+
+func TestGetAuthOptions_temporaryAkSkWithAgency(t *testing.T) {
+	otcOptions := writeCredentialsFiles(t, map[string]string{
+		"accessKey":        "access-key",
+		"secretKey":        "secret-key",
+		"securityToken":    "security-token",
+		"otcAccountName":   "OTC-EU-DE-00000001",
+		"projectName":      "eu-de_project",
+		"agencyName":       "waf-cert-uploader",
+		"agencyDomainName": "OTC-EU-DE-00000000",
+	})
+	authOptions, err := readCredentials(otcOptions)
+	assert.Nil(t, err)
+
+	authOpts := getAuthOptions(authOptions, otcOptions.Endpoints)
+
+	assert.Equal(t, golangsdk.AKSKAuthOptions{
+		IdentityEndpoint: "https://iam.eu-de.otc.t-systems.com:443/v3",
+		Region:           "eu-de",
+		Domain:           "OTC-EU-DE-00000001",
+		AccessKey:        "access-key",
+		SecretKey:        "secret-key",
+		SecurityToken:    "security-token",
+		AgencyName:       "waf-cert-uploader",
+		AgencyDomainName: "OTC-EU-DE-00000000",
+		DelegatedProject: "eu-de_project",
+	}, authOpts)
+}
+
+func TestGetAuthOptions_passwordWithAgency(t *testing.T) {
+	otcOptions := writeCredentialsFiles(t, map[string]string{
+		"username":         "Robin",
+		"password":         "abc123",
+		"otcAccountName":   "OTC-EU-DE-00000001",
+		"projectName":      "eu-de_project",
+		"agencyName":       "waf-cert-uploader",
+		"agencyDomainName": "OTC-EU-DE-00000000",
+	})
+	authOptions, err := readCredentials(otcOptions)
+	assert.Nil(t, err)
+
+	authOpts := getAuthOptions(authOptions, otcOptions.Endpoints)
+
+	assert.Equal(t, golangsdk.AuthOptions{
+		IdentityEndpoint: "https://iam.eu-de.otc.t-systems.com:443/v3",
+		Username:         "Robin",
+		Password:         "abc123",
+		DomainName:       "OTC-EU-DE-00000001",
+		AllowReauth:      true,
+		AgencyName:       "waf-cert-uploader",
+		AgencyDomainName: "OTC-EU-DE-00000000",
+		DelegatedProject: "eu-de_project",
+	}, authOpts)
+}
+
+func TestDetectAuthMode(t *testing.T) {
+	mode, err := detectAuthMode(map[string]string{
+		"accessKey": "access-key", "secretKey": "secret-key", "securityToken": "token", "projectName": "eu-de_project"})
+	assert.Nil(t, err)
+	assert.Equal(t, authModeTemporaryAkSk, mode)
+
+	_, err = detectAuthMode(map[string]string{"securityToken": "token", "projectName": "eu-de_project"})
+	assert.Equal(t, "the temporary ak/sk credentials are incomplete, missing: accessKey, secretKey", err.Error())
+
+	_, err = detectAuthMode(map[string]string{
+		"accessKey": "access-key", "secretKey": "secret-key", "projectName": "eu-de_project", "agencyName": "agency"})
+	assert.Equal(t, "the ak/sk agency credentials are incomplete, missing: agencyDomainName, otcAccountName", err.Error())
+}
@@ -0,0 +1,122 @@
+package service
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	wafDomain "github.com/opentelekomcloud/gophertelekomcloud/openstack/waf/v1/domains"
+	"github.com/thoas/go-funk"
+	"log"
+	"strings"
+	"sync"
+	"time"
+	"waf-cert-uploader/adapter"
+)
+
+const autoDomainHostnames = "auto"
+
+var (
+	ErrWafDomainNotFound  = errors.New("no waf domain found for hostname")
+	ErrWafDomainAmbiguous = errors.New("more than one waf domain found for hostname")
+)
+
+var DomainCacheTtl = 5 * time.Minute
+
+type domainCache struct {
+	waf       adapter.WafCertificateManager
+	mutex     sync.Mutex
+	domains   []wafDomain.Domain
+	expiresAt time.Time
+}
+
+func (c *domainCache) list() ([]wafDomain.Domain, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.domains != nil && now().Before(c.expiresAt) {
+		return c.domains, nil
+	}
+
+	domains, err := c.waf.ListDomains()
+	if err != nil {
+		log.Println("couldn't list the waf domains", err)
+		return nil, err
+	}
+	c.domains = domains
+	c.expiresAt = now().Add(DomainCacheTtl)
+	return domains, nil
+}
+
+func (c *domainCache) invalidate() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.domains = nil
+}
+
+func (s *CertificateService) resolveWafDomainIds(certSecret CertificateSecret, leafCertificate *x509.Certificate) ([]string, error) {
+	if len(certSecret.wafDomainHostnames) == 0 {
+		return certSecret.wafDomainIds, nil
+	}
+
+	domains, err := s.domainCache.list()
+	if err != nil {
+		return nil, err
+	}
+
+	wafDomainIds := append([]string{}, certSecret.wafDomainIds...)
+	for _, hostname := range certSecret.wafDomainHostnames {
+		var resolvedIds []string
+		if hostname == autoDomainHostnames {
+			resolvedIds, err = findWafDomainIdsForCertificate(domains, leafCertificate)
+		} else {
+			resolvedIds, err = findWafDomainIdsForHostname(domains, hostname)
+		}
+		if err != nil {
+			s.domainCache.invalidate()
+			return nil, err
+		}
+		for _, domainId := range resolvedIds {
+			if !funk.ContainsString(wafDomainIds, domainId) {
+				wafDomainIds = append(wafDomainIds, domainId)
+			}
+		}
+	}
+	return wafDomainIds, nil
+}
+
+func findWafDomainIdsForHostname(domains []wafDomain.Domain, hostname string) ([]string, error) {
+	var domainIds []string
+	for _, domain := range domains {
+		if strings.EqualFold(domain.HostName, hostname) {
+			domainIds = append(domainIds, domain.Id)
+		}
+	}
+
+	if len(domainIds) == 0 {
+		return nil, fmt.Errorf("%w %s", ErrWafDomainNotFound, hostname)
+	}
+	if len(domainIds) > 1 {
+		return nil, fmt.Errorf("%w %s: %s", ErrWafDomainAmbiguous, hostname, strings.Join(domainIds, ", "))
+	}
+	log.Printf("resolved hostname %s to waf domain %s", hostname, domainIds[0])
+	return domainIds, nil
+}
+
+func findWafDomainIdsForCertificate(domains []wafDomain.Domain, leafCertificate *x509.Certificate) ([]string, error) {
+	var domainIds []string
+	for _, dnsName := range leafCertificate.DNSNames {
+		resolvedIds, err := findWafDomainIdsForHostname(domains, dnsName)
+		if errors.Is(err, ErrWafDomainNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		domainIds = append(domainIds, resolvedIds...)
+	}
+
+	if len(domainIds) == 0 {
+		return nil, fmt.Errorf("%w %s", ErrWafDomainNotFound, strings.Join(leafCertificate.DNSNames, ", "))
+	}
+	return domainIds, nil
+}
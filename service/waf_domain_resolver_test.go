@@ -0,0 +1,87 @@
+package service
+
+import (
+	wafDomain "github.com/opentelekomcloud/gophertelekomcloud/openstack/waf/v1/domains"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"waf-cert-uploader/adapter"
+)
+
+func setupWafDomainList(domains []wafDomain.Domain) (*CertificateService, *adapter.FakeWafCertificateManager) {
+	fakeWaf := adapter.NewFakeWafCertificateManager()
+	for _, domain := range domains {
+		fakeWaf.AddDomain(domain)
+	}
+	return NewCertificateService(fakeWaf, DefaultOptions()), fakeWaf
+}
+
+func TestResolveWafDomainIds_ByHostname(t *testing.T) {
+	certificateService, fakeWaf := setupWafDomainList([]wafDomain.Domain{
+		{Id: "domain-1", HostName: "my.domain.com"},
+		{Id: "domain-2", HostName: "other.domain.com"},
+	})
+	certSecret := CertificateSecret{
+		wafDomainIds:       []string{"domain-0"},
+		wafDomainHostnames: []string{"My.Domain.com"},
+	}
+
+	result, err := certificateService.resolveWafDomainIds(certSecret, nil)
+	assert.Nil(t, err)
+	assert.EqualValues(t, []string{"domain-0", "domain-1"}, result)
+
+	_, err = certificateService.resolveWafDomainIds(certSecret, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"ListDomains"}, fakeWaf.Calls())
+}
+
+func TestResolveWafDomainIds_Auto(t *testing.T) {
+	certificateService, _ := setupWafDomainList([]wafDomain.Domain{
+		{Id: "domain-1", HostName: "my.domain.com"},
+		{Id: "domain-2", HostName: "other.domain.com"},
+		{Id: "domain-3", HostName: "unrelated.com"},
+	})
+	leaf := createTestLeafCertificate("my.domain.com", "other.domain.com", "not-in-waf.domain.com")
+	certSecret := CertificateSecret{wafDomainHostnames: []string{"auto"}}
+
+	result, err := certificateService.resolveWafDomainIds(certSecret, leaf.certificate)
+
+	assert.Nil(t, err)
+	assert.EqualValues(t, []string{"domain-1", "domain-2"}, result)
+}
+
+func TestResolveWafDomainIds_NotFound(t *testing.T) {
+	certificateService, fakeWaf := setupWafDomainList([]wafDomain.Domain{{Id: "domain-1", HostName: "my.domain.com"}})
+	certSecret := CertificateSecret{wafDomainHostnames: []string{"typo.domain.com"}}
+
+	_, err := certificateService.resolveWafDomainIds(certSecret, nil)
+	assert.ErrorIs(t, err, ErrWafDomainNotFound)
+	assert.Equal(t, "no waf domain found for hostname typo.domain.com", err.Error())
+
+	_, err = certificateService.resolveWafDomainIds(certSecret, nil)
+	assert.ErrorIs(t, err, ErrWafDomainNotFound)
+	assert.Equal(t, []string{"ListDomains", "ListDomains"}, fakeWaf.Calls())
+}
+
+func TestResolveWafDomainIds_Ambiguous(t *testing.T) {
+	certificateService, _ := setupWafDomainList([]wafDomain.Domain{
+		{Id: "domain-1", HostName: "my.domain.com"},
+		{Id: "domain-2", HostName: "my.domain.com"},
+	})
+	certSecret := CertificateSecret{wafDomainHostnames: []string{"my.domain.com"}}
+
+	_, err := certificateService.resolveWafDomainIds(certSecret, nil)
+
+	assert.ErrorIs(t, err, ErrWafDomainAmbiguous)
+	assert.Equal(t, "more than one waf domain found for hostname my.domain.com: domain-1, domain-2", err.Error())
+}
+
+func TestResolveWafDomainIds_WithoutHostnames(t *testing.T) {
+	certificateService, fakeWaf := setupWafDomainList(nil)
+	certSecret := CertificateSecret{wafDomainIds: []string{"domain-1"}}
+
+	result, err := certificateService.resolveWafDomainIds(certSecret, nil)
+
+	assert.Nil(t, err)
+	assert.EqualValues(t, []string{"domain-1"}, result)
+	assert.Empty(t, fakeWaf.Calls())
+}
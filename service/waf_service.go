@@ -2,67 +2,281 @@ package service
 
 import (
 	"crypto/sha256"
+	"crypto/x509"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	waf "github.com/opentelekomcloud/gophertelekomcloud/openstack/waf/v1/certificates"
 	wafDomain "github.com/opentelekomcloud/gophertelekomcloud/openstack/waf/v1/domains"
 	"github.com/thoas/go-funk"
 	apiv1 "k8s.io/api/core/v1"
 	"log"
+	"strconv"
 	"strings"
 	"waf-cert-uploader/adapter"
+	"waf-cert-uploader/metrics"
 )
 
 type CertificateSecret struct {
-	certName    string
-	tlsCert     string
-	tlsKey      string
-	domainName  string
-	wafDomainId string
-	certWafId   string
+	namespace              string
+	name                   string
+	certName               string
+	tlsCert                string
+	tlsKey                 string
+	domainName             string
+	wafDomainIds           []string
+	wafDomainHostnames     []string
+	wafType                WafType
+	targets                []TargetName
+	certIds                map[TargetName]string
+	hostnameMismatchPolicy HostnameMismatchPolicy
+	httpsBackend           HttpsBackend
+	elbListenerIds         []string
+	elbCertificateBinding  ElbCertificateBinding
 }
 
-func CreateOrUpdateCertificate(secret apiv1.Secret) (*string, error) {
-	certSecret := getCertificateSecret(secret)
-	certIdInWaf, err := findCertInWaf(certSecret)
+type HttpsBackend struct {
+	ServerProtocol string
+	Port           int
+}
+
+type UploadResult struct {
+	CertIds map[TargetName]string
+	// Attachments are the resources of every target the certificate was attached to by this upload.
+	Attachments map[TargetName][]DomainAttachment
+	Warnings    []string
+}
+
+// DomainAttachment is the result of attaching a certificate to a waf domain or, for the elb, to a listener.
+type DomainAttachment struct {
+	DomainId string
+	Err      error
+	// Restored is set if the domain was attached, but got its previous certificate back during the rollback.
+	Restored bool
+}
+
+// DomainAttachmentError shares its attachments with the binding, so the domains restored during the rollback
+// aren't reported as attached.
+type DomainAttachmentError struct {
+	CertId      string
+	Attachments []DomainAttachment
+}
+
+func (e *DomainAttachmentError) Error() string {
+	var failures, attachedDomainIds, restoredDomainIds []string
+	for _, attachment := range e.Attachments {
+		if attachment.Err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", attachment.DomainId, attachment.Err.Error()))
+		} else if attachment.Restored {
+			restoredDomainIds = append(restoredDomainIds, attachment.DomainId)
+		} else {
+			attachedDomainIds = append(attachedDomainIds, attachment.DomainId)
+		}
+	}
+	message := fmt.Sprintf("certificate %s couldn't be attached to all waf domains (%s)",
+		e.CertId, strings.Join(failures, ", "))
+	if len(attachedDomainIds) > 0 {
+		message += fmt.Sprintf(", it is still attached to %s", strings.Join(attachedDomainIds, ", "))
+	}
+	if len(restoredDomainIds) > 0 {
+		message += fmt.Sprintf(", the previous certificate was restored on %s", strings.Join(restoredDomainIds, ", "))
+	}
+	return message
+}
+
+func (e *DomainAttachmentError) Unwrap() []error {
+	var errs []error
+	for _, attachment := range e.Attachments {
+		if attachment.Err != nil {
+			errs = append(errs, attachment.Err)
+		}
+	}
+	return errs
+}
+
+// CertificateService uploads the certificates of secrets to the waf managed by its WafCertificateManager.
+type CertificateService struct {
+	waf         adapter.WafCertificateManager
+	domainCache *domainCache
+	options     Options
+}
+
+func NewCertificateService(wafCertificateManager adapter.WafCertificateManager, options Options) *CertificateService {
+	return &CertificateService{
+		waf:         wafCertificateManager,
+		domainCache: &domainCache{waf: wafCertificateManager},
+		options:     options,
+	}
+}
+
+// CreateOrUpdateCertificate uploads the certificate of the secret to this waf, regardless of the targets of the secret.
+func (s *CertificateService) CreateOrUpdateCertificate(secret apiv1.Secret) (*UploadResult, error) {
+	return createOrUpdateCertificate(secret, s.options, func(CertificateSecret) ([]selectedTarget, error) {
+		return []selectedTarget{{name: TargetWaf, target: s}}, nil
+	})
+}
+
+// wafDomainBinding attaches a certificate to the waf domains of a secret.
+type wafDomainBinding struct {
+	service         *CertificateService
+	certSecret      CertificateSecret
+	leafCertificate *x509.Certificate
+	existingDomains map[string]wafDomain.Domain
+	warnings        []string
+	attachments     []DomainAttachment
+}
+
+// PrepareBinding reads the waf domains of the secret and checks that the certificate covers their hostnames.
+// A secret without waf domains can only use a certificate that exists in the waf already.
+func (s *CertificateService) PrepareBinding(
+	certSecret CertificateSecret,
+	leafCertificate *x509.Certificate) (CertificateBinding, error) {
+	binding := &wafDomainBinding{service: s, certSecret: certSecret, leafCertificate: leafCertificate}
+	if len(certSecret.wafDomainIds) == 0 && len(certSecret.wafDomainHostnames) == 0 {
+		return binding, nil
+	}
 
+	var err error
+	binding.certSecret.wafDomainIds, err = s.resolveWafDomainIds(certSecret, leafCertificate)
 	if err != nil {
 		return nil, err
 	}
 
-	if certIdInWaf != nil {
-		log.Println("the certificate already exists in the waf")
-		return certIdInWaf, nil
-	} else {
-		log.Println("the certificate does not exist in the waf yet...")
-		certId, err := uploadNewCertificate(certSecret)
+	binding.existingDomains, binding.warnings, err = s.getWafDomains(binding.certSecret, leafCertificate)
+	if err != nil {
+		return nil, err
+	}
+	return binding, nil
+}
+
+func (b *wafDomainBinding) Bind(certId string) error {
+	if len(b.certSecret.wafDomainIds) == 0 {
+		return nil
+	}
+
+	var detachedDomainIds []string
+	for _, domainId := range b.certSecret.wafDomainIds {
+		if b.existingDomains[domainId].CertificateId != certId {
+			detachedDomainIds = append(detachedDomainIds, domainId)
+		}
+	}
 
+	if len(detachedDomainIds) == 0 {
+		log.Println("the certificate is attached to all waf domains")
+	} else {
+		log.Printf("the certificate is not attached to the waf domains %s, attaching it...",
+			strings.Join(detachedDomainIds, ", "))
+		certSecret := b.certSecret
+		certSecret.wafDomainIds = detachedDomainIds
+		var err error
+		b.attachments, err = b.service.attachCertificateToWafDomains(certSecret, b.existingDomains, certId)
 		if err != nil {
-			return nil, err
+			return err
+		}
+	}
+	metrics.SetCertificateExpiry(
+		b.certSecret.namespace, b.certSecret.name, b.certSecret.wafDomainIds, b.leafCertificate.NotAfter)
+	return nil
+}
+
+// Restore reattaches the previous certificates of the waf domains the new certificate was attached to and marks
+// them as restored.
+func (b *wafDomainBinding) Restore() error {
+	var errs []error
+	for i, attachment := range b.attachments {
+		if attachment.Err == nil {
+			err := b.service.restoreWafDomain(b.existingDomains[attachment.DomainId], attachment.DomainId)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			b.attachments[i].Restored = true
 		}
+	}
+	return errors.Join(errs...)
+}
+
+func (b *wafDomainBinding) Warnings() []string {
+	return b.warnings
+}
 
-		err = attachCertificateToWafDomain(certSecret.wafDomainId, *certId)
+func (b *wafDomainBinding) Attachments() []DomainAttachment {
+	return b.attachments
+}
+
+func (s *CertificateService) getWafDomains(
+	certSecret CertificateSecret,
+	leafCertificate *x509.Certificate) (map[string]wafDomain.Domain, []string, error) {
+	if len(certSecret.wafDomainIds) == 0 {
+		return nil, nil, fmt.Errorf(
+			"%w: the secret has neither a waf domain id nor a waf domain hostname annotation", ErrInvalidConfiguration)
+	}
 
+	existingDomains := map[string]wafDomain.Domain{}
+	var warnings []string
+	for _, domainId := range certSecret.wafDomainIds {
+		existingDomain, err := s.waf.GetDomain(domainId)
 		if err != nil {
-			return nil, err
+			log.Printf("couldn't get the waf domain %s: %v", domainId, err)
+			return nil, nil, err
 		}
 
-		if len(certSecret.certWafId) > 0 {
-			deletePreviousCertificate(certSecret.certWafId)
+		domainWarnings, err := checkHostnameCoverage(
+			leafCertificate, existingDomain.HostName, certSecret.hostnameMismatchPolicy)
+		if err != nil {
+			return nil, nil, err
 		}
-		return certId, nil
+		warnings = append(warnings, domainWarnings...)
+		existingDomains[domainId] = *existingDomain
+	}
+	return existingDomains, warnings, nil
+}
+
+func (s *CertificateService) attachCertificateToWafDomains(
+	certSecret CertificateSecret,
+	existingDomains map[string]wafDomain.Domain,
+	certId string) ([]DomainAttachment, error) {
+	var attachments []DomainAttachment
+	failed := false
+	for _, domainId := range certSecret.wafDomainIds {
+		err := s.attachCertificateToWafDomain(existingDomains[domainId], domainId, certId, certSecret.httpsBackend)
+		attachments = append(attachments, DomainAttachment{DomainId: domainId, Err: err})
+		failed = failed || err != nil
 	}
+
+	if failed {
+		return attachments, &DomainAttachmentError{CertId: certId, Attachments: attachments}
+	}
+	return attachments, nil
 }
 
-func attachCertificateToWafDomain(domainId string, certId string) error {
-	newServerOpts, err := getNewServerOpts(domainId)
+// restoreWafDomain fails for a domain that had no certificate before, the waf can't detach a certificate
+// from a domain with https server entries.
+func (s *CertificateService) restoreWafDomain(existingDomain wafDomain.Domain, domainId string) error {
+	if len(existingDomain.CertificateId) == 0 {
+		return fmt.Errorf("waf domain %s had no certificate before and keeps the new one", domainId)
+	}
+
+	_, err := s.waf.UpdateDomain(domainId, wafDomain.UpdateOpts{
+		CertificateId: existingDomain.CertificateId,
+		Server:        toServerOpts(existingDomain.Server),
+	})
 	if err != nil {
-		log.Println(err)
-		return err
+		log.Printf("waf domain %s couldn't be restored: %v", domainId, err)
+		return fmt.Errorf("waf domain %s couldn't be restored: %w", domainId, err)
 	}
+	log.Printf("waf domain %s was restored to certificate %s", domainId, existingDomain.CertificateId)
+	return nil
+}
 
-	_, err = adapter.UpdateDomainAndExtract(WafClient, domainId, wafDomain.UpdateOpts{
+func (s *CertificateService) attachCertificateToWafDomain(
+	existingDomain wafDomain.Domain,
+	domainId string,
+	certId string,
+	httpsBackend HttpsBackend) error {
+	_, err := s.waf.UpdateDomain(domainId, wafDomain.UpdateOpts{
 		CertificateId: certId,
-		Server:        *newServerOpts,
+		Server:        getNewServerOpts(existingDomain, httpsBackend),
 	})
 	if err != nil {
 		log.Println(err)
@@ -72,40 +286,52 @@ func attachCertificateToWafDomain(domainId string, certId string) error {
 	return nil
 }
 
-func getNewServerOpts(domainId string) (*[]wafDomain.ServerOpts, error) {
-	existingDomain, err := adapter.GetWafDomainAndExtract(WafClient, domainId)
-	if err != nil {
-		return nil, err
+func getNewServerOpts(existingDomain wafDomain.Domain, httpsBackend HttpsBackend) []wafDomain.ServerOpts {
+	newOpts := toServerOpts(existingDomain.Server)
+	addressesWithHttps := map[string]bool{}
+	var addresses []string
+
+	for _, server := range existingDomain.Server {
+		if _, seen := addressesWithHttps[server.Address]; !seen {
+			addresses = append(addresses, server.Address)
+		}
+		addressesWithHttps[server.Address] = addressesWithHttps[server.Address] || server.ClientProtocol == "HTTPS"
 	}
-	newOpts := []wafDomain.ServerOpts{
-		{
+
+	for _, address := range addresses {
+		if addressesWithHttps[address] {
+			continue
+		}
+		log.Printf("adding https server entry for address %s", address)
+		newOpts = append(newOpts, wafDomain.ServerOpts{
 			ClientProtocol: "HTTPS",
-			ServerProtocol: "HTTPS",
-			Address:        existingDomain.Server[0].Address,
-			Port:           443,
-		},
-		{
-			ClientProtocol: "HTTP",
-			ServerProtocol: "HTTP",
-			Address:        existingDomain.Server[0].Address,
-			Port:           80,
-		},
-	}
-	return &newOpts, nil
-}
-
-func deletePreviousCertificate(id string) {
-	_, err := adapter.DeleteAndExtract(WafClient, id)
-	if err != nil {
-		log.Println("previous certificate couldn't be deleted", err)
-	} else {
-		log.Printf("previous certificate with id %s was deleted successfully", id)
+			ServerProtocol: httpsBackend.ServerProtocol,
+			Address:        address,
+			Port:           httpsBackend.Port,
+		})
 	}
+	return newOpts
+}
+
+func toServerOpts(servers []wafDomain.Server) []wafDomain.ServerOpts {
+	var serverOpts []wafDomain.ServerOpts
+	for _, server := range servers {
+		serverOpts = append(serverOpts, wafDomain.ServerOpts{
+			ClientProtocol: server.ClientProtocol,
+			ServerProtocol: server.ServerProtocol,
+			Address:        server.Address,
+			Port:           server.Port,
+		})
+	}
+	return serverOpts
+}
+
+func (s *CertificateService) DeleteCertificate(certId string) error {
+	return s.waf.DeleteCertificate(certId)
 }
 
-func findCertInWaf(secret CertificateSecret) (*string, error) {
-	log.Println("trying to find certificate in the waf...")
-	certs, err := adapter.ListAndExtract(WafClient, waf.ListOpts{})
+func (s *CertificateService) FindCertificate(secret CertificateSecret) (*string, error) {
+	certs, err := s.waf.ListCertificates()
 	if err != nil {
 		log.Println("couldn't get existing certificates from the waf ", err)
 		return nil, err
@@ -127,7 +353,12 @@ func findCertInWaf(secret CertificateSecret) (*string, error) {
 	}
 }
 
-func uploadNewCertificate(certSecret CertificateSecret) (*string, error) {
+func (s *CertificateService) UploadCertificate(certSecret CertificateSecret) (string, error) {
+	if len(certSecret.wafDomainIds) == 0 && len(certSecret.wafDomainHostnames) == 0 {
+		return "", fmt.Errorf(
+			"%w: the secret has neither a waf domain id nor a waf domain hostname annotation", ErrInvalidConfiguration)
+	}
+
 	log.Println("uploading a new certificate to web application firewall...")
 	log.Println("certificate domain name: " + certSecret.domainName)
 
@@ -137,36 +368,122 @@ func uploadNewCertificate(certSecret CertificateSecret) (*string, error) {
 		Key:     certSecret.tlsKey,
 	}
 
-	certificate, err := adapter.CreateAndExtract(WafClient, createOpts)
+	certificate, err := s.waf.CreateCertificate(createOpts)
 	if err != nil {
 		log.Println("certificate couldn't be uploaded ", err)
-		return nil, err
+		return "", err
 	}
 
 	log.Println("created a new certificate in waf with id " + certificate.Id)
-	return &certificate.Id, nil
+	return certificate.Id, nil
 }
 
-func getCertificateSecret(secret apiv1.Secret) CertificateSecret {
+func getCertificateSecret(secret apiv1.Secret, options Options) (CertificateSecret, error) {
 	tlsCertificate := secret.Data["tls.crt"]
 	tlsKey := secret.Data["tls.key"]
 
-	certWafId := secret.Annotations["waf-cert-uploader.iits.tech/cert-waf-id"]
-	wafDomainId := secret.Annotations["waf-cert-uploader.iits.tech/waf-domain-id"]
+	wafDomainIds := parseAnnotationList(secret.Annotations["waf-cert-uploader.iits.tech/waf-domain-id"])
+	wafDomainHostnames := parseAnnotationList(secret.Annotations["waf-cert-uploader.iits.tech/waf-domain-hostname"])
 
 	trimmedCert := strings.TrimSuffix(string(tlsCertificate), "\n")
 	trimmedKey := strings.TrimSuffix(string(tlsKey), "\n")
 
 	certHashString := getCertificateHash(tlsCertificate)
 
+	hostnameMismatchPolicy := options.HostnameMismatchPolicy
+	if policyAnnotation, found := secret.Annotations["waf-cert-uploader.iits.tech/hostname-mismatch-policy"]; found {
+		var err error
+		hostnameMismatchPolicy, err = ParseHostnameMismatchPolicy(policyAnnotation)
+		if err != nil {
+			log.Println("invalid hostname mismatch policy annotation", err)
+			return CertificateSecret{}, fmt.Errorf("%w: %w", ErrInvalidConfiguration, err)
+		}
+	}
+
+	httpsBackend, err := ParseHttpsBackend(
+		options.HttpsBackend,
+		secret.Annotations["waf-cert-uploader.iits.tech/https-server-protocol"],
+		secret.Annotations["waf-cert-uploader.iits.tech/https-server-port"])
+	if err != nil {
+		log.Println("invalid https server annotation", err)
+		return CertificateSecret{}, fmt.Errorf("%w: %w", ErrInvalidConfiguration, err)
+	}
+
+	wafType, err := getWafType(secret, options.WafType)
+	if err != nil {
+		return CertificateSecret{}, err
+	}
+
+	targets, err := getTargets(secret)
+	if err != nil {
+		return CertificateSecret{}, err
+	}
+
+	certIds, err := parseCertIds(secret)
+	if err != nil {
+		return CertificateSecret{}, err
+	}
+
+	elbCertificateBinding := ElbCertificateBindingDefault
+	if bindingAnnotation, found := secret.Annotations["waf-cert-uploader.iits.tech/elb-certificate-binding"]; found {
+		elbCertificateBinding, err = ParseElbCertificateBinding(bindingAnnotation)
+		if err != nil {
+			log.Println("invalid elb certificate binding annotation", err)
+			return CertificateSecret{}, fmt.Errorf("%w: %w", ErrInvalidConfiguration, err)
+		}
+	}
+
 	return CertificateSecret{
-		certName:    certHashString,
-		tlsCert:     trimmedCert,
-		tlsKey:      trimmedKey,
-		domainName:  secret.Annotations["cert-manager.io/certificate-name"],
-		certWafId:   certWafId,
-		wafDomainId: wafDomainId,
+		namespace:              secret.Namespace,
+		name:                   secret.Name,
+		certName:               certHashString,
+		tlsCert:                trimmedCert,
+		tlsKey:                 trimmedKey,
+		domainName:             secret.Annotations["cert-manager.io/certificate-name"],
+		wafDomainIds:           wafDomainIds,
+		wafDomainHostnames:     wafDomainHostnames,
+		wafType:                wafType,
+		targets:                targets,
+		certIds:                certIds,
+		hostnameMismatchPolicy: hostnameMismatchPolicy,
+		httpsBackend:           httpsBackend,
+		elbListenerIds:         parseAnnotationList(secret.Annotations["waf-cert-uploader.iits.tech/elb-listener-id"]),
+		elbCertificateBinding:  elbCertificateBinding,
+	}, nil
+}
+
+func parseAnnotationList(annotation string) []string {
+	var values []string
+	for _, value := range strings.Split(annotation, ",") {
+		value = strings.TrimSpace(value)
+		if len(value) > 0 && !funk.ContainsString(values, value) {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func ParseHttpsBackend(defaults HttpsBackend, serverProtocol string, port string) (HttpsBackend, error) {
+	httpsBackend := defaults
+	if len(serverProtocol) > 0 {
+		httpsBackend.ServerProtocol = strings.ToUpper(strings.TrimSpace(serverProtocol))
+		if httpsBackend.ServerProtocol != "HTTP" && httpsBackend.ServerProtocol != "HTTPS" {
+			return HttpsBackend{}, fmt.Errorf("unknown https server protocol %q", serverProtocol)
+		}
 	}
+	if len(port) > 0 {
+		parsedPort, err := strconv.Atoi(strings.TrimSpace(port))
+		if err != nil || parsedPort < 1 || parsedPort > 65535 {
+			return HttpsBackend{}, fmt.Errorf("invalid https server port %q", port)
+		}
+		httpsBackend.Port = parsedPort
+	}
+	return httpsBackend, nil
+}
+
+// CertificateHash returns the hash of the certificate of a secret, the uploaded certificates are named by it.
+func CertificateHash(secret apiv1.Secret) string {
+	return getCertificateHash(secret.Data["tls.crt"])
 }
 
 func getCertificateHash(tlsCertificateBase64 []byte) string {
@@ -12,8 +12,14 @@ import (
 )
 
 func TestCreateOrUpdateCertificate_Create(t *testing.T) {
-	setupWafTestClient()
-	var domainUpdateOptsSlot wafDomain.UpdateOpts
+	testCert := createTestLeafCertificate("my.domain.com")
+	fakeWaf := adapter.NewFakeWafCertificateManager()
+	fakeWaf.AddDomain(wafDomain.Domain{Id: "45656165da65456", HostName: "my.domain.com", Server: []wafDomain.Server{{
+		ClientProtocol: "HTTP",
+		ServerProtocol: "HTTP",
+		Address:        "abc.def.iits.tech",
+		Port:           80,
+	}}})
 	secret := apiv1.Secret{
 		ObjectMeta: v1.ObjectMeta{
 			ResourceVersion: "version1",
@@ -22,84 +28,100 @@ func TestCreateOrUpdateCertificate_Create(t *testing.T) {
 			},
 		},
 		Data: map[string][]byte{
-			"tls.crt": []byte("any cert"),
-			"tls.key": []byte("any private key"),
+			"tls.crt": testCert.certPem,
+			"tls.key": testCert.keyPem,
 		},
 	}
-	var functionCalls []string
 
-	adapter.ListAndExtract = func(c *golangsdk.ServiceClient, opts waf.ListOptsBuilder) ([]waf.Certificate, error) {
-		functionCalls = append(functionCalls, "listAndExtract")
-		return []waf.Certificate{}, nil
-	}
+	result, _ := NewCertificateService(fakeWaf, DefaultOptions()).CreateOrUpdateCertificate(secret)
 
-	adapter.CreateAndExtract = func(c *golangsdk.ServiceClient, opts waf.CreateOpts) (*waf.Certificate, error) {
-		functionCalls = append(functionCalls, "CreateAndExtract")
-		return &waf.Certificate{Id: "1"}, nil
-	}
+	assert.Equal(t, "cert-1", result.CertIds[TargetWaf])
+	assert.EqualValues(t, []string{"ListCertificates", "GetDomain 45656165da65456", "CreateCertificate",
+		"UpdateDomain 45656165da65456"}, fakeWaf.Calls())
+	servers := fakeWaf.Domain("45656165da65456").Server
+	assert.EqualValues(t, "abc.def.iits.tech", servers[0].Address)
+	assert.EqualValues(t, "HTTP", servers[0].ClientProtocol)
+	assert.EqualValues(t, "HTTP", servers[0].ServerProtocol)
+	assert.EqualValues(t, 80, servers[0].Port)
+	assert.EqualValues(t, "abc.def.iits.tech", servers[1].Address)
+	assert.EqualValues(t, "HTTPS", servers[1].ClientProtocol)
+	assert.EqualValues(t, "HTTPS", servers[1].ServerProtocol)
+	assert.EqualValues(t, 443, servers[1].Port)
+	assert.Equal(t, "cert-1", fakeWaf.Domain("45656165da65456").CertificateId)
+}
 
-	adapter.GetWafDomainAndExtract = func(
-		c *golangsdk.ServiceClient,
-		domainID string) (*wafDomain.Domain, error) {
-		functionCalls = append(functionCalls, "GetWafDomainAndExtract")
-		wafDomainWithServer := wafDomain.Domain{Server: []wafDomain.Server{{
-			ClientProtocol: "HTTP",
-			ServerProtocol: "HTTP",
-			Address:        "abc.def.iits.tech",
-			Port:           80,
-		}}}
-		return &wafDomainWithServer, nil
+func TestCreateOrUpdateCertificate_Create_AlreadyExists(t *testing.T) {
+	testCert := createTestLeafCertificate("my.domain.com")
+	secret := apiv1.Secret{
+		Data: map[string][]byte{
+			"tls.crt": testCert.certPem,
+			"tls.key": testCert.keyPem,
+		},
 	}
+	fakeWaf := adapter.NewFakeWafCertificateManager()
+	fakeWaf.AddCertificate(waf.Certificate{Name: getCertificateHash(testCert.certPem), Id: "previous-id"})
 
-	adapter.UpdateDomainAndExtract = func(
-		c *golangsdk.ServiceClient,
-		domainID string,
-		opts wafDomain.UpdateOptsBuilder) (*wafDomain.Domain, error) {
-		functionCalls = append(functionCalls, "UpdateDomainAndExtract")
-		domainUpdateOptsSlot = opts.(wafDomain.UpdateOpts)
-		emptyWafDomain := wafDomain.Domain{}
-		return &emptyWafDomain, nil
-	}
+	result, _ := NewCertificateService(fakeWaf, DefaultOptions()).CreateOrUpdateCertificate(secret)
 
-	result, _ := CreateOrUpdateCertificate(secret)
-	assert.Equal(t, "1", *result)
-	assert.EqualValues(t, []string{"listAndExtract", "CreateAndExtract", "GetWafDomainAndExtract", "UpdateDomainAndExtract"}, functionCalls)
-	assert.EqualValues(t, "abc.def.iits.tech", domainUpdateOptsSlot.Server[0].Address)
-	assert.EqualValues(t, "HTTPS", domainUpdateOptsSlot.Server[0].ClientProtocol)
-	assert.EqualValues(t, "HTTPS", domainUpdateOptsSlot.Server[0].ServerProtocol)
-	assert.EqualValues(t, 443, domainUpdateOptsSlot.Server[0].Port)
-	assert.EqualValues(t, "abc.def.iits.tech", domainUpdateOptsSlot.Server[1].Address)
-	assert.EqualValues(t, "HTTP", domainUpdateOptsSlot.Server[1].ClientProtocol)
-	assert.EqualValues(t, "HTTP", domainUpdateOptsSlot.Server[1].ServerProtocol)
-	assert.EqualValues(t, 80, domainUpdateOptsSlot.Server[1].Port)
+	assert.Equal(t, "previous-id", result.CertIds[TargetWaf])
+	assert.EqualValues(t, []string{"ListCertificates"}, fakeWaf.Calls())
 }
 
-func TestCreateOrUpdateCertificate_Create_AlreadyExists(t *testing.T) {
+func TestCreateOrUpdateCertificate_AlreadyExistsAndAttached(t *testing.T) {
+	testCert := createTestLeafCertificate("my.domain.com")
 	secret := apiv1.Secret{
+		ObjectMeta: v1.ObjectMeta{
+			Annotations: map[string]string{
+				"waf-cert-uploader.iits.tech/cert-waf-id":   "existing-id",
+				"waf-cert-uploader.iits.tech/waf-domain-id": "45656165da65456",
+			},
+		},
 		Data: map[string][]byte{
-			"tls.crt": []byte("any cert"),
-			"tls.key": []byte("any private key"),
+			"tls.crt": testCert.certPem,
+			"tls.key": testCert.keyPem,
 		},
 	}
-	setupWafTestClient()
-	var functionCalls []string
-
-	adapter.ListAndExtract = func(c *golangsdk.ServiceClient, opts waf.ListOptsBuilder) ([]waf.Certificate, error) {
-		functionCalls = append(functionCalls, "ListAndExtract")
-		return []waf.Certificate{{
-			Name: "4f4eb3c8aaf131baaf5d781449260177b6a4099240d8c999acb7b3b60cb318ed",
-			Id:   "previous-id",
-		}}, nil
+	fakeWaf := adapter.NewFakeWafCertificateManager()
+	fakeWaf.AddCertificate(waf.Certificate{Name: getCertificateHash(testCert.certPem), Id: "existing-id"})
+	fakeWaf.AddDomain(wafDomain.Domain{Id: "45656165da65456", HostName: "my.domain.com", CertificateId: "existing-id"})
+
+	result, err := NewCertificateService(fakeWaf, DefaultOptions()).CreateOrUpdateCertificate(secret)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "existing-id", result.CertIds[TargetWaf])
+	assert.EqualValues(t, []string{"ListCertificates", "GetDomain 45656165da65456"}, fakeWaf.Calls())
+}
+
+func TestCreateOrUpdateCertificate_AlreadyExistsButDetached(t *testing.T) {
+	testCert := createTestLeafCertificate("my.domain.com")
+	secret := apiv1.Secret{
+		ObjectMeta: v1.ObjectMeta{
+			Annotations: map[string]string{
+				"waf-cert-uploader.iits.tech/cert-waf-id":   "previous-id",
+				"waf-cert-uploader.iits.tech/waf-domain-id": "45656165da65456",
+			},
+		},
+		Data: map[string][]byte{
+			"tls.crt": testCert.certPem,
+			"tls.key": testCert.keyPem,
+		},
 	}
+	fakeWaf := adapter.NewFakeWafCertificateManager()
+	fakeWaf.AddCertificate(waf.Certificate{Name: getCertificateHash(testCert.certPem), Id: "existing-id"})
+	fakeWaf.AddCertificate(waf.Certificate{Name: "previous-hash", Id: "previous-id"})
+	fakeWaf.AddDomain(wafDomain.Domain{Id: "45656165da65456", HostName: "my.domain.com", CertificateId: "previous-id"})
 
-	result, _ := CreateOrUpdateCertificate(secret)
+	result, err := NewCertificateService(fakeWaf, DefaultOptions()).CreateOrUpdateCertificate(secret)
 
-	assert.Equal(t, "previous-id", *result)
-	assert.EqualValues(t, []string{"ListAndExtract"}, functionCalls)
+	assert.Nil(t, err)
+	assert.Equal(t, "existing-id", result.CertIds[TargetWaf])
+	assert.EqualValues(t, []string{"ListCertificates", "GetDomain 45656165da65456",
+		"UpdateDomain 45656165da65456", "DeleteCertificate previous-id"}, fakeWaf.Calls())
+	assert.Equal(t, "existing-id", fakeWaf.Domain("45656165da65456").CertificateId)
 }
 
 func TestCreateOrUpdateCertificate_Update(t *testing.T) {
-	setupWafTestClient()
+	testCert := createTestLeafCertificate("my.domain.com")
 	secret := apiv1.Secret{
 		ObjectMeta: v1.ObjectMeta{
 			ResourceVersion: "version1",
@@ -109,73 +131,278 @@ func TestCreateOrUpdateCertificate_Update(t *testing.T) {
 			},
 		},
 		Data: map[string][]byte{
-			"tls.crt": []byte("any cert"),
-			"tls.key": []byte("any private key"),
+			"tls.crt": testCert.certPem,
+			"tls.key": testCert.keyPem,
 		},
 	}
-	var functionCalls []string
-	adapter.ListAndExtract = func(c *golangsdk.ServiceClient, opts waf.ListOptsBuilder) ([]waf.Certificate, error) {
-		functionCalls = append(functionCalls, "ListAndExtract")
-		return []waf.Certificate{}, nil
-	}
-	adapter.CreateAndExtract = func(c *golangsdk.ServiceClient, opts waf.CreateOpts) (*waf.Certificate, error) {
-		functionCalls = append(functionCalls, "CreateAndExtract")
-		return &waf.Certificate{Id: "new-id"}, nil
-	}
+	fakeWaf := adapter.NewFakeWafCertificateManager()
+	fakeWaf.AddCertificate(waf.Certificate{Name: "previous-hash", Id: "previous-id"})
+	fakeWaf.AddDomain(wafDomain.Domain{Id: "45656165da65456", HostName: "my.domain.com",
+		CertificateId: "previous-id", Server: []wafDomain.Server{{}}})
+
+	result, _ := NewCertificateService(fakeWaf, DefaultOptions()).CreateOrUpdateCertificate(secret)
 
-	adapter.GetWafDomainAndExtract = func(
-		c *golangsdk.ServiceClient,
-		domainID string) (*wafDomain.Domain, error) {
-		functionCalls = append(functionCalls, "GetWafDomainAndExtract")
-		wafDomainWithServer := wafDomain.Domain{Server: []wafDomain.Server{{}}}
-		return &wafDomainWithServer, nil
+	assert.Equal(t, "cert-1", result.CertIds[TargetWaf])
+	assert.EqualValues(t, []string{"ListCertificates", "GetDomain 45656165da65456", "CreateCertificate",
+		"UpdateDomain 45656165da65456", "DeleteCertificate previous-id"}, fakeWaf.Calls())
+	_, found := fakeWaf.Certificate("previous-id")
+	assert.False(t, found)
+}
+
+func TestCreateOrUpdateCertificate_Fails(t *testing.T) {
+	testCert := createTestLeafCertificate("my.domain.com")
+	secret := apiv1.Secret{
+		Data: map[string][]byte{
+			"tls.crt": testCert.certPem,
+			"tls.key": testCert.keyPem,
+		},
 	}
+	fakeWaf := adapter.NewFakeWafCertificateManager()
+	fakeWaf.FailNext("ListCertificates", golangsdk.BaseError{Info: "error occurred"})
+
+	result, err := NewCertificateService(fakeWaf, DefaultOptions()).CreateOrUpdateCertificate(secret)
 
-	adapter.UpdateDomainAndExtract = func(
-		c *golangsdk.ServiceClient,
-		domainID string,
-		opts wafDomain.UpdateOptsBuilder) (*wafDomain.Domain, error) {
-		functionCalls = append(functionCalls, "UpdateDomainAndExtract")
-		emptyWafDomain := wafDomain.Domain{}
-		return &emptyWafDomain, nil
+	assert.Equal(t, "error occurred", err.Error())
+	assert.Nil(t, result)
+	assert.EqualValues(t, []string{"ListCertificates"}, fakeWaf.Calls())
+}
+
+func TestCreateOrUpdateCertificate_HostnameMismatch(t *testing.T) {
+	testCert := createTestLeafCertificate("my.domain.com")
+	secret := apiv1.Secret{
+		ObjectMeta: v1.ObjectMeta{
+			Annotations: map[string]string{
+				"waf-cert-uploader.iits.tech/waf-domain-id":            "45656165da65456",
+				"waf-cert-uploader.iits.tech/hostname-mismatch-policy": "reject",
+			},
+		},
+		Data: map[string][]byte{
+			"tls.crt": testCert.certPem,
+			"tls.key": testCert.keyPem,
+		},
 	}
-	adapter.DeleteAndExtract = func(c *golangsdk.ServiceClient, id string) (*golangsdk.ErrRespond, error) {
-		functionCalls = append(functionCalls, "DeleteAndExtract")
-		errRespond := golangsdk.ErrRespond{}
-		return &errRespond, nil
+	fakeWaf := adapter.NewFakeWafCertificateManager()
+	fakeWaf.AddDomain(wafDomain.Domain{Id: "45656165da65456", HostName: "typo.domain.com", Server: []wafDomain.Server{{}}})
+
+	result, err := NewCertificateService(fakeWaf, DefaultOptions()).CreateOrUpdateCertificate(secret)
+
+	assert.ErrorIs(t, err, ErrHostnameMismatch)
+	assert.Nil(t, result)
+	assert.EqualValues(t, []string{"ListCertificates", "GetDomain 45656165da65456"}, fakeWaf.Calls())
+}
+
+func TestCreateOrUpdateCertificate_HostnameMismatchWarning(t *testing.T) {
+	testCert := createTestLeafCertificate("my.domain.com")
+	secret := apiv1.Secret{
+		ObjectMeta: v1.ObjectMeta{
+			Annotations: map[string]string{
+				"waf-cert-uploader.iits.tech/waf-domain-id": "45656165da65456",
+			},
+		},
+		Data: map[string][]byte{
+			"tls.crt": testCert.certPem,
+			"tls.key": testCert.keyPem,
+		},
 	}
+	fakeWaf := adapter.NewFakeWafCertificateManager()
+	fakeWaf.AddDomain(wafDomain.Domain{Id: "45656165da65456", HostName: "typo.domain.com", Server: []wafDomain.Server{{}}})
 
-	result, _ := CreateOrUpdateCertificate(secret)
-	assert.Equal(t, "new-id", *result)
-	assert.EqualValues(t, []string{"ListAndExtract", "CreateAndExtract", "GetWafDomainAndExtract",
-		"UpdateDomainAndExtract", "DeleteAndExtract"}, functionCalls)
+	result, err := NewCertificateService(fakeWaf, DefaultOptions()).CreateOrUpdateCertificate(secret)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "cert-1", result.CertIds[TargetWaf])
+	assert.Len(t, result.Warnings, 1)
 }
 
-func TestCreateOrUpdateCertificate_Fails(t *testing.T) {
-	setupWafTestClient()
+func TestCreateOrUpdateCertificate_InvalidCertificate(t *testing.T) {
 	secret := apiv1.Secret{
 		Data: map[string][]byte{
 			"tls.crt": []byte("any cert"),
 			"tls.key": []byte("any private key"),
 		},
 	}
-	var functionCalls []string
+	fakeWaf := adapter.NewFakeWafCertificateManager()
+
+	result, err := NewCertificateService(fakeWaf, DefaultOptions()).CreateOrUpdateCertificate(secret)
 
-	adapter.ListAndExtract = func(c *golangsdk.ServiceClient, opts waf.ListOptsBuilder) ([]waf.Certificate, error) {
-		functionCalls = append(functionCalls, "ListAndExtract")
-		return []waf.Certificate{}, golangsdk.BaseError{Info: "error occurred"}
+	assert.ErrorIs(t, err, ErrNoCertificate)
+	assert.Nil(t, result)
+	assert.Empty(t, fakeWaf.Calls())
+}
+
+func TestCreateOrUpdateCertificate_MultipleDomains(t *testing.T) {
+	testCert := createTestLeafCertificate("*.domain.com")
+	secret := apiv1.Secret{
+		ObjectMeta: v1.ObjectMeta{
+			Annotations: map[string]string{
+				"waf-cert-uploader.iits.tech/cert-waf-id":   "previous-id",
+				"waf-cert-uploader.iits.tech/waf-domain-id": "domain-1, domain-2",
+			},
+		},
+		Data: map[string][]byte{
+			"tls.crt": testCert.certPem,
+			"tls.key": testCert.keyPem,
+		},
 	}
+	fakeWaf := adapter.NewFakeWafCertificateManager()
+	fakeWaf.AddCertificate(waf.Certificate{Name: "previous-hash", Id: "previous-id"})
+	fakeWaf.AddDomain(wafDomain.Domain{Id: "domain-1", HostName: "domain-1.domain.com", Server: []wafDomain.Server{{}}})
+	fakeWaf.AddDomain(wafDomain.Domain{Id: "domain-2", HostName: "domain-2.domain.com", Server: []wafDomain.Server{{}}})
 
-	result, err := CreateOrUpdateCertificate(secret)
+	result, err := NewCertificateService(fakeWaf, DefaultOptions()).CreateOrUpdateCertificate(secret)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "cert-1", result.CertIds[TargetWaf])
+	assert.EqualValues(t, []DomainAttachment{{DomainId: "domain-1"}, {DomainId: "domain-2"}},
+		result.Attachments[TargetWaf])
+	assert.Equal(t, "cert-1", fakeWaf.Domain("domain-1").CertificateId)
+	assert.Equal(t, "cert-1", fakeWaf.Domain("domain-2").CertificateId)
+	assert.EqualValues(t, []string{"ListCertificates", "GetDomain domain-1", "GetDomain domain-2",
+		"CreateCertificate", "UpdateDomain domain-1", "UpdateDomain domain-2", "DeleteCertificate previous-id"},
+		fakeWaf.Calls())
+}
+
+func TestCreateOrUpdateCertificate_MultipleDomainsPartialFailure(t *testing.T) {
+	testCert := createTestLeafCertificate("*.domain.com")
+	secret := apiv1.Secret{
+		ObjectMeta: v1.ObjectMeta{
+			Annotations: map[string]string{
+				"waf-cert-uploader.iits.tech/cert-waf-id":   "previous-id",
+				"waf-cert-uploader.iits.tech/waf-domain-id": "domain-1,domain-2",
+			},
+		},
+		Data: map[string][]byte{
+			"tls.crt": testCert.certPem,
+			"tls.key": testCert.keyPem,
+		},
+	}
+	fakeWaf := adapter.NewFakeWafCertificateManager()
+	for _, domainId := range []string{"domain-1", "domain-2"} {
+		fakeWaf.AddDomain(wafDomain.Domain{
+			Id:            domainId,
+			HostName:      domainId + ".domain.com",
+			CertificateId: "previous-id",
+			Server:        []wafDomain.Server{{Address: "10.0.0.1", ClientProtocol: "HTTP", ServerProtocol: "HTTP", Port: 80}},
+		})
+	}
+	fakeWaf.FailNext("UpdateDomain domain-1", golangsdk.BaseError{Info: "update failed"})
+
+	result, err := NewCertificateService(fakeWaf, DefaultOptions()).CreateOrUpdateCertificate(secret)
 
-	assert.Equal(t, "error occurred", err.Error())
 	assert.Nil(t, result)
-	assert.EqualValues(t, []string{"ListAndExtract"}, functionCalls)
+	assert.Equal(t, "certificate cert-1 couldn't be attached to all waf domains "+
+		"(domain-1: update failed), the previous certificate was restored on domain-2", err.Error())
+	assert.EqualValues(t, []string{"ListCertificates", "GetDomain domain-1", "GetDomain domain-2", "CreateCertificate",
+		"UpdateDomain domain-1", "UpdateDomain domain-2", "UpdateDomain domain-2", "DeleteCertificate cert-1"},
+		fakeWaf.Calls())
+	assert.Equal(t, "previous-id", fakeWaf.Domain("domain-2").CertificateId)
+	assert.Len(t, fakeWaf.Domain("domain-2").Server, 1)
 }
 
-func setupWafTestClient() {
-	provider := &golangsdk.ProviderClient{}
-	WafClient = &golangsdk.ServiceClient{
-		ProviderClient: provider,
+func TestCreateOrUpdateCertificate_RollbackKeepsCertificateOfDomainWithoutPreviousCertificate(t *testing.T) {
+	testCert := createTestLeafCertificate("*.domain.com")
+	secret := apiv1.Secret{
+		ObjectMeta: v1.ObjectMeta{
+			Annotations: map[string]string{
+				"waf-cert-uploader.iits.tech/waf-domain-id": "domain-1,domain-2",
+			},
+		},
+		Data: map[string][]byte{
+			"tls.crt": testCert.certPem,
+			"tls.key": testCert.keyPem,
+		},
 	}
+	fakeWaf := adapter.NewFakeWafCertificateManager()
+	fakeWaf.AddDomain(wafDomain.Domain{Id: "domain-1", HostName: "domain-1.domain.com", Server: []wafDomain.Server{{}}})
+	fakeWaf.AddDomain(wafDomain.Domain{Id: "domain-2", HostName: "domain-2.domain.com", Server: []wafDomain.Server{{}}})
+	fakeWaf.FailNext("UpdateDomain domain-1", golangsdk.BaseError{Info: "update failed"})
+
+	result, err := NewCertificateService(fakeWaf, DefaultOptions()).CreateOrUpdateCertificate(secret)
+
+	assert.Nil(t, result)
+	assert.Equal(t, "certificate cert-1 couldn't be attached to all waf domains "+
+		"(domain-1: update failed), it is still attached to domain-2", err.Error())
+	assert.EqualValues(t, []string{"ListCertificates", "GetDomain domain-1", "GetDomain domain-2", "CreateCertificate",
+		"UpdateDomain domain-1", "UpdateDomain domain-2"}, fakeWaf.Calls())
+	_, found := fakeWaf.Certificate("cert-1")
+	assert.True(t, found)
+	assert.Equal(t, "cert-1", fakeWaf.Domain("domain-2").CertificateId)
+
+	result, err = NewCertificateService(fakeWaf, DefaultOptions()).CreateOrUpdateCertificate(secret)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "cert-1", result.CertIds[TargetWaf])
+	assert.EqualValues(t, []string{"ListCertificates", "GetDomain domain-1", "GetDomain domain-2",
+		"UpdateDomain domain-1"}, fakeWaf.Calls()[6:])
+}
+
+func TestCreateOrUpdateCertificate_RollbackOnAttachFailure(t *testing.T) {
+	testCert := createTestLeafCertificate("my.domain.com")
+	secret := apiv1.Secret{
+		ObjectMeta: v1.ObjectMeta{
+			Annotations: map[string]string{
+				"waf-cert-uploader.iits.tech/cert-waf-id":   "previous-id",
+				"waf-cert-uploader.iits.tech/waf-domain-id": "45656165da65456",
+			},
+		},
+		Data: map[string][]byte{
+			"tls.crt": testCert.certPem,
+			"tls.key": testCert.keyPem,
+		},
+	}
+	fakeWaf := adapter.NewFakeWafCertificateManager()
+	fakeWaf.AddDomain(wafDomain.Domain{Id: "45656165da65456", HostName: "my.domain.com",
+		CertificateId: "previous-id", Server: []wafDomain.Server{{}}})
+	fakeWaf.FailNext("UpdateDomain 45656165da65456", golangsdk.BaseError{Info: "update failed"})
+
+	result, err := NewCertificateService(fakeWaf, DefaultOptions()).CreateOrUpdateCertificate(secret)
+
+	assert.Nil(t, result)
+	assert.NotNil(t, err)
+	assert.EqualValues(t, []string{"ListCertificates", "GetDomain 45656165da65456", "CreateCertificate",
+		"UpdateDomain 45656165da65456", "DeleteCertificate cert-1"}, fakeWaf.Calls())
+	_, found := fakeWaf.Certificate("cert-1")
+	assert.False(t, found)
+}
+
+func TestParseAnnotationList(t *testing.T) {
+	assert.Nil(t, parseAnnotationList(""))
+	assert.EqualValues(t, []string{"a"}, parseAnnotationList("a"))
+	assert.EqualValues(t, []string{"a", "b"}, parseAnnotationList(" a, b,,a "))
+}
+
+func TestGetNewServerOpts_PreservesExistingServers(t *testing.T) {
+	existingDomain := wafDomain.Domain{Server: []wafDomain.Server{
+		{ClientProtocol: "HTTP", ServerProtocol: "HTTP", Address: "10.0.0.1", Port: 8080},
+		{ClientProtocol: "HTTP", ServerProtocol: "HTTP", Address: "10.0.0.2", Port: 8080},
+		{ClientProtocol: "HTTPS", ServerProtocol: "HTTPS", Address: "10.0.0.2", Port: 8443},
+		{ClientProtocol: "HTTPS", ServerProtocol: "HTTPS", Address: "10.0.0.3", Port: 9443},
+	}}
+
+	result := getNewServerOpts(existingDomain, HttpsBackend{ServerProtocol: "HTTP", Port: 8080})
+
+	assert.EqualValues(t, []wafDomain.ServerOpts{
+		{ClientProtocol: "HTTP", ServerProtocol: "HTTP", Address: "10.0.0.1", Port: 8080},
+		{ClientProtocol: "HTTP", ServerProtocol: "HTTP", Address: "10.0.0.2", Port: 8080},
+		{ClientProtocol: "HTTPS", ServerProtocol: "HTTPS", Address: "10.0.0.2", Port: 8443},
+		{ClientProtocol: "HTTPS", ServerProtocol: "HTTPS", Address: "10.0.0.3", Port: 9443},
+		{ClientProtocol: "HTTPS", ServerProtocol: "HTTP", Address: "10.0.0.1", Port: 8080},
+	}, result)
+}
+
+func TestParseHttpsBackend(t *testing.T) {
+	defaultHttpsBackend := DefaultOptions().HttpsBackend
+	result, err := ParseHttpsBackend(defaultHttpsBackend, "", "")
+	assert.Nil(t, err)
+	assert.Equal(t, HttpsBackend{ServerProtocol: "HTTPS", Port: 443}, result)
+
+	result, err = ParseHttpsBackend(defaultHttpsBackend, "http", "8080")
+	assert.Nil(t, err)
+	assert.Equal(t, HttpsBackend{ServerProtocol: "HTTP", Port: 8080}, result)
+
+	_, err = ParseHttpsBackend(defaultHttpsBackend, "TCP", "")
+	assert.Equal(t, `unknown https server protocol "TCP"`, err.Error())
+
+	_, err = ParseHttpsBackend(defaultHttpsBackend, "", "70000")
+	assert.Equal(t, `invalid https server port "70000"`, err.Error())
 }
@@ -0,0 +1,44 @@
+package service
+
+import (
+	"fmt"
+	apiv1 "k8s.io/api/core/v1"
+	"log"
+	"strings"
+)
+
+const wafTypeAnnotation = "waf-cert-uploader.iits.tech/waf-type"
+
+// WafType selects the waf a certificate is uploaded to, the cloud waf or a dedicated waf instance.
+type WafType string
+
+const (
+	WafTypeCloud     WafType = "cloud"
+	WafTypeDedicated WafType = "dedicated"
+)
+
+var wafTypes = []WafType{WafTypeCloud, WafTypeDedicated}
+
+const DefaultWafType = WafTypeCloud
+
+func ParseWafType(value string) (WafType, error) {
+	switch wafType := WafType(strings.ToLower(strings.TrimSpace(value))); wafType {
+	case WafTypeCloud, WafTypeDedicated:
+		return wafType, nil
+	default:
+		return "", fmt.Errorf("unknown waf type %q, expected %s or %s", value, WafTypeCloud, WafTypeDedicated)
+	}
+}
+
+func getWafType(secret apiv1.Secret, defaultWafType WafType) (WafType, error) {
+	wafTypeValue, found := secret.Annotations[wafTypeAnnotation]
+	if !found {
+		return defaultWafType, nil
+	}
+	wafType, err := ParseWafType(wafTypeValue)
+	if err != nil {
+		log.Println("invalid waf type annotation", err)
+		return "", fmt.Errorf("%w: %w", ErrInvalidConfiguration, err)
+	}
+	return wafType, nil
+}
@@ -0,0 +1,124 @@
+package service
+
+import (
+	"errors"
+	elbListener "github.com/opentelekomcloud/gophertelekomcloud/openstack/elb/v3/listeners"
+	wafDomain "github.com/opentelekomcloud/gophertelekomcloud/openstack/waf/v1/domains"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	"testing"
+	"waf-cert-uploader/adapter"
+)
+
+func getWafTypeTestSecret(wafType string, testCert testCertificate) apiv1.Secret {
+	secret := getDriftTestSecret("my", "", testCert)
+	if len(wafType) > 0 {
+		secret.Annotations[wafTypeAnnotation] = wafType
+	}
+	return secret
+}
+
+func TestCertificateServices_routesByWafType(t *testing.T) {
+	testCert := createTestLeafCertificate("my.domain.com")
+	cloudWaf := adapter.NewFakeWafCertificateManager()
+	cloudWaf.AddDomain(wafDomain.Domain{Id: "my-domain", HostName: "my.domain.com"})
+	dedicatedWaf := adapter.NewFakeWafCertificateManager()
+	dedicatedWaf.AddDomain(wafDomain.Domain{Id: "my-domain", HostName: "my.domain.com"})
+	certificateServices := NewCertificateServices(map[WafType]*CertificateService{
+		WafTypeCloud:     NewCertificateService(cloudWaf, DefaultOptions()),
+		WafTypeDedicated: NewCertificateService(dedicatedWaf, DefaultOptions()),
+	}, DefaultOptions())
+
+	_, err := certificateServices.CreateOrUpdateCertificate(getWafTypeTestSecret("dedicated", testCert))
+
+	assert.Nil(t, err)
+	assert.Empty(t, cloudWaf.Calls())
+	assert.Equal(t, "cert-1", dedicatedWaf.Domain("my-domain").CertificateId)
+
+	_, err = certificateServices.CreateOrUpdateCertificate(getWafTypeTestSecret("", testCert))
+
+	assert.Nil(t, err)
+	assert.Equal(t, "cert-1", cloudWaf.Domain("my-domain").CertificateId)
+}
+
+func TestCertificateServices_wafTypeNotConfigured(t *testing.T) {
+	testCert := createTestLeafCertificate("my.domain.com")
+	cloudWaf := adapter.NewFakeWafCertificateManager()
+	certificateServices := NewCertificateServices(map[WafType]*CertificateService{
+		WafTypeCloud: NewCertificateService(cloudWaf, DefaultOptions()),
+	}, DefaultOptions())
+
+	_, err := certificateServices.CreateOrUpdateCertificate(getWafTypeTestSecret("dedicated", testCert))
+
+	assert.True(t, errors.Is(err, ErrInvalidConfiguration))
+	assert.Equal(t, "invalid secret configuration: the dedicated waf is not configured", err.Error())
+	assert.Empty(t, cloudWaf.Calls())
+}
+
+func TestParseWafType(t *testing.T) {
+	wafType, err := ParseWafType(" Dedicated ")
+	assert.Nil(t, err)
+	assert.Equal(t, WafTypeDedicated, wafType)
+
+	_, err = ParseWafType("premium")
+	assert.Equal(t, `unknown waf type "premium", expected cloud or dedicated`, err.Error())
+}
+
+func TestValidateSecret_invalidWafType(t *testing.T) {
+	testCert := createTestLeafCertificate("my.domain.com")
+
+	_, err := NewCertificateServices(nil, DefaultOptions()).ValidateSecret(getWafTypeTestSecret("premium", testCert))
+
+	assert.True(t, errors.Is(err, ErrInvalidConfiguration))
+}
+
+func TestCertificateServices_elbOnly(t *testing.T) {
+	testCert := createTestLeafCertificate("my.domain.com")
+	cloudWaf := adapter.NewFakeWafCertificateManager()
+	fakeElb := adapter.NewFakeElbCertificateManager()
+	fakeElb.AddListener(elbListener.Listener{ID: "listener-1", Protocol: "HTTPS"})
+	certificateServices := NewCertificateServices(map[WafType]*CertificateService{
+		WafTypeCloud: NewCertificateService(cloudWaf, DefaultOptions()),
+	}, DefaultOptions())
+	certificateServices.RegisterTarget(TargetElb, NewElbCertificateService(fakeElb, DefaultOptions()))
+	secret := getElbTestSecret(testCert, map[string]string{"waf-cert-uploader.iits.tech/elb-listener-id": "listener-1"})
+
+	result, err := certificateServices.CreateOrUpdateCertificate(secret)
+
+	assert.Nil(t, err)
+	assert.Equal(t, map[TargetName]string{TargetElb: "elb-cert-1"}, result.CertIds)
+	assert.Empty(t, cloudWaf.Calls())
+}
+
+func TestCertificateServices_wafAndElb(t *testing.T) {
+	testCert := createTestLeafCertificate("my.domain.com")
+	cloudWaf := adapter.NewFakeWafCertificateManager()
+	cloudWaf.AddDomain(wafDomain.Domain{Id: "my-domain", HostName: "my.domain.com"})
+	fakeElb := adapter.NewFakeElbCertificateManager()
+	fakeElb.AddListener(elbListener.Listener{ID: "listener-1", Protocol: "HTTPS"})
+	certificateServices := NewCertificateServices(map[WafType]*CertificateService{
+		WafTypeCloud: NewCertificateService(cloudWaf, DefaultOptions()),
+	}, DefaultOptions())
+	certificateServices.RegisterTarget(TargetElb, NewElbCertificateService(fakeElb, DefaultOptions()))
+	secret := getWafTypeTestSecret("", testCert)
+	secret.Annotations["waf-cert-uploader.iits.tech/elb-listener-id"] = "listener-1"
+
+	result, err := certificateServices.CreateOrUpdateCertificate(secret)
+
+	assert.Nil(t, err)
+	assert.Equal(t, map[TargetName]string{TargetWaf: "cert-1", TargetElb: "elb-cert-1"}, result.CertIds)
+	assert.Equal(t, "cert-1", cloudWaf.Domain("my-domain").CertificateId)
+	assert.Equal(t, "elb-cert-1", fakeElb.Listener("listener-1").DefaultTlsContainerRef)
+}
+
+func TestCertificateServices_elbNotConfigured(t *testing.T) {
+	testCert := createTestLeafCertificate("my.domain.com")
+	certificateServices := NewCertificateServices(map[WafType]*CertificateService{
+		WafTypeCloud: NewCertificateService(adapter.NewFakeWafCertificateManager(), DefaultOptions()),
+	}, DefaultOptions())
+	secret := getElbTestSecret(testCert, map[string]string{"waf-cert-uploader.iits.tech/elb-listener-id": "listener-1"})
+
+	_, err := certificateServices.CreateOrUpdateCertificate(secret)
+
+	assert.Equal(t, "invalid secret configuration: the elb target is not configured", err.Error())
+}